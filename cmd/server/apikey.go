@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"shortener/internal/db"
+	"shortener/internal/shared"
+	"shortener/internal/shorten"
+)
+
+const apiKeyUsage = "usage: server apikey create [-owner <owner>] <name> <scope>... | list | revoke <id>"
+
+// runAPIKey manages API keys straight in the database, which is how the first admin key is made
+func runAPIKey(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New(apiKeyUsage)
+	}
+
+	sqlDB, err := db.Connect(ctx, dbConfig())
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	keys := shared.NewKeyAuth(shorten.NewPGStore(sqlDB))
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("create", flag.ContinueOnError)
+		owner := flags.String("owner", "", "owner of the links the key creates (default: the key's name)")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() < 2 {
+			return errors.New(apiKeyUsage)
+		}
+		scopes, err := shared.ParseScopes(flags.Args()[1:])
+		if err != nil {
+			return err
+		}
+		secret, key, err := keys.Mint(ctx, flags.Arg(0), *owner, scopes)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("id:    %s\nowner: %s\nkey:   %s\n", key.ID, key.Owner, secret)
+		fmt.Fprintln(os.Stderr, "the key is not stored and can't be shown again")
+
+	case "list":
+		if len(args) != 1 {
+			return errors.New(apiKeyUsage)
+		}
+		list, err := keys.List(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tOWNER\tSCOPES\tCREATED\tLAST USED\tREVOKED")
+		for _, key := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%s\t%s\t%s\n",
+				key.ID, key.Name, key.Owner, key.Scopes, key.CreatedAt.Format(time.DateTime), formatOptionalTime(key.LastUsedAt), formatOptionalTime(key.RevokedAt))
+		}
+		return tw.Flush()
+
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New(apiKeyUsage)
+		}
+		return keys.Revoke(ctx, args[1])
+
+	default:
+		return errors.New(apiKeyUsage)
+	}
+
+	return nil
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.DateTime)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"shortener/internal/shared"
+	"shortener/internal/shorten"
+)
+
+// Runtime settings come from the environment, falling back to defaults that suit local development.
+
+// envDuration reads a duration such as "90s" or "1h" from the environment
+func envDuration(key string, fallback time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		log.Printf("config: ignoring invalid %s=%q, using %s", key, raw, fallback)
+		return fallback
+	}
+
+	return d
+}
+
+// envInt reads a positive integer from the environment
+func envInt(key string, fallback int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		log.Printf("config: ignoring invalid %s=%q, using %d", key, raw, fallback)
+		return fallback
+	}
+
+	return n
+}
+
+// envBool reads a true/false flag (anything strconv.ParseBool accepts) from the environment
+func envBool(key string, fallback bool) bool {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Printf("config: ignoring invalid %s=%q, using %t", key, raw, fallback)
+		return fallback
+	}
+
+	return b
+}
+
+// newIDGenerator picks the short ID generator from SHORTENER_ID_GENERATOR:
+//   - "counter" (default): sequential base62, counter blocks reserved from alloc
+//   - "random": crypto/rand IDs of SHORTENER_ID_LENGTH characters from SHORTENER_ID_ALPHABET
+//   - "permuted": the counter, scrambled with the secret SHORTENER_ID_KEY over SHORTENER_ID_BITS bits
+func newIDGenerator(alloc shorten.CounterAllocator) (shorten.IDGenerator, error) {
+	switch kind := os.Getenv("SHORTENER_ID_GENERATOR"); kind {
+	case "", "counter":
+		// reserve counter blocks from Postgres so IDs don't restart from 1 after a deploy
+		return shorten.NewBlockBase62Generator(alloc, uint64(envInt("SHORTENER_ID_BLOCK_SIZE", 100))), nil
+	case "random":
+		return shorten.NewRandomGenerator(envInt("SHORTENER_ID_LENGTH", 8), os.Getenv("SHORTENER_ID_ALPHABET"))
+	case "permuted":
+		return newPermutedGenerator(alloc)
+	default:
+		return nil, fmt.Errorf("unknown SHORTENER_ID_GENERATOR %q", kind)
+	}
+}
+
+// newPermutedGenerator is shared by the server and the decode-id tool, which must agree on key and bits
+func newPermutedGenerator(alloc shorten.CounterAllocator) (*shorten.PermutedGenerator, error) {
+	key := os.Getenv("SHORTENER_ID_KEY")
+	if key == "" {
+		return nil, fmt.Errorf("SHORTENER_ID_KEY is required for permuted ids")
+	}
+
+	return shorten.NewPermutedGenerator(
+		[]byte(key),
+		envInt("SHORTENER_ID_BITS", 40),
+		alloc,
+		uint64(envInt("SHORTENER_ID_BLOCK_SIZE", 100)),
+	)
+}
+
+// visitorSalt is the secret SHORTENER_VISITOR_SALT that keys the hash of visitor IPs.
+// Without it a random salt is used, so visitors can't be matched across restarts or replicas
+func visitorSalt() []byte {
+	if salt := os.Getenv("SHORTENER_VISITOR_SALT"); salt != "" {
+		return []byte(salt)
+	}
+
+	log.Printf("config: SHORTENER_VISITOR_SALT is not set, using a random salt")
+	return []byte(rand.Text())
+}
+
+// newBotClassifier adds the comma-separated User-Agent substrings in SHORTENER_BOT_PATTERNS to the
+// default bot patterns. SHORTENER_BOT_METHODS replaces the default HEAD,OPTIONS if set
+func newBotClassifier() *shorten.BotClassifier {
+	patterns := shorten.DefaultBotPatterns()
+	if raw := os.Getenv("SHORTENER_BOT_PATTERNS"); raw != "" {
+		patterns = append(patterns, strings.Split(raw, ",")...)
+	}
+
+	methods := shorten.DefaultBotMethods
+	if raw, ok := os.LookupEnv("SHORTENER_BOT_METHODS"); ok {
+		methods = strings.Split(raw, ",")
+	}
+
+	return shorten.NewBotClassifier(patterns, methods)
+}
+
+// envRatePolicy reads a rate limit such as "60/1m" (60 requests a minute, all of which may come
+// at once) from the environment. "off" turns the limit off
+func envRatePolicy(key, fallback string) shared.RatePolicy {
+	raw := os.Getenv(key)
+	if raw == "" {
+		raw = fallback
+	}
+	if raw == "off" {
+		return shared.RatePolicy{}
+	}
+
+	policy, err := parseRatePolicy(raw)
+	if err != nil {
+		log.Printf("config: ignoring invalid %s=%q, using %s", key, raw, fallback)
+		policy, _ = parseRatePolicy(fallback)
+	}
+	return policy
+}
+
+func parseRatePolicy(raw string) (shared.RatePolicy, error) {
+	count, period, ok := strings.Cut(raw, "/")
+	if !ok {
+		return shared.RatePolicy{}, fmt.Errorf("expected <requests>/<duration>, got %q", raw)
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return shared.RatePolicy{}, fmt.Errorf("bad request count %q", count)
+	}
+	per, err := time.ParseDuration(period)
+	if err != nil || per <= 0 {
+		return shared.RatePolicy{}, fmt.Errorf("bad duration %q", period)
+	}
+
+	return shared.RatePolicy{Rate: float64(n) / per.Seconds(), Burst: n}, nil
+}
+
+// trustedProxies reads SHORTENER_TRUSTED_PROXIES, the addresses and CIDR ranges of the proxies
+// whose X-Forwarded-For can be believed. With none set, clients are told apart by their own address
+func trustedProxies() []netip.Prefix {
+	raw := os.Getenv("SHORTENER_TRUSTED_PROXIES")
+	prefixes, err := shared.ParseTrustedProxies(raw)
+	if err != nil {
+		log.Printf("config: ignoring invalid SHORTENER_TRUSTED_PROXIES=%q: %v", raw, err)
+		return nil
+	}
+	return prefixes
+}
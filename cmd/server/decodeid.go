@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// runDecodeID prints the counter value behind each permuted short ID.
+// It needs the same SHORTENER_ID_KEY and SHORTENER_ID_BITS the server generated them with.
+func runDecodeID(ids []string) error {
+	if len(ids) == 0 {
+		return errors.New("usage: server decode-id <id>...")
+	}
+
+	generator, err := newPermutedGenerator(nil)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		n, err := generator.Decode(id)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		fmt.Printf("%s\t%d\n", id, n)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"shortener/internal/db"
+)
+
+const migrateUsage = "usage: server migrate up|down|status"
+
+func runMigrate(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New(migrateUsage)
+	}
+
+	sqlDB, err := db.Connect(ctx, dbConfig())
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp(ctx, sqlDB)
+		for _, m := range applied {
+			log.Printf("applied %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			log.Println("schema is up to date")
+		}
+
+	case "down":
+		m, err := db.MigrateDown(ctx, sqlDB)
+		if err != nil {
+			return err
+		}
+		log.Printf("reverted %04d_%s", m.Version, m.Name)
+
+	case "status":
+		statuses, err := db.MigrationStatuses(ctx, sqlDB)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, state)
+		}
+
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	return nil
+}
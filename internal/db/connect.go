@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"time"
@@ -15,7 +16,7 @@ type Config struct {
 	SSLMode  string
 }
 
-func Connect(cfg Config) (*sql.DB, error) {
+func Connect(ctx context.Context, cfg Config) (*sql.DB, error) {
 	dsn := fmt.Sprintf(
 		"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
 		cfg.Host,
@@ -36,7 +37,8 @@ func Connect(cfg Config) (*sql.DB, error) {
 	db.SetMaxIdleConns(25)
 	db.SetConnMaxLifetime(5 * time.Minute)
 
-	if err := db.Ping(); err != nil {
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
 		return nil, err
 	}
 	return db, nil
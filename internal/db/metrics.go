@@ -0,0 +1,37 @@
+package db
+
+import (
+	"database/sql"
+
+	"shortener/internal/metrics"
+)
+
+// RegisterMetrics exports the connection pool's stats (sql.DB.Stats) to reg
+func RegisterMetrics(reg *metrics.Registry, db *sql.DB) {
+	gauge := func(name, help string, value func(sql.DBStats) float64) {
+		reg.GaugeFunc(name, help, nil, func() float64 { return value(db.Stats()) })
+	}
+	counter := func(name, help string, value func(sql.DBStats) float64) {
+		reg.CounterFunc(name, help, nil, func() float64 { return value(db.Stats()) })
+	}
+
+	gauge("db_pool_max_open_connections", "Most connections the pool may open.",
+		func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) })
+	gauge("db_pool_open_connections", "Connections open, in use or idle.",
+		func(s sql.DBStats) float64 { return float64(s.OpenConnections) })
+	gauge("db_pool_in_use_connections", "Connections currently in use.",
+		func(s sql.DBStats) float64 { return float64(s.InUse) })
+	gauge("db_pool_idle_connections", "Connections currently idle.",
+		func(s sql.DBStats) float64 { return float64(s.Idle) })
+
+	counter("db_pool_wait_count_total", "Times a query had to wait for a free connection.",
+		func(s sql.DBStats) float64 { return float64(s.WaitCount) })
+	counter("db_pool_wait_seconds_total", "Time spent waiting for a free connection.",
+		func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() })
+	counter("db_pool_max_idle_closed_total", "Connections closed because the pool had too many idle ones.",
+		func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) })
+	counter("db_pool_max_idle_time_closed_total", "Connections closed for being idle too long.",
+		func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) })
+	counter("db_pool_max_lifetime_closed_total", "Connections closed for reaching their maximum lifetime.",
+		func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) })
+}
@@ -0,0 +1,331 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration files live in ./migrations and are named <version>_<name>.<up|down>.sql,
+// e.g. 0001_create_link.up.sql. They are compiled into the binary so a deploy never
+// depends on the SQL being present on disk.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Arbitrary, but fixed, key for pg_advisory_lock. Every replica uses the same key,
+// so only one of them can be migrating at any given time.
+const migrationLockKey = 727_274_001
+
+var ErrNoMigrations = errors.New("no migrations to roll back")
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// LoadMigrations reads the embedded migration files and returns them sorted by version.
+// Every version must have both an up and a down file.
+func LoadMigrations() ([]Migration, error) {
+	return loadMigrations(migrationFiles, "migrations")
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		version, name, direction, err := parseMigrationName(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		contents, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %04d has conflicting names %q and %q", version, m.Name, name)
+		}
+
+		switch direction {
+		case "up":
+			m.Up = string(contents)
+		case "down":
+			m.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s must have both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// parseMigrationName splits "0001_create_link.up.sql" into (1, "create_link", "up")
+func parseMigrationName(filename string) (int, string, string, error) {
+	base, ok := strings.CutSuffix(filename, ".sql")
+	if !ok {
+		return 0, "", "", fmt.Errorf("migration %q: expected .sql extension", filename)
+	}
+
+	var direction string
+	switch {
+	case strings.HasSuffix(base, ".up"):
+		direction = "up"
+	case strings.HasSuffix(base, ".down"):
+		direction = "down"
+	default:
+		return 0, "", "", fmt.Errorf("migration %q: expected .up.sql or .down.sql", filename)
+	}
+	base = strings.TrimSuffix(base, "."+direction)
+
+	rawVersion, name, ok := strings.Cut(base, "_")
+	if !ok || name == "" {
+		return 0, "", "", fmt.Errorf("migration %q: expected <version>_<name>", filename)
+	}
+
+	version, err := strconv.Atoi(rawVersion)
+	if err != nil || version <= 0 {
+		return 0, "", "", fmt.Errorf("migration %q: invalid version %q", filename, rawVersion)
+	}
+
+	return version, name, direction, nil
+}
+
+// MigrateUp applies every migration that hasn't been applied yet, in version order.
+// Each migration runs in its own transaction. It returns the migrations it applied.
+func MigrateUp(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+
+	err = withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		done, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := done[m.Version]; ok {
+				continue
+			}
+
+			if err := runMigration(ctx, conn, m.Up, func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, `
+				INSERT INTO schema_migrations (version, name, applied_at)
+				VALUES ($1, $2, NOW())
+				`, m.Version, m.Name)
+				return err
+			}); err != nil {
+				return fmt.Errorf("migration %04d_%s up: %w", m.Version, m.Name, err)
+			}
+
+			applied = append(applied, m)
+		}
+		return nil
+	})
+
+	return applied, err
+}
+
+// MigrateDown rolls back the most recently applied migration and returns it.
+// It returns ErrNoMigrations if nothing has been applied.
+func MigrateDown(ctx context.Context, db *sql.DB) (Migration, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return Migration{}, err
+	}
+
+	var reverted Migration
+
+	err = withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		done, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		// walk backwards so we revert the latest applied version
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			if _, ok := done[m.Version]; !ok {
+				continue
+			}
+
+			if err := runMigration(ctx, conn, m.Down, func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, `
+				DELETE FROM schema_migrations
+				WHERE version = $1
+				`, m.Version)
+				return err
+			}); err != nil {
+				return fmt.Errorf("migration %04d_%s down: %w", m.Version, m.Name, err)
+			}
+
+			reverted = m
+			return nil
+		}
+
+		return ErrNoMigrations
+	})
+
+	return reverted, err
+}
+
+// MigrationStatuses lists every known migration and whether it has been applied.
+func MigrationStatuses(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := ensureMigrationsTable(ctx, conn); err != nil {
+		return nil, err
+	}
+
+	done, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, ok := done[m.Version]
+		statuses = append(statuses, MigrationStatus{
+			Version:   m.Version,
+			Name:      m.Name,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+
+	return statuses, nil
+}
+
+// withMigrationLock pins a single connection (advisory locks belong to a session, so
+// we can't let database/sql hand us a different pooled connection halfway through),
+// takes the advisory lock, and makes sure the tracking table exists before calling fn.
+func withMigrationLock(ctx context.Context, db *sql.DB, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer func() {
+		// use a fresh context so the lock is still released if ctx was cancelled
+		_, _ = conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+	}()
+
+	if err := ensureMigrationsTable(ctx, conn); err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+func ensureMigrationsTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)
+	`)
+	return err
+}
+
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `
+	SELECT version, applied_at
+	FROM schema_migrations
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		done[version] = appliedAt
+	}
+
+	return done, rows.Err()
+}
+
+// runMigration executes the migration SQL and the schema_migrations bookkeeping in one
+// transaction, so a failed migration never leaves the tracking table out of sync.
+func runMigration(ctx context.Context, conn *sql.Conn, script string, record func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+
+	if err := record(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
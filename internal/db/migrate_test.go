@@ -0,0 +1,94 @@
+package db
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations_Embedded(t *testing.T) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(migrations) == 0 {
+		t.Fatal("expected at least one embedded migration")
+	}
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("expected versions to be contiguous from 1, got %d at position %d", m.Version, i)
+		}
+		if m.Up == "" || m.Down == "" {
+			t.Fatalf("migration %d is missing an up or down script", m.Version)
+		}
+	}
+}
+
+func TestLoadMigrations_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{
+			"missing down file",
+			fstest.MapFS{
+				"m/0001_init.up.sql": {Data: []byte("SELECT 1;")},
+			},
+		},
+		{
+			"bad direction",
+			fstest.MapFS{
+				"m/0001_init.sideways.sql": {Data: []byte("SELECT 1;")},
+			},
+		},
+		{
+			"bad version",
+			fstest.MapFS{
+				"m/abc_init.up.sql":   {Data: []byte("SELECT 1;")},
+				"m/abc_init.down.sql": {Data: []byte("SELECT 1;")},
+			},
+		},
+		{
+			"conflicting names",
+			fstest.MapFS{
+				"m/0001_init.up.sql":    {Data: []byte("SELECT 1;")},
+				"m/0001_other.down.sql": {Data: []byte("SELECT 1;")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadMigrations(tt.files, "m"); err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestLoadMigrations_Sorted(t *testing.T) {
+	files := fstest.MapFS{
+		"m/0002_second.up.sql":   {Data: []byte("SELECT 2;")},
+		"m/0002_second.down.sql": {Data: []byte("SELECT -2;")},
+		"m/0001_first.up.sql":    {Data: []byte("SELECT 1;")},
+		"m/0001_first.down.sql":  {Data: []byte("SELECT -1;")},
+	}
+
+	migrations, err := loadMigrations(files, "m")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(migrations))
+	}
+
+	if migrations[0].Name != "first" || migrations[1].Name != "second" {
+		t.Fatalf("expected [first second], got [%s %s]", migrations[0].Name, migrations[1].Name)
+	}
+
+	if migrations[1].Down != "SELECT -2;" {
+		t.Fatalf("expected down script to be loaded, got %q", migrations[1].Down)
+	}
+}
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS link (
+    short_id     TEXT PRIMARY KEY,
+    original_url TEXT NOT NULL,
+    hits         BIGINT NOT NULL DEFAULT 0,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
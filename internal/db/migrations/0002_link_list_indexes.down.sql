@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS link_hits_idx;
+DROP INDEX IF EXISTS link_created_at_idx;
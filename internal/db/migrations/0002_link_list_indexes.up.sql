@@ -0,0 +1,3 @@
+-- keyset pagination indexes for GET /links (see PGStore.List)
+CREATE INDEX IF NOT EXISTS link_created_at_idx ON link (created_at DESC, short_id DESC);
+CREATE INDEX IF NOT EXISTS link_hits_idx ON link (hits DESC, short_id DESC);
@@ -0,0 +1,2 @@
+-- NULL means the link is live; soft-deleted links keep their row so the ID is never reused
+ALTER TABLE link ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS link_expires_at_idx;
+ALTER TABLE link DROP COLUMN IF EXISTS expires_at;
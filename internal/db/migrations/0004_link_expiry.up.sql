@@ -0,0 +1,5 @@
+-- NULL means the link never expires
+ALTER TABLE link ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+
+-- the reaper only ever looks at links that have an expiry
+CREATE INDEX IF NOT EXISTS link_expires_at_idx ON link (expires_at) WHERE expires_at IS NOT NULL;
@@ -0,0 +1 @@
+ALTER TABLE link DROP COLUMN IF EXISTS max_hits;
@@ -0,0 +1,2 @@
+-- NULL means unlimited; otherwise the link stops resolving once hits reaches max_hits
+ALTER TABLE link ADD COLUMN IF NOT EXISTS max_hits BIGINT CHECK (max_hits > 0);
@@ -0,0 +1,12 @@
+-- Durable counters for ID generators. Generators reserve a block of values at a time
+-- (value is the last value handed out), so restarts and replicas never reuse a counter.
+CREATE TABLE IF NOT EXISTS id_counter (
+    name  TEXT PRIMARY KEY,
+    value BIGINT NOT NULL
+);
+
+-- Before this table existed the counter restarted from 1 on every deploy, so the IDs
+-- already in use are at most 1..(number of links). Starting after that skips them.
+INSERT INTO id_counter (name, value)
+SELECT 'link', COUNT(*) FROM link
+ON CONFLICT (name) DO NOTHING;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS link_url_key_idx;
+ALTER TABLE link DROP COLUMN IF EXISTS url_key;
@@ -0,0 +1,11 @@
+-- Normalized original_url (lowercase scheme/host, no default port, "/" for an empty path),
+-- used to find an existing link for a URL instead of creating a duplicate.
+ALTER TABLE link ADD COLUMN IF NOT EXISTS url_key TEXT;
+
+-- Older rows weren't normalized when they were saved; using the URL as-is means they
+-- can still be matched when it was already in normal form, which is the common case.
+UPDATE link SET url_key = original_url WHERE url_key IS NULL;
+
+-- only links that may be handed out again (see ShortLink.reusable) are worth indexing
+CREATE INDEX IF NOT EXISTS link_url_key_idx ON link (url_key, created_at)
+    WHERE deleted_at IS NULL AND expires_at IS NULL AND max_hits IS NULL;
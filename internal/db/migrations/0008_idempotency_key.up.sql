@@ -0,0 +1,12 @@
+-- Responses to requests sent with an Idempotency-Key header, replayed on retries.
+-- status/body are NULL while the first request is still being handled.
+CREATE TABLE IF NOT EXISTS idempotency_key (
+    key         TEXT PRIMARY KEY,
+    fingerprint TEXT NOT NULL,
+    status      INTEGER,
+    body        BYTEA,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at  TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_key_expires_at_idx ON idempotency_key (expires_at);
@@ -0,0 +1,12 @@
+-- One row per redirect, for time series and breakdowns. The client IP is never stored,
+-- only a keyed hash of it, so visitors can be told apart without being identified.
+CREATE TABLE IF NOT EXISTS click (
+    id            BIGSERIAL PRIMARY KEY,
+    short_id      TEXT NOT NULL REFERENCES link (short_id) ON DELETE CASCADE,
+    clicked_at    TIMESTAMPTZ NOT NULL,
+    referrer_host TEXT NOT NULL DEFAULT '',
+    agent_class   TEXT NOT NULL DEFAULT '',
+    ip_hash       TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS click_short_id_clicked_at_idx ON click (short_id, clicked_at);
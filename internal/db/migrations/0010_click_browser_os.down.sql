@@ -0,0 +1,3 @@
+ALTER TABLE click
+    DROP COLUMN IF EXISTS browser,
+    DROP COLUMN IF EXISTS os;
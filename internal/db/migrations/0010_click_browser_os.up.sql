@@ -0,0 +1,4 @@
+-- Browser and OS families, for stats breakdowns. Clicks recorded before this have '' (unknown).
+ALTER TABLE click
+    ADD COLUMN IF NOT EXISTS browser TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS os      TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,8 @@
+-- HyperLogLog sketches of each link's visitors, one per UTC day. Sketches merge by taking
+-- the larger of each register, so any range of days combines into one unique visitor estimate.
+CREATE TABLE IF NOT EXISTS link_visitors (
+    short_id TEXT NOT NULL REFERENCES link (short_id) ON DELETE CASCADE,
+    day      DATE NOT NULL,
+    sketch   BYTEA NOT NULL,
+    PRIMARY KEY (short_id, day)
+);
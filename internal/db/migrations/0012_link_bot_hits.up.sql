@@ -0,0 +1,3 @@
+-- Redirects served to crawlers and link-preview bots, counted apart from hits
+-- (and never against max_hits).
+ALTER TABLE link ADD COLUMN IF NOT EXISTS bot_hits BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,24 @@
+-- Webhook subscriptions. An empty events array subscribes to every event type.
+CREATE TABLE IF NOT EXISTS webhook (
+    id         TEXT PRIMARY KEY,
+    url        TEXT NOT NULL,
+    secret     TEXT NOT NULL,
+    events     TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- The outbox: one row per event still to be delivered to a webhook. Rows are deleted once
+-- delivered (or given up on), so whatever is here survives a restart and is sent afterwards.
+CREATE TABLE IF NOT EXISTS webhook_delivery (
+    id              BIGSERIAL PRIMARY KEY,
+    webhook_id      TEXT NOT NULL REFERENCES webhook (id) ON DELETE CASCADE,
+    event_id        TEXT NOT NULL,
+    event_type      TEXT NOT NULL,
+    payload         TEXT NOT NULL, -- not JSONB, which would reorder what we sign
+    attempts        INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    last_error      TEXT NOT NULL DEFAULT '',
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS webhook_delivery_next_attempt_at_idx ON webhook_delivery (next_attempt_at);
@@ -0,0 +1,10 @@
+-- API keys. Only the SHA-256 of each secret is stored; the secret itself is shown once, when minted.
+CREATE TABLE IF NOT EXISTS api_key (
+    id           TEXT PRIMARY KEY,
+    name         TEXT NOT NULL,
+    hash         TEXT NOT NULL UNIQUE,
+    scopes       TEXT[] NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMPTZ,
+    revoked_at   TIMESTAMPTZ
+);
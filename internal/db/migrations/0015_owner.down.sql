@@ -0,0 +1,4 @@
+ALTER TABLE api_key DROP COLUMN IF EXISTS owner;
+DROP INDEX IF EXISTS link_owner_hits_idx;
+DROP INDEX IF EXISTS link_owner_created_at_idx;
+ALTER TABLE link DROP COLUMN IF EXISTS owner;
@@ -0,0 +1,12 @@
+-- Links belong to whoever created them: the owner of the API key that was used. Links made
+-- before there were owners have '', which only admins can see.
+ALTER TABLE link ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '';
+
+-- keyset pagination within one owner's links, like link_created_at_idx and link_hits_idx
+CREATE INDEX IF NOT EXISTS link_owner_created_at_idx ON link (owner, created_at DESC, short_id DESC);
+CREATE INDEX IF NOT EXISTS link_owner_hits_idx ON link (owner, hits DESC, short_id DESC);
+
+-- Keys of the same owner (say, a team's CI key and its dashboard key) share their links.
+-- Existing keys become their own owner.
+ALTER TABLE api_key ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '';
+UPDATE api_key SET owner = name WHERE owner = '';
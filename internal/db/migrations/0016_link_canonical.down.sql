@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS link_canonical_url_idx;
+ALTER TABLE link DROP COLUMN IF EXISTS canonical;
@@ -0,0 +1,9 @@
+-- Links created in dedupe mode are the canonical link for their owner and URL, and only one of
+-- them may be live at a time: of two creates of the same URL that both missed in FindByURL, the
+-- second insert fails and it hands out the first one's link instead. The conditions mirror
+-- ShortLink.reusable, like link_url_key_idx. Links made without dedupe aren't canonical, so
+-- they can still repeat a URL.
+ALTER TABLE link ADD COLUMN IF NOT EXISTS canonical BOOLEAN NOT NULL DEFAULT false;
+
+CREATE UNIQUE INDEX IF NOT EXISTS link_canonical_url_idx ON link (owner, url_key)
+    WHERE canonical AND deleted_at IS NULL AND expires_at IS NULL AND max_hits IS NULL;
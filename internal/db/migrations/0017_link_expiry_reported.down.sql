@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS link_expiry_unreported_idx;
+ALTER TABLE link DROP COLUMN IF EXISTS expired_reported_at;
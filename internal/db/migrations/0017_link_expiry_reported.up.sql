@@ -0,0 +1,12 @@
+-- The reaper reports a link's expiry to webhooks by setting expired_reported_at, in the same
+-- transaction that queues its link.expired event, so each expiry is reported exactly once however
+-- many replicas run a reaper and however long none did. Links that had already expired are taken
+-- as reported, rather than all being announced at once.
+ALTER TABLE link ADD COLUMN IF NOT EXISTS expired_reported_at TIMESTAMPTZ;
+
+UPDATE link SET expired_reported_at = expires_at
+WHERE expires_at <= NOW() AND expired_reported_at IS NULL;
+
+-- what's left for the reaper to report
+CREATE INDEX IF NOT EXISTS link_expiry_unreported_idx ON link (expires_at)
+    WHERE expires_at IS NOT NULL AND expired_reported_at IS NULL AND deleted_at IS NULL;
@@ -0,0 +1,4 @@
+CREATE INDEX IF NOT EXISTS link_url_key_idx ON link (url_key, created_at)
+    WHERE deleted_at IS NULL AND expires_at IS NULL AND max_hits IS NULL;
+
+DROP INDEX IF EXISTS link_owner_url_key_idx;
@@ -0,0 +1,7 @@
+-- FindByURL looks within one owner's links, and prefers the canonical one (see 0016), so the
+-- index leads with owner and sorts canonical links first. It replaces link_url_key_idx, which
+-- only helped with the url_key and left the owner to be filtered row by row.
+CREATE INDEX IF NOT EXISTS link_owner_url_key_idx ON link (owner, url_key, canonical DESC, created_at)
+    WHERE deleted_at IS NULL AND expires_at IS NULL AND max_hits IS NULL;
+
+DROP INDEX IF EXISTS link_url_key_idx;
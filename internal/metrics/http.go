@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// InstrumentHTTP returns middleware that counts requests and times them, by route and status.
+// The route is the ServeMux pattern that matched (e.g. "GET /stats/{id}"), so it has to wrap the
+// mux directly: the mux sets Request.Pattern on the request it's given, and middleware that
+// replaces the request (with WithContext, say) in between would hide it
+func InstrumentHTTP(reg *Registry) func(http.Handler) http.Handler {
+	requests := reg.Counter("http_requests_total",
+		"HTTP requests served, by route and status.", "route", "status")
+	latency := reg.Histogram("http_request_duration_seconds",
+		"How long HTTP requests took to serve, by route and status.", DefBuckets, "route", "status")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+
+			next.ServeHTTP(sw, r)
+
+			route := r.Pattern
+			if route == "" {
+				route = "unmatched" // a 404 or 405 from the mux itself
+			}
+			status := strconv.Itoa(sw.statusCode())
+
+			requests.With(route, status).Inc()
+			latency.With(route, status).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// statusWriter records the response status. Unwrap lets http.ResponseController reach the
+// underlying writer, so streaming responses can still flush
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (sw *statusWriter) statusCode() int {
+	if sw.status == 0 {
+		return http.StatusOK // the handler wrote nothing at all
+	}
+	return sw.status
+}
@@ -0,0 +1,394 @@
+// Package metrics is a small Prometheus-compatible metrics registry: counters, histograms and
+// gauges or counters read from a function, served in the Prometheus text exposition format.
+// It covers what this server needs without pulling in the full Prometheus client.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Labels are label names and values for a metric read from a function
+type Labels map[string]string
+
+// DefBuckets are latency buckets in seconds, from 5ms to 10s, the same as Prometheus' defaults
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// Registry holds metrics and serves them at /metrics (it's an http.Handler)
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// family is every series of one metric name
+type family struct {
+	name       string
+	help       string
+	kind       string
+	collectors []collector
+}
+
+// collector writes some of a family's samples
+type collector interface {
+	collect(emit emitFunc)
+}
+
+// emitFunc writes one sample: the family name plus suffix (e.g. "_bucket"), its labels and value
+type emitFunc func(suffix string, labels []labelPair, value float64)
+
+type labelPair struct {
+	name, value string
+}
+
+// register adds c to the family called name, creating it if needed. Only func metrics (shared) may
+// add to an existing family, and only one of the same type. Anything else is a programming error,
+// so it panics, as does an invalid name
+func (r *Registry) register(name, help, kind string, c collector, shared bool) {
+	if !validName(name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", name))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.families[name]
+	if ok && !shared {
+		panic(fmt.Sprintf("metrics: %s is already registered", name))
+	}
+	if !ok {
+		f = &family{name: name, help: help, kind: kind}
+		r.families[name] = f
+	}
+	if f.kind != kind {
+		panic(fmt.Sprintf("metrics: %s is already registered as a %s", name, f.kind))
+	}
+	f.collectors = append(f.collectors, c)
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', c == ':', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// vec keeps one series per combination of label values
+type vec[T any] struct {
+	names []string
+
+	mu     sync.RWMutex
+	series map[string]*T
+	values map[string][]string // label values by series key
+	create func() *T
+}
+
+func newVec[T any](names []string, create func() *T) *vec[T] {
+	for _, name := range names {
+		if !validName(name) || strings.Contains(name, ":") {
+			panic(fmt.Sprintf("metrics: invalid label name %q", name))
+		}
+	}
+
+	return &vec[T]{
+		names:  names,
+		series: make(map[string]*T),
+		values: make(map[string][]string),
+		create: create,
+	}
+}
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.names) {
+		panic(fmt.Sprintf("metrics: got %d label values for labels %v", len(values), v.names))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if s, ok := v.series[key]; ok {
+		return s
+	}
+	s = v.create()
+	v.series[key] = s
+	v.values[key] = slices.Clone(values)
+	return s
+}
+
+// each calls fn for every series, in a stable order
+func (v *vec[T]) each(fn func(labels []labelPair, s *T)) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.mu.RLock()
+		s, values := v.series[key], v.values[key]
+		v.mu.RUnlock()
+
+		labels := make([]labelPair, len(values))
+		for i, value := range values {
+			labels[i] = labelPair{v.names[i], value}
+		}
+		fn(labels, s)
+	}
+}
+
+// Counter only goes up
+type Counter struct {
+	bits atomic.Uint64 // float64 bits
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds n, which must not be negative
+func (c *Counter) Add(n float64) {
+	if n < 0 {
+		panic("metrics: counters can't go down")
+	}
+	addFloat(&c.bits, n)
+}
+
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(c.bits.Load())
+}
+
+func addFloat(bits *atomic.Uint64, n float64) {
+	for {
+		old := bits.Load()
+		if bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+n)) {
+			return
+		}
+	}
+}
+
+// CounterVec is a counter with labels
+type CounterVec struct {
+	v *vec[Counter]
+}
+
+// Counter registers a counter, with a series per combination of values of the given labels
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{v: newVec(labels, func() *Counter { return new(Counter) })}
+	r.register(name, help, kindCounter, cv, false)
+	return cv
+}
+
+// With returns the counter for these label values, in the order the labels were registered
+func (cv *CounterVec) With(values ...string) *Counter {
+	return cv.v.with(values)
+}
+
+func (cv *CounterVec) collect(emit emitFunc) {
+	cv.v.each(func(labels []labelPair, c *Counter) {
+		emit("", labels, c.Value())
+	})
+}
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	upper  []float64       // bucket upper bounds, ascending
+	counts []atomic.Uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    atomic.Uint64   // float64 bits
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		upper:  buckets,
+		counts: make([]atomic.Uint64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v) // the first bucket with upper >= v
+	h.counts[i].Add(1)
+	addFloat(&h.sum, v)
+}
+
+// HistogramVec is a histogram with labels
+type HistogramVec struct {
+	v *vec[Histogram]
+}
+
+// Histogram registers a histogram with the given bucket upper bounds (DefBuckets if nil),
+// with a series per combination of values of the given labels
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = slices.Sorted(slices.Values(buckets))
+
+	hv := &HistogramVec{v: newVec(labels, func() *Histogram { return newHistogram(buckets) })}
+	r.register(name, help, kindHistogram, hv, false)
+	return hv
+}
+
+// With returns the histogram for these label values, in the order the labels were registered
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return hv.v.with(values)
+}
+
+func (hv *HistogramVec) collect(emit emitFunc) {
+	hv.v.each(func(labels []labelPair, h *Histogram) {
+		// the count is the +Inf bucket, so the two agree even if observations race with the scrape
+		var cumulative uint64
+		for i, upper := range h.upper {
+			cumulative += h.counts[i].Load()
+			emit("_bucket", append(slices.Clone(labels), labelPair{"le", formatFloat(upper)}), float64(cumulative))
+		}
+		cumulative += h.counts[len(h.upper)].Load()
+		emit("_bucket", append(slices.Clone(labels), labelPair{"le", "+Inf"}), float64(cumulative))
+		emit("_sum", labels, math.Float64frombits(h.sum.Load()))
+		emit("_count", labels, float64(cumulative))
+	})
+}
+
+// funcCollector is one series whose value is read when the metrics are scraped
+type funcCollector struct {
+	labels []labelPair
+	fn     func() float64
+}
+
+func newFuncCollector(labels Labels, fn func() float64) *funcCollector {
+	pairs := make([]labelPair, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, labelPair{name, value})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].name < pairs[j].name })
+
+	return &funcCollector{labels: pairs, fn: fn}
+}
+
+func (c *funcCollector) collect(emit emitFunc) {
+	emit("", c.labels, c.fn())
+}
+
+// GaugeFunc registers a gauge read from fn on every scrape. The same name can be registered
+// again with other labels, for another series of the same gauge
+func (r *Registry) GaugeFunc(name, help string, labels Labels, fn func() float64) {
+	r.register(name, help, kindGauge, newFuncCollector(labels, fn), true)
+}
+
+// CounterFunc is GaugeFunc for a value that only goes up, such as a total kept elsewhere
+func (r *Registry) CounterFunc(name, help string, labels Labels, fn func() float64) {
+	r.register(name, help, kindCounter, newFuncCollector(labels, fn), true)
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format (version 0.0.4)
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+	r.write(bw)
+	_ = bw.Flush()
+}
+
+func (r *Registry) write(w *bufio.Writer) {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+		r.mu.Lock()
+		collectors := slices.Clone(f.collectors)
+		r.mu.Unlock()
+
+		for _, c := range collectors {
+			c.collect(func(suffix string, labels []labelPair, value float64) {
+				w.WriteString(f.name)
+				w.WriteString(suffix)
+				writeLabels(w, labels)
+				w.WriteByte(' ')
+				w.WriteString(formatFloat(value))
+				w.WriteByte('\n')
+			})
+		}
+	}
+}
+
+func writeLabels(w *bufio.Writer, labels []labelPair) {
+	if len(labels) == 0 {
+		return
+	}
+
+	w.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteString(l.name)
+		w.WriteString(`="`)
+		w.WriteString(labelEscaper.Replace(l.value))
+		w.WriteByte('"')
+	}
+	w.WriteByte('}')
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
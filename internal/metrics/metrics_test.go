@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, reg *Registry) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	return rec.Body.String()
+}
+
+func expectLines(t *testing.T, body string, lines ...string) {
+	t.Helper()
+
+	for _, line := range lines {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("expected line %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	t.Run("Counters", func(t *testing.T) {
+		reg := NewRegistry()
+		requests := reg.Counter("requests_total", "Requests.", "method", "path")
+
+		requests.With("GET", "/a").Inc()
+		requests.With("GET", "/a").Add(2)
+		requests.With("POST", `/"b"`).Inc()
+
+		expectLines(t, scrape(t, reg),
+			"# HELP requests_total Requests.",
+			"# TYPE requests_total counter",
+			`requests_total{method="GET",path="/a"} 3`,
+			`requests_total{method="POST",path="/\"b\""} 1`,
+		)
+	})
+
+	t.Run("Histograms", func(t *testing.T) {
+		reg := NewRegistry()
+		latency := reg.Histogram("latency_seconds", "Latency.", []float64{1, 0.1})
+
+		for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+			latency.With().Observe(v)
+		}
+
+		expectLines(t, scrape(t, reg),
+			"# TYPE latency_seconds histogram",
+			`latency_seconds_bucket{le="0.1"} 2`,
+			`latency_seconds_bucket{le="1"} 3`,
+			`latency_seconds_bucket{le="+Inf"} 4`,
+			"latency_seconds_sum 3.65",
+			"latency_seconds_count 4",
+		)
+	})
+
+	t.Run("Func metrics", func(t *testing.T) {
+		reg := NewRegistry()
+		value := 1.0
+		reg.GaugeFunc("temperature", "Multi\nline help.", nil, func() float64 { return value })
+		reg.CounterFunc("results_total", "Results.", Labels{"result": "ok"}, func() float64 { return 7 })
+		reg.CounterFunc("results_total", "Results.", Labels{"result": "error"}, func() float64 { return 2 })
+
+		value = 2.5
+		expectLines(t, scrape(t, reg),
+			`# HELP temperature Multi\nline help.`,
+			"# TYPE temperature gauge",
+			"temperature 2.5",
+			`results_total{result="ok"} 7`,
+			`results_total{result="error"} 2`,
+		)
+	})
+
+	t.Run("Families are sorted by name", func(t *testing.T) {
+		reg := NewRegistry()
+		reg.GaugeFunc("b", "B.", nil, func() float64 { return 0 })
+		reg.GaugeFunc("a", "A.", nil, func() float64 { return 0 })
+
+		body := scrape(t, reg)
+		if strings.Index(body, "# HELP a") > strings.Index(body, "# HELP b") {
+			t.Fatalf("expected a before b, got:\n%s", body)
+		}
+	})
+
+	t.Run("Bad registrations panic", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			register func(reg *Registry)
+		}{
+			{"Invalid name", func(reg *Registry) { reg.Counter("bad-name", "") }},
+			{"Invalid label", func(reg *Registry) { reg.Counter("ok", "", "bad label") }},
+			{"Duplicate", func(reg *Registry) { reg.Counter("dup", ""); reg.Counter("dup", "") }},
+			{"Type clash", func(reg *Registry) {
+				reg.GaugeFunc("clash", "", nil, func() float64 { return 0 })
+				reg.CounterFunc("clash", "", nil, func() float64 { return 0 })
+			}},
+			{"Wrong label count", func(reg *Registry) { reg.Counter("c", "", "a", "b").With("x") }},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				defer func() {
+					if recover() == nil {
+						t.Fatal("expected a panic")
+					}
+				}()
+				tt.register(NewRegistry())
+			})
+		}
+	})
+}
+
+func TestInstrumentHTTP(t *testing.T) {
+	reg := NewRegistry()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, "ok")
+	})
+	mux.HandleFunc("GET /stream", func(w http.ResponseWriter, r *http.Request) {
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("expected flushing to work through the middleware, got %v", err)
+		}
+	})
+	handler := InstrumentHTTP(reg)(mux)
+
+	for _, path := range []string{"/items/1", "/items/2", "/items/missing", "/nowhere", "/stream"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	expectLines(t, scrape(t, reg),
+		`http_requests_total{route="GET /items/{id}",status="200"} 2`,
+		`http_requests_total{route="GET /items/{id}",status="404"} 1`,
+		`http_requests_total{route="unmatched",status="404"} 1`,
+		`http_requests_total{route="GET /stream",status="200"} 1`,
+		`http_request_duration_seconds_count{route="GET /items/{id}",status="200"} 2`,
+	)
+}
@@ -0,0 +1,343 @@
+package shared
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidAPIKey  = errors.New("invalid api key")
+)
+
+// Scope is something an API key is allowed to do
+type Scope string
+
+const (
+	ScopeCreate    Scope = "create"     // create links and manage them
+	ScopeReadStats Scope = "read-stats" // list links and read their stats
+	ScopeAdmin     Scope = "admin"      // everything, including the admin endpoints
+)
+
+var knownScopes = []Scope{ScopeCreate, ScopeReadStats, ScopeAdmin}
+
+// APIKey is a key as it's stored: only the hash of the secret is kept
+type APIKey struct {
+	ID         string
+	Name       string
+	Owner      string // keys with the same owner share the links they create
+	Hash       string // hex SHA-256 of the secret, see HashAPIKey
+	Scopes     []Scope
+	CreatedAt  time.Time
+	LastUsedAt *time.Time // nil if it's never been used
+	RevokedAt  *time.Time // nil unless revoked
+}
+
+// APIKeyStore keeps API keys
+type APIKeyStore interface {
+	SaveAPIKey(ctx context.Context, key APIKey) error
+	// FindAPIKey looks a key up by the hash of its secret, revoked or not. ErrAPIKeyNotFound if there's none
+	FindAPIKey(ctx context.Context, hash string) (APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	// RevokeAPIKey marks a key revoked at the given time, unless it already is. ErrAPIKeyNotFound if there's no such key
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
+	// TouchAPIKey records that the key was used at the given time
+	TouchAPIKey(ctx context.Context, id string, at time.Time) error
+}
+
+// HashAPIKey is how a secret is stored and looked up. Secrets are random, so a plain SHA-256
+// is enough; there's nothing to brute-force the way there is with passwords
+func HashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseScopes turns scope names such as "read-stats" into Scopes
+func ParseScopes(names []string) ([]Scope, error) {
+	parsed := make([]Scope, len(names))
+	for i, name := range names {
+		parsed[i] = Scope(strings.TrimSpace(name))
+	}
+	return checkScopes(parsed)
+}
+
+// checkScopes rejects unknown scopes and drops repeats
+func checkScopes(scopes []Scope) ([]Scope, error) {
+	checked := make([]Scope, 0, len(scopes))
+	for _, scope := range scopes {
+		if !slices.Contains(knownScopes, scope) {
+			return nil, fmt.Errorf("%w: unknown scope %q", ErrInvalidAPIKey, scope)
+		}
+		if !slices.Contains(checked, scope) {
+			checked = append(checked, scope)
+		}
+	}
+	if len(checked) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidAPIKey)
+	}
+	return checked, nil
+}
+
+// Principal is who a request was authenticated as
+type Principal struct {
+	KeyID  string
+	Name   string
+	Owner  string
+	Scopes []Scope
+}
+
+// Has reports whether the principal may do what scope covers. Admins may do anything
+func (p Principal) Has(scope Scope) bool {
+	return slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, ScopeAdmin)
+}
+
+type ctxKeyPrincipal struct{}
+
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, ctxKeyPrincipal{}, p)
+}
+
+// PrincipalFromContext returns the principal KeyAuth put in a request's context, if any
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(ctxKeyPrincipal{}).(Principal)
+	return p, ok
+}
+
+const (
+	// how long a looked-up key is trusted before it's looked up again, which is also how long
+	// a key revoked through another replica keeps working here
+	keyCacheTTL = 30 * time.Second
+
+	// last-used times are written at most this often per key, not on every request
+	keyTouchInterval = time.Minute
+)
+
+// KeyAuth authenticates requests by API key, sent as X-API-Key or as an "Authorization: Bearer" token
+type KeyAuth struct {
+	store APIKeyStore
+	now   func() time.Time
+
+	// failed attempts are limited per IP, see LimitFailures
+	failures      *RateLimiter
+	failurePolicy RatePolicy
+
+	mu      sync.Mutex
+	cache   map[string]cachedKey // by hash, only keys that exist
+	touched map[string]time.Time // by key ID
+}
+
+type cachedKey struct {
+	key     APIKey
+	expires time.Time
+}
+
+func NewKeyAuth(store APIKeyStore) *KeyAuth {
+	return &KeyAuth{
+		store:   store,
+		now:     time.Now,
+		cache:   make(map[string]cachedKey),
+		touched: make(map[string]time.Time),
+	}
+}
+
+// LimitFailures lets each IP address fail to authenticate only as often as policy allows. Once it
+// has used that up, its requests get a 429 without their key being looked up, which keeps key
+// guessing slow and off the database. Call it before serving any requests
+func (a *KeyAuth) LimitFailures(l *RateLimiter, policy RatePolicy) {
+	policy.Name = cmp.Or(policy.Name, "auth-failures")
+	a.failures = l
+	a.failurePolicy = policy
+}
+
+// Mint creates a key and returns its secret, which isn't stored anywhere and can't be shown again.
+// An empty owner makes the key its own owner
+func (a *KeyAuth) Mint(ctx context.Context, name, owner string, scopes []Scope) (string, APIKey, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", APIKey{}, fmt.Errorf("%w: a name is required", ErrInvalidAPIKey)
+	}
+	owner = strings.TrimSpace(owner)
+	if owner == "" {
+		owner = name
+	}
+	scopes, err := checkScopes(scopes)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	secret := "sk_" + rand.Text()
+	key := APIKey{
+		ID:        uuid.NewString(),
+		Name:      name,
+		Owner:     owner,
+		Hash:      HashAPIKey(secret),
+		Scopes:    scopes,
+		CreatedAt: a.now().UTC(),
+	}
+	if err := a.store.SaveAPIKey(ctx, key); err != nil {
+		return "", APIKey{}, err
+	}
+	return secret, key, nil
+}
+
+func (a *KeyAuth) List(ctx context.Context) ([]APIKey, error) {
+	return a.store.ListAPIKeys(ctx)
+}
+
+// Revoke stops a key from working. Here that's immediate; other replicas notice within keyCacheTTL
+func (a *KeyAuth) Revoke(ctx context.Context, id string) error {
+	if err := a.store.RevokeAPIKey(ctx, id, a.now().UTC()); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for hash, cached := range a.cache {
+		if cached.key.ID == id {
+			delete(a.cache, hash)
+		}
+	}
+	return nil
+}
+
+// lookup finds the key for a secret, from the cache if it was looked up recently
+func (a *KeyAuth) lookup(ctx context.Context, secret string) (APIKey, error) {
+	hash := HashAPIKey(secret)
+	now := a.now()
+
+	a.mu.Lock()
+	cached, ok := a.cache[hash]
+	a.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.key, nil
+	}
+
+	key, err := a.store.FindAPIKey(ctx, hash)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	a.mu.Lock()
+	a.cache[hash] = cachedKey{key: key, expires: now.Add(keyCacheTTL)}
+	a.mu.Unlock()
+	return key, nil
+}
+
+// touch records the key's use, unless that was done less than keyTouchInterval ago
+func (a *KeyAuth) touch(ctx context.Context, id string) {
+	now := a.now()
+
+	a.mu.Lock()
+	due := now.Sub(a.touched[id]) >= keyTouchInterval
+	if due {
+		a.touched[id] = now
+	}
+	a.mu.Unlock()
+
+	if due {
+		// a missed last-used time isn't worth failing the request over
+		if err := a.store.TouchAPIKey(ctx, id, now.UTC()); err != nil {
+			log.Printf("api keys: recording use of %s: %v", id, err)
+		}
+	}
+}
+
+// Require only lets through requests with a valid, unrevoked key that has scope, and puts its
+// Principal in the request context. Missing and bad keys get a 401, keys without the scope a 403,
+// and IPs that have failed too often a 429 (see LimitFailures)
+func (a *KeyAuth) Require(scope Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !a.mayTry(w, r) {
+				return
+			}
+
+			secret := requestKey(r)
+			if secret == "" {
+				a.unauthorized(w, r)
+				return
+			}
+
+			key, err := a.lookup(r.Context(), secret)
+			switch {
+			case errors.Is(err, ErrAPIKeyNotFound):
+				a.unauthorized(w, r)
+				return
+			case err != nil:
+				log.Printf("api keys: lookup failed: %v", err)
+				writeJSONError(w, http.StatusServiceUnavailable, "can't check api key, try again later")
+				return
+			case key.RevokedAt != nil:
+				a.unauthorized(w, r)
+				return
+			}
+
+			principal := Principal{KeyID: key.ID, Name: key.Name, Owner: key.Owner, Scopes: key.Scopes}
+			if !principal.Has(scope) {
+				writeJSONError(w, http.StatusForbidden, fmt.Sprintf("api key lacks the %s scope", scope))
+				return
+			}
+
+			a.touch(r.Context(), key.ID)
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
+// mayTry answers with a 429 if the request's IP has run out of failed attempts
+func (a *KeyAuth) mayTry(w http.ResponseWriter, r *http.Request) bool {
+	if a.failures == nil || !a.failurePolicy.enabled() {
+		return true
+	}
+
+	d := a.failures.peek(a.failureKey(r), a.failurePolicy)
+	if !d.allowed {
+		w.Header().Set("Retry-After", ceilSeconds(d.retryAfter))
+		writeJSONError(w, http.StatusTooManyRequests, "too many failed attempts, try again later")
+	}
+	return d.allowed
+}
+
+// unauthorized answers with a 401 and counts it against the request's IP
+func (a *KeyAuth) unauthorized(w http.ResponseWriter, r *http.Request) {
+	if a.failures != nil && a.failurePolicy.enabled() {
+		a.failures.take(a.failureKey(r), a.failurePolicy)
+	}
+	writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+}
+
+func (a *KeyAuth) failureKey(r *http.Request) string {
+	return a.failurePolicy.Name + "|" + a.failures.ipClient(r)
+}
+
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": msg,
+	})
+}
@@ -0,0 +1,278 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memKeys is an APIKeyStore for tests
+type memKeys struct {
+	mu      sync.Mutex
+	keys    map[string]APIKey
+	finds   int
+	touches int
+	fail    error
+}
+
+func newMemKeys() *memKeys {
+	return &memKeys{keys: make(map[string]APIKey)}
+}
+
+func (m *memKeys) SaveAPIKey(_ context.Context, key APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[key.ID] = key
+	return nil
+}
+
+func (m *memKeys) FindAPIKey(_ context.Context, hash string) (APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.finds++
+	if m.fail != nil {
+		return APIKey{}, m.fail
+	}
+	for _, key := range m.keys {
+		if key.Hash == hash {
+			return key, nil
+		}
+	}
+	return APIKey{}, ErrAPIKeyNotFound
+}
+
+func (m *memKeys) ListAPIKeys(_ context.Context) ([]APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []APIKey
+	for _, key := range m.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (m *memKeys) RevokeAPIKey(_ context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, ok := m.keys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	key.RevokedAt = &at
+	m.keys[id] = key
+	return nil
+}
+
+func (m *memKeys) TouchAPIKey(_ context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := m.keys[id]
+	key.LastUsedAt = &at
+	m.keys[id] = key
+	m.touches++
+	return nil
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes([]string{"create", " read-stats", "create"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(scopes) != 2 || scopes[0] != ScopeCreate || scopes[1] != ScopeReadStats {
+		t.Fatalf("expected create and read-stats, got %v", scopes)
+	}
+
+	for _, names := range [][]string{nil, {"delete-everything"}} {
+		if _, err := ParseScopes(names); !errors.Is(err, ErrInvalidAPIKey) {
+			t.Fatalf("expected ErrInvalidAPIKey for %v, got %v", names, err)
+		}
+	}
+}
+
+func TestPrincipal_Has(t *testing.T) {
+	reader := Principal{Scopes: []Scope{ScopeReadStats}}
+	if !reader.Has(ScopeReadStats) || reader.Has(ScopeCreate) {
+		t.Fatal("expected a read-stats principal to only read stats")
+	}
+
+	admin := Principal{Scopes: []Scope{ScopeAdmin}}
+	if !admin.Has(ScopeCreate) || !admin.Has(ScopeReadStats) {
+		t.Fatal("expected an admin to have every scope")
+	}
+}
+
+func TestKeyAuth(t *testing.T) {
+	ctx := context.Background()
+
+	var got Principal
+	handler := func(a *KeyAuth, scope Scope) http.Handler {
+		return a.Require(scope)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = PrincipalFromContext(r.Context())
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	serve := func(h http.Handler, header, value string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	t.Run("Minted keys are stored hashed", func(t *testing.T) {
+		store := newMemKeys()
+		a := NewKeyAuth(store)
+
+		secret, key, err := a.Mint(ctx, "ci", "", []Scope{ScopeCreate})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if stored := store.keys[key.ID]; stored.Hash != HashAPIKey(secret) || stored.Hash == secret {
+			t.Fatalf("expected only the hash to be stored, got %+v", stored)
+		}
+
+		if _, _, err := a.Mint(ctx, " ", "", []Scope{ScopeCreate}); !errors.Is(err, ErrInvalidAPIKey) {
+			t.Fatalf("expected ErrInvalidAPIKey without a name, got %v", err)
+		}
+		if _, _, err := a.Mint(ctx, "ci", "", nil); !errors.Is(err, ErrInvalidAPIKey) {
+			t.Fatalf("expected ErrInvalidAPIKey without scopes, got %v", err)
+		}
+	})
+
+	t.Run("Valid keys get through with their principal", func(t *testing.T) {
+		a := NewKeyAuth(newMemKeys())
+		secret, key, _ := a.Mint(ctx, "ci", "", []Scope{ScopeCreate})
+
+		if code := serve(handler(a, ScopeCreate), "X-API-Key", secret); code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", code)
+		}
+		if got.KeyID != key.ID || got.Name != "ci" || !got.Has(ScopeCreate) {
+			t.Fatalf("unexpected principal %+v", got)
+		}
+		if code := serve(handler(a, ScopeCreate), "Authorization", "Bearer "+secret); code != http.StatusOK {
+			t.Fatalf("expected a bearer token to work too, got %d", code)
+		}
+	})
+
+	t.Run("Rejections", func(t *testing.T) {
+		store := newMemKeys()
+		a := NewKeyAuth(store)
+		secret, _, _ := a.Mint(ctx, "ci", "", []Scope{ScopeReadStats})
+
+		if code := serve(handler(a, ScopeReadStats), "", ""); code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 without a key, got %d", code)
+		}
+		if code := serve(handler(a, ScopeReadStats), "X-API-Key", "sk_wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for an unknown key, got %d", code)
+		}
+		if code := serve(handler(a, ScopeCreate), "X-API-Key", secret); code != http.StatusForbidden {
+			t.Fatalf("expected 403 without the scope, got %d", code)
+		}
+
+		store.fail = errors.New("db down")
+		if code := serve(handler(a, ScopeReadStats), "X-API-Key", "sk_other"); code != http.StatusServiceUnavailable {
+			t.Fatalf("expected 503 when the store fails, got %d", code)
+		}
+	})
+
+	t.Run("Revoked keys stop working", func(t *testing.T) {
+		a := NewKeyAuth(newMemKeys())
+		secret, key, _ := a.Mint(ctx, "ci", "", []Scope{ScopeCreate})
+
+		if code := serve(handler(a, ScopeCreate), "X-API-Key", secret); code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", code)
+		}
+		if err := a.Revoke(ctx, key.ID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// even though the key was cached
+		if code := serve(handler(a, ScopeCreate), "X-API-Key", secret); code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 once revoked, got %d", code)
+		}
+
+		if err := a.Revoke(ctx, "missing"); !errors.Is(err, ErrAPIKeyNotFound) {
+			t.Fatalf("expected ErrAPIKeyNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Failed attempts are limited per IP", func(t *testing.T) {
+		store := newMemKeys()
+		a := NewKeyAuth(store)
+		secret, _, _ := a.Mint(ctx, "ci", "", []Scope{ScopeCreate})
+
+		now := time.Now()
+		l := NewRateLimiter(nil)
+		l.now = func() time.Time { return now }
+		a.LimitFailures(l, RatePolicy{Rate: 1, Burst: 2})
+
+		h := handler(a, ScopeCreate)
+		serveFrom := func(remoteAddr, secret string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = remoteAddr
+			req.Header.Set("X-API-Key", secret)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			return rr
+		}
+
+		// good keys don't use up the allowance
+		for range 3 {
+			if rr := serveFrom("203.0.113.1:1234", secret); rr.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", rr.Code)
+			}
+		}
+
+		for range 2 {
+			if rr := serveFrom("203.0.113.1:1234", "sk_wrong"); rr.Code != http.StatusUnauthorized {
+				t.Fatalf("expected 401, got %d", rr.Code)
+			}
+		}
+		finds := store.finds
+		rr := serveFrom("203.0.113.1:1234", "sk_other")
+		if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+			t.Fatalf("expected 429 with Retry-After: 1 once the failures are used up, got %d %v", rr.Code, rr.Header())
+		}
+		if store.finds != finds {
+			t.Fatal("expected the key not to be looked up")
+		}
+		if rr := serveFrom("203.0.113.1:1234", secret); rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected good keys from that IP to wait too, got %d", rr.Code)
+		}
+
+		if rr := serveFrom("203.0.113.2:1234", "sk_wrong"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected another IP to have its own allowance, got %d", rr.Code)
+		}
+
+		now = now.Add(time.Second)
+		if rr := serveFrom("203.0.113.1:1234", secret); rr.Code != http.StatusOK {
+			t.Fatalf("expected 200 once a try has refilled, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Last use is recorded at most once a minute", func(t *testing.T) {
+		store := newMemKeys()
+		a := NewKeyAuth(store)
+		now := time.Now()
+		a.now = func() time.Time { return now }
+		secret, key, _ := a.Mint(ctx, "ci", "", []Scope{ScopeCreate})
+
+		for range 3 {
+			serve(handler(a, ScopeCreate), "X-API-Key", secret)
+		}
+		if store.touches != 1 || store.keys[key.ID].LastUsedAt == nil {
+			t.Fatalf("expected one recorded use, got %d", store.touches)
+		}
+
+		now = now.Add(keyTouchInterval)
+		serve(handler(a, ScopeCreate), "X-API-Key", secret)
+		if store.touches != 2 {
+			t.Fatalf("expected a second recorded use a minute later, got %d", store.touches)
+		}
+	})
+}
@@ -0,0 +1,268 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RatePolicy is a token bucket: each client may make Burst requests at once, and gets Rate more
+// per second after that. The zero value doesn't limit anything
+type RatePolicy struct {
+	Name  string  // buckets are per policy, so one group of routes can't use up another's allowance
+	Rate  float64 // tokens added per second
+	Burst int     // the bucket's size
+}
+
+func (p RatePolicy) enabled() bool {
+	return p.Rate > 0 && p.Burst > 0
+}
+
+// RateLimiter keeps a token bucket per policy and client. A client is its API key when the
+// request has been authenticated (see KeyAuth), otherwise its IP address
+type RateLimiter struct {
+	trusted []netip.Prefix // proxies whose X-Forwarded-For is believed
+	now     func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	policy RatePolicy
+	tokens float64
+	last   time.Time // when tokens was worked out
+}
+
+// full reports whether the bucket will have refilled completely by now
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.policy.Rate >= float64(b.policy.Burst)
+}
+
+// NewRateLimiter takes the proxies (e.g. the load balancer's subnet) allowed to tell us the
+// client's address in X-Forwarded-For. Anyone else could put anything in it, so it's ignored
+func NewRateLimiter(trustedProxies []netip.Prefix) *RateLimiter {
+	return &RateLimiter{
+		trusted: trustedProxies,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// rateDecision is what a bucket said about one request
+type rateDecision struct {
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration // until the next token, when not allowed
+	reset      time.Duration // until the bucket is full again
+}
+
+// take refills the bucket for the time that's passed and takes a token from it if there is one
+func (l *RateLimiter) take(key string, policy RatePolicy) rateDecision {
+	return l.decide(key, policy, true)
+}
+
+// peek is take without taking the token, for limits that only count some requests
+func (l *RateLimiter) peek(key string, policy RatePolicy) rateDecision {
+	return l.decide(key, policy, false)
+}
+
+func (l *RateLimiter) decide(key string, policy RatePolicy, take bool) rateDecision {
+	now := l.now()
+	burst := float64(policy.Burst)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if !take {
+			return rateDecision{allowed: true, remaining: policy.Burst}
+		}
+		b = &tokenBucket{policy: policy, tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*policy.Rate)
+	b.last = now
+
+	d := rateDecision{allowed: b.tokens >= 1}
+	switch {
+	case !d.allowed:
+		d.retryAfter = secondsDuration((1 - b.tokens) / policy.Rate)
+	case take:
+		b.tokens--
+	}
+	d.remaining = int(b.tokens)
+	d.reset = secondsDuration((burst - b.tokens) / policy.Rate)
+	return d
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Evict forgets the buckets that have refilled completely. A full bucket is exactly what a new
+// client gets, so this changes nothing but the memory used
+func (l *RateLimiter) Evict() {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Run evicts full buckets every interval until ctx is cancelled, which keeps memory down to
+// the clients that have been busy lately
+func (l *RateLimiter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.Evict()
+		}
+	}
+}
+
+// size is how many buckets are kept
+func (l *RateLimiter) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// RateLimit lets each client make requests at the rate the policy allows. Every response gets
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers, and requests over the limit get
+// a 429 with Retry-After. Put it after KeyAuth.Require, so API clients are limited per key
+func RateLimit(l *RateLimiter, policy RatePolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !policy.enabled() {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d := l.take(policy.Name+"|"+l.client(r), policy)
+
+			h := w.Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(policy.Burst))
+			h.Set("RateLimit-Remaining", strconv.Itoa(d.remaining))
+			h.Set("RateLimit-Reset", ceilSeconds(d.reset))
+			h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%s", policy.Burst, ceilSeconds(secondsDuration(float64(policy.Burst)/policy.Rate))))
+
+			if !d.allowed {
+				h.Set("Retry-After", ceilSeconds(d.retryAfter))
+				writeJSONError(w, http.StatusTooManyRequests, "rate limit exceeded, try again later")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// client is who a request counts against: its API key if it has been authenticated, else its IP
+func (l *RateLimiter) client(r *http.Request) string {
+	if p, ok := PrincipalFromContext(r.Context()); ok {
+		return "key:" + p.KeyID
+	}
+	return l.ipClient(r)
+}
+
+// ipClient is who a request counts against by address alone
+func (l *RateLimiter) ipClient(r *http.Request) string {
+	addr := l.ClientIP(r)
+	if !addr.IsValid() {
+		return "ip:" + r.RemoteAddr
+	}
+	// an IPv6 host usually has a whole /64 to pick addresses from
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return "ip:" + prefix.String()
+	}
+	return "ip:" + addr.String()
+}
+
+// ClientIP is the address the request came from. Behind trusted proxies that's the last address
+// in X-Forwarded-For that isn't one of them, since every hop appends the address it saw
+func (l *RateLimiter) ClientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0 && l.isTrusted(addr); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break // garbage from before a trusted proxy; the proxy's own address is all we know
+		}
+		addr = hop.Unmap()
+	}
+	return addr
+}
+
+func (l *RateLimiter) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range l.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedProxies reads a comma-separated list of addresses and CIDR ranges, such as
+// "10.0.0.0/8, 192.168.1.10"
+func ParseTrustedProxies(raw string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if strings.Contains(part, "/") {
+			prefix, err := netip.ParsePrefix(part)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(part)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,171 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	policy := RatePolicy{Name: "test", Rate: 1, Burst: 2} // 2 at once, then 1 a second
+
+	newLimited := func(trusted ...netip.Prefix) (*RateLimiter, http.Handler, *time.Time) {
+		now := time.Now()
+		l := NewRateLimiter(trusted)
+		l.now = func() time.Time { return now }
+
+		var called bool
+		return l, RateLimit(l, policy)(testHandler(&called)), &now
+	}
+	serve := func(h http.Handler, remoteAddr string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Add(header[i], header[i+1])
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Bursts, then refills", func(t *testing.T) {
+		_, h, now := newLimited()
+
+		first := serve(h, "203.0.113.1:1234")
+		if first.Code != http.StatusOK || first.Header().Get("RateLimit-Limit") != "2" || first.Header().Get("RateLimit-Remaining") != "1" {
+			t.Fatalf("expected 200 with 1 remaining of 2, got %d %v", first.Code, first.Header())
+		}
+		if rr := serve(h, "203.0.113.1:1234"); rr.Code != http.StatusOK {
+			t.Fatalf("expected the burst to allow 2 requests, got %d", rr.Code)
+		}
+
+		rr := serve(h, "203.0.113.1:1234")
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected 429, got %d", rr.Code)
+		}
+		if got := rr.Header().Get("Retry-After"); got != "1" {
+			t.Fatalf("expected Retry-After 1, got %q", got)
+		}
+		if got := rr.Header().Get("RateLimit-Reset"); got != "2" {
+			t.Fatalf("expected the bucket to be full again in 2s, got %q", got)
+		}
+
+		*now = now.Add(time.Second)
+		if rr := serve(h, "203.0.113.1:1234"); rr.Code != http.StatusOK {
+			t.Fatalf("expected a token a second later, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Clients have their own buckets", func(t *testing.T) {
+		_, h, _ := newLimited()
+
+		for range 2 {
+			serve(h, "203.0.113.1:1234")
+		}
+		if rr := serve(h, "203.0.113.2:1234"); rr.Code != http.StatusOK {
+			t.Fatalf("expected another IP to have its own bucket, got %d", rr.Code)
+		}
+	})
+
+	t.Run("IPv6 clients are limited per /64", func(t *testing.T) {
+		_, h, _ := newLimited()
+
+		serve(h, "[2001:db8::1]:1234")
+		serve(h, "[2001:db8::2]:1234")
+		if rr := serve(h, "[2001:db8::3]:1234"); rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected addresses in one /64 to share a bucket, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Authenticated clients are limited per key", func(t *testing.T) {
+		a := NewKeyAuth(newMemKeys())
+		first, _, _ := a.Mint(context.Background(), "first", "", []Scope{ScopeCreate})
+		second, _, _ := a.Mint(context.Background(), "second", "", []Scope{ScopeCreate})
+		_, limited, _ := newLimited()
+		h := a.Require(ScopeCreate)(limited)
+
+		for range 2 {
+			serve(h, "203.0.113.1:1234", "X-API-Key", first)
+		}
+		if rr := serve(h, "203.0.113.1:1234", "X-API-Key", first); rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected 429, got %d", rr.Code)
+		}
+		if rr := serve(h, "203.0.113.1:1234", "X-API-Key", second); rr.Code != http.StatusOK {
+			t.Fatalf("expected another key from the same IP to have its own bucket, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Disabled policies don't limit", func(t *testing.T) {
+		var called bool
+		h := RateLimit(NewRateLimiter(nil), RatePolicy{})(testHandler(&called))
+
+		for range 10 {
+			if rr := serve(h, "203.0.113.1:1234"); rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "" {
+				t.Fatalf("expected no limit, got %d %v", rr.Code, rr.Header())
+			}
+		}
+	})
+
+	t.Run("Idle buckets are evicted", func(t *testing.T) {
+		l, h, now := newLimited()
+
+		serve(h, "203.0.113.1:1234")
+		serve(h, "203.0.113.2:1234")
+		serve(h, "203.0.113.2:1234")
+
+		*now = now.Add(time.Second)
+		l.Evict()
+		if got := l.size(); got != 1 {
+			t.Fatalf("expected only the bucket that's still refilling to be kept, got %d", got)
+		}
+
+		*now = now.Add(time.Second)
+		l.Evict()
+		if got := l.size(); got != 0 {
+			t.Fatalf("expected every bucket to be evicted, got %d", got)
+		}
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.10")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := NewRateLimiter(trusted)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"No proxy", "203.0.113.1:1234", nil, "203.0.113.1"},
+		{"Untrusted X-Forwarded-For is ignored", "203.0.113.1:1234", []string{"198.51.100.7"}, "203.0.113.1"},
+		{"Trusted proxy", "10.0.0.5:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"Chain of trusted proxies", "10.0.0.5:1234", []string{"198.51.100.7, 192.168.1.10", "10.1.1.1"}, "198.51.100.7"},
+		{"Spoofed hops before the client are ignored", "10.0.0.5:1234", []string{"1.2.3.4, 198.51.100.7"}, "198.51.100.7"},
+		{"Garbage stops at the last trusted hop", "10.0.0.5:1234", []string{"nonsense, 10.1.1.1"}, "10.1.1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, header := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", header)
+			}
+
+			if got := l.ClientIP(req).String(); got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Fatal("expected an error for a bad range")
+	}
+}
@@ -0,0 +1,60 @@
+package shorten
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidAlias = errors.New("invalid alias")
+	ErrAliasTaken   = errors.New("alias is already taken")
+)
+
+const (
+	minAliasLength = 3
+	maxAliasLength = 64
+)
+
+// reservedAliases are paths that RegisterRoutes (or the server around it) serves itself,
+// plus a few we're likely to want later. A link at /stats would never be reachable.
+var reservedAliases = map[string]bool{
+	"shorten": true,
+	"stats":   true,
+	"links":   true,
+	"admin":   true,
+	"api":     true,
+	"metrics": true,
+	"health":  true,
+	"static":  true,
+}
+
+func isReservedAlias(id string) bool {
+	return reservedAliases[strings.ToLower(id)]
+}
+
+// validateAlias checks a user-chosen short ID: 3-64 characters from [A-Za-z0-9_-], and not reserved
+func validateAlias(alias string) error {
+	if len(alias) < minAliasLength || len(alias) > maxAliasLength {
+		return fmt.Errorf("%w: must be between %d and %d characters", ErrInvalidAlias, minAliasLength, maxAliasLength)
+	}
+
+	for _, c := range alias {
+		if !isIDChar(c) {
+			return fmt.Errorf("%w: may only contain letters, digits, '-' and '_'", ErrInvalidAlias)
+		}
+	}
+
+	if isReservedAlias(alias) {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidAlias, alias)
+	}
+
+	return nil
+}
+
+// isIDChar reports whether c may appear in a short ID, i.e. is one of [A-Za-z0-9_-].
+// Anything else could need escaping in a path, or be taken for a query or fragment
+func isIDChar(c rune) bool {
+	isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+	return isAlnum || c == '-' || c == '_'
+}
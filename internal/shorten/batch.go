@@ -0,0 +1,201 @@
+package shorten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrBatchTooLarge = errors.New("batch is too large")
+var ErrEmptyBatch = errors.New("batch is empty")
+
+const defaultMaxBatchSize = 1000
+
+// BatchItem is one link to create in a CreateBatch call
+type BatchItem struct {
+	URL     string
+	Options CreateOptions
+}
+
+// BatchResult is the outcome for the BatchItem at the same index: either Link or Err is set.
+// Created is false when dedupe mode (see WithDedupe) answered the item with an existing link
+type BatchResult struct {
+	Link    ShortLink
+	Created bool
+	Err     error
+}
+
+// MaxBatchSize is the most items CreateBatch accepts in one call
+func (s *Shortener) MaxBatchSize() int {
+	return s.maxBatchSize
+}
+
+// CreateBatch creates many links at once. Every item is validated and retried like Create would,
+// but the saves go to the store in bulk (one SaveMany per round of ID attempts) instead of one per link.
+// A bad item doesn't fail the batch: its error is reported in its BatchResult.
+// The returned error is only for problems with the whole batch (too big, store unavailable).
+func (s *Shortener) CreateBatch(ctx context.Context, items []BatchItem) ([]BatchResult, error) {
+	if len(items) == 0 {
+		return nil, ErrEmptyBatch
+	}
+	if len(items) > s.maxBatchSize {
+		return nil, fmt.Errorf("%w: %d items, the maximum is %d", ErrBatchTooLarge, len(items), s.maxBatchSize)
+	}
+
+	ctx, cancel := s.writeContext(ctx)
+	defer cancel()
+
+	now := time.Now()
+	results := make([]BatchResult, len(items))
+
+	// indexes of the items still waiting to be saved
+	var pending []int
+
+	// aliases must also be unique within the batch, since the store would only see one of them
+	aliases := make(map[string]bool)
+
+	// in dedupe mode, repeats of a URL within the batch share the first one's link:
+	// index of a repeated item -> index of the first item with that URL
+	firstByURL := make(map[string]int)
+	sameAs := make(map[int]int)
+
+	for i, item := range items {
+		link, err := newLink(item.URL, item.Options, now)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		if s.dedupe && item.Options.dedupable() {
+			link.Canonical = true
+
+			key := item.Options.Owner + " " + normalizeURL(item.URL)
+			if first, ok := firstByURL[key]; ok {
+				sameAs[i] = first
+				continue
+			}
+			firstByURL[key] = i
+
+			existing, err := s.store.FindByURL(ctx, item.URL, item.Options.Owner)
+			if err == nil {
+				results[i].Link = existing
+				continue
+			}
+			if !errors.Is(err, ErrNotFound) {
+				return nil, contextError(ctx, err)
+			}
+		}
+
+		if alias := item.Options.Alias; alias != "" {
+			if aliases[alias] {
+				results[i].Err = fmt.Errorf("%w: %q", ErrAliasTaken, alias)
+				continue
+			}
+			aliases[alias] = true
+			link.ID = alias
+		}
+
+		results[i].Link = link
+		pending = append(pending, i)
+	}
+
+	for attempt := 0; attempt < maxAttempts && len(pending) > 0; attempt++ {
+		// give every generated link an ID for this round, making sure the batch doesn't collide with itself
+		used := make(map[string]bool, len(pending))
+		var round []int
+
+		for _, i := range pending {
+			if items[i].Options.Alias != "" {
+				used[results[i].Link.ID] = true
+				round = append(round, i)
+			}
+		}
+
+		var retry []int
+		for _, i := range pending {
+			if items[i].Options.Alias != "" {
+				continue
+			}
+
+			id, err := s.nextID(ctx, items[i].URL, attempt)
+			if err != nil {
+				return nil, contextError(ctx, err)
+			}
+
+			if isReservedAlias(id) || used[id] {
+				if used[id] {
+					s.counts.collisions.Add(1)
+				}
+				retry = append(retry, i) // collision -> retry next round
+				continue
+			}
+
+			used[id] = true
+			results[i].Link.ID = id
+			round = append(round, i)
+		}
+
+		links := make([]ShortLink, len(round))
+		for j, i := range round {
+			links[j] = results[i].Link
+		}
+
+		errs, err := s.store.SaveMany(ctx, links, s.events(EventLinkCreated)...)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		for j, i := range round {
+			switch {
+			case errs[j] == nil:
+				results[i].Created = true
+			case errors.Is(errs[j], ErrDuplicateURL):
+				// another create of the same URL got in after FindByURL: hand out its link
+				existing, err := s.store.FindByURL(ctx, items[i].URL, items[i].Options.Owner)
+				switch {
+				case err == nil:
+					results[i].Link = existing
+				case errors.Is(err, ErrNotFound):
+					retry = append(retry, i) // and it's gone again
+				default:
+					return nil, contextError(ctx, err)
+				}
+			case !errors.Is(errs[j], ErrDuplicateID):
+				results[i].Err = errs[j]
+			case items[i].Options.Alias != "":
+				results[i].Err = fmt.Errorf("%w: %q", ErrAliasTaken, items[i].Options.Alias)
+			default:
+				s.counts.collisions.Add(1)
+				retry = append(retry, i) // collision -> retry next round
+			}
+		}
+
+		pending = retry
+	}
+
+	for _, i := range pending {
+		results[i].Err = ErrTooManyCollisions
+	}
+
+	for i, first := range sameAs {
+		results[i] = BatchResult{Link: results[first].Link, Err: results[first].Err}
+	}
+
+	// failed items shouldn't carry a half-built link
+	var created []ShortLink
+	for i := range results {
+		if results[i].Err != nil {
+			results[i].Link = ShortLink{}
+		}
+		if results[i].Created {
+			created = append(created, results[i].Link)
+		}
+	}
+	s.counts.created.Add(int64(len(created)))
+	if len(created) > 0 {
+		s.notify()
+	}
+
+	return results, nil
+}
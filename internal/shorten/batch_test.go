@@ -0,0 +1,156 @@
+package shorten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCreateBatch(t *testing.T) {
+	t.Run("Results are in input order", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		items := []BatchItem{
+			{URL: "https://example.com/a"},
+			{URL: "not a url"},
+			{URL: "https://example.com/b", Options: CreateOptions{Alias: "my-alias"}},
+			{URL: "https://example.com/c", Options: CreateOptions{Alias: "my-alias"}},
+		}
+
+		results, err := shortener.CreateBatch(context.Background(), items)
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+
+		if len(results) != len(items) {
+			t.Fatalf("expected %d results, got %d", len(items), len(results))
+		}
+
+		if results[0].Err != nil || results[0].Link.URL != "https://example.com/a" {
+			t.Fatalf("expected item 0 to succeed, got %+v", results[0])
+		}
+		if !errors.Is(results[1].Err, ErrInvalidURL) {
+			t.Fatalf("expected ErrInvalidURL for item 1, got %v", results[1].Err)
+		}
+		if results[2].Err != nil || results[2].Link.ID != "my-alias" {
+			t.Fatalf("expected item 2 to get its alias, got %+v", results[2])
+		}
+		if !errors.Is(results[3].Err, ErrAliasTaken) {
+			t.Fatalf("expected ErrAliasTaken for repeated alias, got %v", results[3].Err)
+		}
+
+		// successful items are really saved
+		for _, i := range []int{0, 2} {
+			if _, err := shortener.Stats(context.Background(), results[i].Link.ID); err != nil {
+				t.Fatalf("expected item %d to be saved, got %v", i, err)
+			}
+		}
+	})
+
+	t.Run("Collisions are retried", func(t *testing.T) {
+		// "id1" already exists and is also handed out twice within the batch
+		shortener := newTestShortener(t, NewSequenceGenerator("id1", "id1", "id1", "id2", "id3"))
+		if _, err := shortener.Create(context.Background(), "https://example.com"); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		results, err := shortener.CreateBatch(context.Background(), []BatchItem{
+			{URL: "https://example.com/a"},
+			{URL: "https://example.com/b"},
+		})
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+
+		for i, result := range results {
+			if result.Err != nil {
+				t.Fatalf("item %d: expected nil error, got %v", i, result.Err)
+			}
+		}
+
+		if results[0].Link.ID == results[1].Link.ID {
+			t.Fatalf("expected distinct ids, both got %q", results[0].Link.ID)
+		}
+	})
+
+	t.Run("Too many collisions", func(t *testing.T) {
+		shortener := newTestShortener(t, NewMockGenerator())
+		if _, err := shortener.Create(context.Background(), "https://example.com"); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		results, err := shortener.CreateBatch(context.Background(), []BatchItem{{URL: "https://example.com/a"}})
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+
+		if !errors.Is(results[0].Err, ErrTooManyCollisions) {
+			t.Fatalf("expected ErrTooManyCollisions, got %v", results[0].Err)
+		}
+	})
+
+	t.Run("Batch size limits", func(t *testing.T) {
+		shortener := NewShortener(NewMemStore(), NewBase62Generator(), WithMaxBatchSize(3))
+
+		items := make([]BatchItem, 4)
+		for i := range items {
+			items[i] = BatchItem{URL: fmt.Sprintf("https://example.com/%d", i)}
+		}
+
+		if _, err := shortener.CreateBatch(context.Background(), items); !errors.Is(err, ErrBatchTooLarge) {
+			t.Fatalf("expected ErrBatchTooLarge, got %v", err)
+		}
+
+		if _, err := shortener.CreateBatch(context.Background(), nil); !errors.Is(err, ErrEmptyBatch) {
+			t.Fatalf("expected ErrEmptyBatch, got %v", err)
+		}
+	})
+}
+
+func TestCreateBatch_Dedupe(t *testing.T) {
+	shortener := NewShortener(NewMemStore(), NewBase62Generator(), WithDedupe())
+
+	existing, err := shortener.Create(context.Background(), "https://example.com/old")
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	results, err := shortener.CreateBatch(context.Background(), []BatchItem{
+		{URL: "https://example.com/old"},
+		{URL: "https://example.com/new"},
+		{URL: "https://EXAMPLE.com/new"},
+	})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+
+	if results[0].Created || results[0].Link.ID != existing.ID {
+		t.Fatalf("expected item 0 to reuse %q, got %+v", existing.ID, results[0])
+	}
+	if !results[1].Created {
+		t.Fatalf("expected item 1 to be created, got %+v", results[1])
+	}
+	if results[2].Created || results[2].Link.ID != results[1].Link.ID {
+		t.Fatalf("expected item 2 to share item 1's link, got %+v", results[2])
+	}
+}
+
+func TestCreateBatch_DedupeRace(t *testing.T) {
+	store := &racingStore{MemStore: NewMemStore()}
+	shortener := NewShortener(store, NewBase62Generator(), WithDedupe())
+
+	winner := ShortLink{ID: "winner", URL: "https://example.com", CreatedAt: time.Now(), Canonical: true}
+	if err := store.Save(context.Background(), winner); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	results, err := shortener.CreateBatch(context.Background(), []BatchItem{{URL: "https://example.com"}})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if results[0].Err != nil || results[0].Created || results[0].Link.ID != winner.ID {
+		t.Fatalf("expected the item to reuse %q, got %+v", winner.ID, results[0])
+	}
+}
@@ -0,0 +1,56 @@
+package shorten
+
+import (
+	"net/http"
+	"strings"
+)
+
+// BotClassifier decides which redirects were made by crawlers and link-preview fetchers rather
+// than people. Those still get redirected, but are counted as BotHits instead of Hits
+type BotClassifier struct {
+	patterns []string        // lowercase User-Agent substrings
+	methods  map[string]bool // request methods that are never a person clicking a link
+}
+
+// DefaultBotMethods are the methods preview fetchers and link checkers use to look before fetching
+var DefaultBotMethods = []string{http.MethodHead, http.MethodOptions}
+
+// DefaultBotPatterns returns the User-Agent substrings the stats already treat as bots,
+// which cover the common crawlers and chat / social link previews
+func DefaultBotPatterns() []string {
+	return append([]string(nil), botMarkers...)
+}
+
+// NewBotClassifier returns a classifier that treats requests made with one of methods, or with a
+// User-Agent containing one of patterns (ignoring case), as bots
+func NewBotClassifier(patterns, methods []string) *BotClassifier {
+	c := &BotClassifier{methods: make(map[string]bool, len(methods))}
+
+	for _, p := range patterns {
+		if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+			c.patterns = append(c.patterns, p)
+		}
+	}
+	for _, m := range methods {
+		if m = strings.ToUpper(strings.TrimSpace(m)); m != "" {
+			c.methods[m] = true
+		}
+	}
+
+	return c
+}
+
+// IsBot reports whether a redirect for this method and User-Agent shouldn't count as a hit
+func (c *BotClassifier) IsBot(method, userAgent string) bool {
+	if c.methods[method] {
+		return true
+	}
+
+	lower := strings.ToLower(userAgent)
+	for _, p := range c.patterns {
+		if strings.Contains(lower, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package shorten
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const slackUA = "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"
+
+func TestBotClassifier(t *testing.T) {
+	bots := NewBotClassifier(DefaultBotPatterns(), DefaultBotMethods)
+
+	tests := []struct {
+		name   string
+		method string
+		ua     string
+		want   bool
+	}{
+		{"Browser", http.MethodGet, firefoxUA, false},
+		{"Phone", http.MethodGet, iphoneUA, false},
+		{"No user agent", http.MethodGet, "", false},
+		{"Crawler", http.MethodGet, botUA, true},
+		{"Slack preview", http.MethodGet, slackUA, true},
+		{"WhatsApp preview", http.MethodGet, "WhatsApp/2.23.20.0", true},
+		{"Twitter in-app browser", http.MethodGet, "Mozilla/5.0 (iPhone) Mobile Twitter for iPhone", false},
+		{"HEAD", http.MethodHead, firefoxUA, true},
+		{"OPTIONS", http.MethodOptions, firefoxUA, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bots.IsBot(tt.method, tt.ua); got != tt.want {
+				t.Fatalf("IsBot(%q, %q) = %v, want %v", tt.method, tt.ua, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Custom patterns and methods", func(t *testing.T) {
+		bots := NewBotClassifier([]string{" LinkChecker ", ""}, []string{"head", " "})
+
+		if !bots.IsBot(http.MethodGet, "my-linkchecker/1.0") {
+			t.Fatal("expected a custom pattern to match regardless of case")
+		}
+		if !bots.IsBot(http.MethodHead, firefoxUA) {
+			t.Fatal("expected HEAD to be a bot method")
+		}
+		if bots.IsBot(http.MethodOptions, firefoxUA) || bots.IsBot("", botUA) {
+			t.Fatal("expected only the configured rules to apply")
+		}
+	})
+}
+
+func TestResolveVisit_Bots(t *testing.T) {
+	ctx := context.Background()
+
+	for _, aggregated := range []bool{false, true} {
+		name := "Counted in the store"
+		if aggregated {
+			name = "Counted by the aggregator"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			store := NewMemStore()
+			hits := NewHitAggregator(store, time.Hour, 100)
+
+			var opts []Option
+			if aggregated {
+				opts = append(opts, WithHitAggregator(hits))
+			}
+			shortener := NewShortener(store, NewBase62Generator(), opts...)
+
+			link, err := shortener.Create(ctx, "https://example.com")
+			if err != nil {
+				t.Fatalf("setup failed: %v", err)
+			}
+
+			visits := []Visit{
+				{At: time.Now(), Method: http.MethodGet, UserAgent: firefoxUA},
+				{At: time.Now(), Method: http.MethodGet, UserAgent: slackUA},
+				{At: time.Now(), Method: http.MethodHead, UserAgent: firefoxUA},
+			}
+			for _, visit := range visits {
+				if url, err := shortener.ResolveVisit(ctx, link.ID, visit); err != nil || url != "https://example.com" {
+					t.Fatalf("expected a redirect for %s %q, got %q (err=%v)", visit.Method, visit.UserAgent, url, err)
+				}
+			}
+
+			stats, err := shortener.Stats(ctx, link.ID)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if stats.Hits != 1 || stats.BotHits != 2 {
+				t.Fatalf("expected hits=1 botHits=2, got hits=%d botHits=%d", stats.Hits, stats.BotHits)
+			}
+
+			if err := hits.Flush(ctx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			stored, err := store.Get(ctx, link.ID)
+			if err != nil || stored.Hits != 1 || stored.BotHits != 2 {
+				t.Fatalf("expected hits=1 botHits=2 in the store, got %+v (err=%v)", stored, err)
+			}
+		})
+	}
+
+	t.Run("Bots don't use up MaxHits", func(t *testing.T) {
+		shortener := NewShortener(NewMemStore(), NewBase62Generator())
+		link, err := shortener.CreateWithOptions(ctx, "https://example.com", CreateOptions{MaxHits: 1})
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		for range 3 {
+			if _, err := shortener.ResolveVisit(ctx, link.ID, Visit{At: time.Now(), UserAgent: slackUA}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if _, err := shortener.ResolveVisit(ctx, link.ID, Visit{At: time.Now(), UserAgent: firefoxUA}); err != nil {
+			t.Fatalf("expected the one allowed hit to go to a person, got %v", err)
+		}
+		if _, err := shortener.ResolveVisit(ctx, link.ID, Visit{At: time.Now(), UserAgent: firefoxUA}); !errors.Is(err, ErrHitLimitReached) {
+			t.Fatalf("expected ErrHitLimitReached, got %v", err)
+		}
+	})
+
+	t.Run("Inactive links are not followed by bots either", func(t *testing.T) {
+		shortener := NewShortener(NewMemStore(), NewBase62Generator())
+		link, err := shortener.Create(ctx, "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		if err := shortener.Delete(ctx, link.ID); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		if _, err := shortener.ResolveVisit(ctx, link.ID, Visit{At: time.Now(), UserAgent: slackUA}); !errors.Is(err, ErrDeleted) {
+			t.Fatalf("expected ErrDeleted, got %v", err)
+		}
+	})
+
+	t.Run("Bot clicks are recorded as bots but not as visitors", func(t *testing.T) {
+		shortener, clicks, _ := newTestClickShortener(t)
+		link, err := shortener.Create(ctx, "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		now := time.Now()
+		visits := []Visit{
+			{At: now, Method: http.MethodGet, IP: "203.0.113.7", UserAgent: firefoxUA},
+			{At: now, Method: http.MethodHead, IP: "203.0.113.8", UserAgent: firefoxUA},
+			{At: now, Method: http.MethodGet, IP: "203.0.113.9", UserAgent: slackUA},
+		}
+		for _, visit := range visits {
+			if _, err := shortener.ResolveVisit(ctx, link.ID, visit); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if err := clicks.Flush(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		b, err := shortener.Breakdown(ctx, link.ID, now.Add(-time.Hour), now.Add(time.Hour), 0)
+		if err != nil || b.Total != 3 || b.Bots != 2 {
+			t.Fatalf("expected 3 clicks of which 2 bots, got %+v (err=%v)", b, err)
+		}
+
+		visitors, err := shortener.UniqueVisitors(ctx, link.ID, now, now)
+		if err != nil || visitors != 1 {
+			t.Fatalf("expected 1 unique visitor, got %d (err=%v)", visitors, err)
+		}
+	})
+}
+
+func TestHandleRedirect_Bots(t *testing.T) {
+	shortener := NewShortener(NewMemStore(), NewBase62Generator())
+	link, err := shortener.Create(context.Background(), "https://example.com")
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	RegisterRoutes(mux, shortener)
+
+	for _, method := range []string{http.MethodHead, http.MethodOptions} {
+		req := httptest.NewRequest(method, "/"+link.ID, nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusFound {
+			t.Fatalf("%s: expected 302, got %d", method, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/stats/"+link.ID, nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	var resp statsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Hits != 0 || resp.BotHits != 2 {
+		t.Fatalf("expected hits=0 botHits=2, got hits=%d botHits=%d", resp.Hits, resp.BotHits)
+	}
+}
@@ -0,0 +1,138 @@
+package shorten
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+const (
+	defaultBreakdownLimit = 10
+	maxBreakdownLimit     = 100
+)
+
+// BreakdownEntry is one value of a breakdown dimension, e.g. the "Firefox" browser family
+type BreakdownEntry struct {
+	Name   string
+	Clicks int64
+}
+
+// Breakdown splits a link's clicks by where they came from and what made them.
+// Each list is sorted by clicks, most first, and only has the top values
+type Breakdown struct {
+	Total  int64
+	Humans int64
+	Bots   int64
+
+	Referrers []BreakdownEntry // "(direct)" for clicks without a referrer
+	Browsers  []BreakdownEntry
+	OSes      []BreakdownEntry
+	Devices   []BreakdownEntry // agent classes other than bots
+}
+
+// names used in breakdowns for clicks where the value isn't known
+const (
+	directReferrer = "(direct)"
+	otherFamily    = "Other"
+)
+
+// breakdownCounts are the raw per-dimension counts a store collects for a Breakdown
+type breakdownCounts struct {
+	referrers map[string]int64
+	browsers  map[string]int64
+	oses      map[string]int64
+	agents    map[string]int64
+}
+
+func newBreakdownCounts() breakdownCounts {
+	return breakdownCounts{
+		referrers: make(map[string]int64),
+		browsers:  make(map[string]int64),
+		oses:      make(map[string]int64),
+		agents:    make(map[string]int64),
+	}
+}
+
+// breakdown turns the counts into a Breakdown with at most limit entries per list.
+// The agent counts must be complete, since the totals come from them
+func (c breakdownCounts) breakdown(limit int) Breakdown {
+	var b Breakdown
+
+	devices := make(map[string]int64)
+	for class, n := range c.agents {
+		b.Total += n
+		if class == AgentBot {
+			b.Bots += n
+			continue
+		}
+		if class == "" {
+			class = AgentUnknown
+		}
+		devices[class] += n
+	}
+	b.Humans = b.Total - b.Bots
+
+	b.Referrers = topEntries(c.referrers, directReferrer, limit)
+	b.Browsers = topEntries(c.browsers, otherFamily, limit)
+	b.OSes = topEntries(c.oses, otherFamily, limit)
+	b.Devices = topEntries(devices, AgentUnknown, limit)
+
+	return b
+}
+
+// topEntries returns the limit largest counts, most first (ties by name), calling "" unknown
+func topEntries(counts map[string]int64, unknown string, limit int) []BreakdownEntry {
+	merged := make(map[string]int64, len(counts))
+	for name, n := range counts {
+		if name == "" {
+			name = unknown
+		}
+		merged[name] += n
+	}
+
+	entries := make([]BreakdownEntry, 0, len(merged))
+	for name, n := range merged {
+		entries = append(entries, BreakdownEntry{Name: name, Clicks: n})
+	}
+
+	slices.SortFunc(entries, func(a, b BreakdownEntry) int {
+		if c := cmp.Compare(b.Clicks, a.Clicks); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+// Breakdown reports where a link's clicks in [from, to) came from: top referrer domains, browser and
+// OS families, device classes, and how many were bots. limit caps each list (0 means the default)
+func (s *Shortener) Breakdown(ctx context.Context, id string, from, to time.Time, limit int) (Breakdown, error) {
+	if s.clicks == nil {
+		return Breakdown{}, ErrClicksDisabled
+	}
+
+	if !from.Before(to) {
+		return Breakdown{}, fmt.Errorf("%w: from must be before to", ErrInvalidRange)
+	}
+	if limit <= 0 {
+		limit = defaultBreakdownLimit
+	}
+	limit = min(limit, maxBreakdownLimit)
+
+	// 404 / 410 for links that don't exist (any more)
+	if _, err := s.Stats(ctx, id); err != nil {
+		return Breakdown{}, err
+	}
+
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
+	b, err := s.clicks.store.ClickBreakdown(ctx, id, from, to, limit)
+	return b, contextError(ctx, err)
+}
@@ -0,0 +1,158 @@
+package shorten
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	firefoxUA = "Mozilla/5.0 (X11; Linux x86_64; rv:127.0) Gecko/20100101 Firefox/127.0"
+	iphoneUA  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1"
+	botUA     = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+)
+
+func TestBreakdown(t *testing.T) {
+	ctx := context.Background()
+	shortener, clicks, _ := newTestClickShortener(t)
+
+	link, err := shortener.Create(ctx, "https://example.com")
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	now := time.Now()
+	visits := []Visit{
+		{At: now, Referrer: "https://news.example.org/a", UserAgent: firefoxUA},
+		{At: now, Referrer: "https://news.example.org/b", UserAgent: iphoneUA},
+		{At: now, Referrer: "https://t.co/xyz", UserAgent: iphoneUA},
+		{At: now, UserAgent: iphoneUA},
+		{At: now, UserAgent: botUA},
+		{At: now.Add(-48 * time.Hour), UserAgent: firefoxUA}, // outside the window
+	}
+	for _, visit := range visits {
+		if _, err := shortener.ResolveVisit(ctx, link.ID, visit); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+	}
+	if err := clicks.Flush(ctx); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	from, to := now.Add(-time.Hour), now.Add(time.Hour)
+
+	t.Run("Counts by dimension", func(t *testing.T) {
+		b, err := shortener.Breakdown(ctx, link.ID, from, to, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if b.Total != 5 || b.Humans != 4 || b.Bots != 1 {
+			t.Fatalf("expected total=5 humans=4 bots=1, got %d/%d/%d", b.Total, b.Humans, b.Bots)
+		}
+
+		wantReferrers := []BreakdownEntry{{directReferrer, 2}, {"news.example.org", 2}, {"t.co", 1}}
+		if !equalEntries(b.Referrers, wantReferrers) {
+			t.Fatalf("expected referrers %v, got %v", wantReferrers, b.Referrers)
+		}
+
+		wantBrowsers := []BreakdownEntry{{"Safari", 3}, {"Firefox", 1}, {otherFamily, 1}}
+		if !equalEntries(b.Browsers, wantBrowsers) {
+			t.Fatalf("expected browsers %v, got %v", wantBrowsers, b.Browsers)
+		}
+
+		wantOSes := []BreakdownEntry{{"iOS", 3}, {"Linux", 1}, {otherFamily, 1}}
+		if !equalEntries(b.OSes, wantOSes) {
+			t.Fatalf("expected os %v, got %v", wantOSes, b.OSes)
+		}
+
+		wantDevices := []BreakdownEntry{{AgentMobile, 3}, {AgentDesktop, 1}}
+		if !equalEntries(b.Devices, wantDevices) {
+			t.Fatalf("expected devices %v, got %v", wantDevices, b.Devices)
+		}
+	})
+
+	t.Run("Limit caps each list but not the totals", func(t *testing.T) {
+		b, err := shortener.Breakdown(ctx, link.ID, from, to, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(b.Referrers) != 1 || len(b.Browsers) != 1 || len(b.OSes) != 1 {
+			t.Fatalf("expected 1 entry per list, got %+v", b)
+		}
+		if b.Total != 5 {
+			t.Fatalf("expected total=5, got %d", b.Total)
+		}
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		if _, err := shortener.Breakdown(ctx, link.ID, to, from, 0); !errors.Is(err, ErrInvalidRange) {
+			t.Fatalf("expected ErrInvalidRange, got %v", err)
+		}
+		if _, err := shortener.Breakdown(ctx, "missing", from, to, 0); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func equalEntries(got, want []BreakdownEntry) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHandleBreakdown(t *testing.T) {
+	shortener, clicks, _ := newTestClickShortener(t)
+	mux := http.NewServeMux()
+	RegisterRoutes(mux, shortener)
+
+	link, err := shortener.Create(context.Background(), "https://example.com")
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/"+link.ID, nil)
+	req.Header.Set("User-Agent", firefoxUA)
+	req.Header.Set("Referer", "https://news.example.org/")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	clicks.Flush(context.Background())
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stats/"+link.ID+"/breakdown", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var resp breakdownResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if resp.Total != 1 || resp.Humans != 1 {
+		t.Fatalf("expected 1 human click, got %+v", resp)
+	}
+	if len(resp.Referrers) != 1 || resp.Referrers[0].Name != "news.example.org" {
+		t.Fatalf("expected news.example.org as the referrer, got %+v", resp.Referrers)
+	}
+	if len(resp.Browsers) != 1 || resp.Browsers[0].Name != "Firefox" {
+		t.Fatalf("expected Firefox as the browser, got %+v", resp.Browsers)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stats/"+link.ID+"/breakdown?limit=0", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for a bad limit, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
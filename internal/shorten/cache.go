@@ -0,0 +1,284 @@
+package shorten
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errLoadAbandoned is get asking to be tried again: it waited for another caller's fetch, and that
+// failed because the other caller went away, which says nothing about the link or this request
+var errLoadAbandoned = errors.New("shared load abandoned")
+
+// CachedStore wraps a Store with an in-memory, read-through LRU cache for Get, so the hottest
+// links don't cost a database round trip on every lookup.
+//
+//   - Entries live for ttl; lookups that came back ErrNotFound are remembered for negativeTTL,
+//     so hammering an unknown ID doesn't reach the database either.
+//   - At most size links are kept, the least recently used one is dropped first.
+//   - Anything that changes a link (Save, Update, Delete, Hit, AddHits...) drops or refreshes its entry.
+//   - Concurrent misses for the same ID share a single call to the wrapped store.
+//
+// The cache is per process, so with several replicas an update made on one of them
+// can be seen as the old link on the others for up to ttl.
+type CachedStore struct {
+	Store
+
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // id -> element holding a *cacheEntry
+	lru     *list.List               // most recently used at the front
+	loads   map[string]*cacheLoad    // misses currently being fetched from the wrapped store
+
+	hits   atomic.Int64
+	misses atomic.Int64
+
+	now func() time.Time // time.Now outside of tests
+}
+
+type cacheEntry struct {
+	id        string
+	link      ShortLink
+	err       error // ErrNotFound for negative entries
+	expiresAt time.Time
+}
+
+// cacheLoad is one in-flight Get on the wrapped store that other callers can wait for
+type cacheLoad struct {
+	done      chan struct{}
+	link      ShortLink
+	err       error
+	abandoned bool // err came from the fetching caller's context ending, not from the store
+}
+
+// CacheStats is a snapshot of a CachedStore's counters
+type CacheStats struct {
+	Hits    int64
+	Misses  int64
+	Entries int
+}
+
+func NewCachedStore(store Store, size int, ttl time.Duration, negativeTTL time.Duration) *CachedStore {
+	if size <= 0 {
+		size = 1
+	}
+
+	return &CachedStore{
+		Store:       store,
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		loads:       make(map[string]*cacheLoad),
+		now:         time.Now,
+	}
+}
+
+// Stats returns the cache's hit and miss counts so far, and how many links it holds
+func (store *CachedStore) Stats() CacheStats {
+	store.mu.Lock()
+	entries := store.lru.Len()
+	store.mu.Unlock()
+
+	return CacheStats{
+		Hits:    store.hits.Load(),
+		Misses:  store.misses.Load(),
+		Entries: entries,
+	}
+}
+
+func (store *CachedStore) Get(ctx context.Context, id string) (ShortLink, error) {
+	for {
+		link, err := store.get(ctx, id)
+		if !errors.Is(err, errLoadAbandoned) {
+			return link, err
+		}
+	}
+}
+
+// get is one attempt at Get
+func (store *CachedStore) get(ctx context.Context, id string) (ShortLink, error) {
+	store.mu.Lock()
+
+	if elem, ok := store.entries[id]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if store.now().Before(entry.expiresAt) {
+			store.lru.MoveToFront(elem)
+			store.mu.Unlock()
+			store.hits.Add(1)
+			return entry.link, entry.err
+		}
+		store.remove(elem)
+	}
+
+	store.misses.Add(1)
+
+	// somebody is already fetching this ID -> wait for their answer instead of asking again
+	if load, ok := store.loads[id]; ok {
+		store.mu.Unlock()
+		select {
+		case <-load.done:
+			if load.abandoned && ctx.Err() == nil {
+				return ShortLink{}, errLoadAbandoned
+			}
+			return load.link, load.err
+		case <-ctx.Done():
+			return ShortLink{}, ctx.Err()
+		}
+	}
+
+	load := &cacheLoad{done: make(chan struct{})}
+	store.loads[id] = load
+	store.mu.Unlock()
+
+	load.link, load.err = store.Store.Get(ctx, id)
+	// drivers don't all return ctx.Err() when a query is cancelled, so ask ctx itself
+	load.abandoned = load.err != nil && ctx.Err() != nil
+
+	store.mu.Lock()
+	// if the link changed while we were fetching it, the invalidation has already
+	// dropped this load and what we got may be stale, so don't cache it
+	if store.loads[id] == load {
+		delete(store.loads, id)
+		store.set(id, load.link, load.err)
+	}
+	store.mu.Unlock()
+
+	close(load.done)
+
+	return load.link, load.err
+}
+
+func (store *CachedStore) Save(ctx context.Context, link ShortLink, events ...EventType) error {
+	// the ID may have been cached as not found
+	defer store.invalidate(link.ID)
+	return store.Store.Save(ctx, link, events...)
+}
+
+func (store *CachedStore) SaveMany(ctx context.Context, links []ShortLink, events ...EventType) ([]error, error) {
+	defer func() {
+		for _, link := range links {
+			store.invalidate(link.ID)
+		}
+	}()
+	return store.Store.SaveMany(ctx, links, events...)
+}
+
+func (store *CachedStore) IncrementHits(ctx context.Context, id string) error {
+	defer store.invalidate(id)
+	return store.Store.IncrementHits(ctx, id)
+}
+
+// AddHits drops every link it counted for, even if it failed: the write may have gone through anyway
+func (store *CachedStore) AddHits(ctx context.Context, counts map[string]HitCount) error {
+	defer func() {
+		for id := range counts {
+			store.invalidate(id)
+		}
+	}()
+	return store.Store.AddHits(ctx, counts)
+}
+
+// Hit always goes to the wrapped store, since it has to count the hit there.
+// The link it returns is the freshest copy there is, so it replaces the cached one
+func (store *CachedStore) Hit(ctx context.Context, id string, now time.Time) (ShortLink, error) {
+	link, err := store.Store.Hit(ctx, id, now)
+
+	switch {
+	case err == nil:
+		store.refresh(id, link, nil)
+	case errors.Is(err, ErrNotFound):
+		store.refresh(id, ShortLink{}, ErrNotFound)
+	default:
+		store.invalidate(id)
+	}
+
+	return link, err
+}
+
+func (store *CachedStore) Update(ctx context.Context, id string, url string, events ...EventType) (ShortLink, error) {
+	defer store.invalidate(id)
+	return store.Store.Update(ctx, id, url, events...)
+}
+
+func (store *CachedStore) Delete(ctx context.Context, id string, events ...EventType) error {
+	defer store.invalidate(id)
+	return store.Store.Delete(ctx, id, events...)
+}
+
+func (store *CachedStore) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	n, err := store.Store.DeleteExpired(ctx, before)
+	if n > 0 {
+		// there's no telling which IDs went, so start over
+		store.mu.Lock()
+		clear(store.entries)
+		clear(store.loads)
+		store.lru.Init()
+		store.mu.Unlock()
+	}
+	return n, err
+}
+
+// invalidate drops id from the cache, along with any fetch of it that's in progress
+func (store *CachedStore) invalidate(id string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if elem, ok := store.entries[id]; ok {
+		store.remove(elem)
+	}
+	delete(store.loads, id)
+}
+
+// refresh replaces id's entry with a result that's known to be current
+func (store *CachedStore) refresh(id string, link ShortLink, err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.loads, id)
+	store.set(id, link, err)
+}
+
+// set caches the result of looking up id. Errors other than ErrNotFound aren't cached.
+// The caller must hold mu
+func (store *CachedStore) set(id string, link ShortLink, err error) {
+	ttl := store.ttl
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrNotFound):
+		ttl = store.negativeTTL
+		err = ErrNotFound
+	default:
+		return
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	entry := &cacheEntry{id: id, link: link, err: err, expiresAt: store.now().Add(ttl)}
+
+	if elem, ok := store.entries[id]; ok {
+		elem.Value = entry
+		store.lru.MoveToFront(elem)
+		return
+	}
+
+	store.entries[id] = store.lru.PushFront(entry)
+
+	for store.lru.Len() > store.size {
+		store.remove(store.lru.Back())
+	}
+}
+
+// remove drops one entry. The caller must hold mu
+func (store *CachedStore) remove(elem *list.Element) {
+	store.lru.Remove(elem)
+	delete(store.entries, elem.Value.(*cacheEntry).id)
+}
@@ -0,0 +1,275 @@
+package shorten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStore is a MemStore that counts the Gets that reach it.
+// If release is set, every Get waits for it to be closed first, or fails the way a
+// cancelled query does if ctx ends before then
+type countingStore struct {
+	*MemStore
+	gets    atomic.Int64
+	release chan struct{}
+}
+
+func (store *countingStore) Get(ctx context.Context, id string) (ShortLink, error) {
+	store.gets.Add(1)
+	if store.release != nil {
+		select {
+		case <-store.release:
+		case <-ctx.Done():
+			return ShortLink{}, errors.New("pq: canceling statement due to user request")
+		}
+	}
+	return store.MemStore.Get(ctx, id)
+}
+
+func newTestCache(t *testing.T, size int) (*CachedStore, *countingStore) {
+	t.Helper()
+
+	backing := &countingStore{MemStore: NewMemStore()}
+	cache := NewCachedStore(backing, size, time.Minute, time.Second)
+
+	for i := range 3 {
+		link := ShortLink{ID: fmt.Sprintf("id%d", i), URL: "https://example.com", CreatedAt: time.Now()}
+		if err := backing.Save(context.Background(), link); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+	}
+
+	return cache, backing
+}
+
+func TestCachedStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Read through", func(t *testing.T) {
+		cache, backing := newTestCache(t, 10)
+
+		for range 3 {
+			link, err := cache.Get(ctx, "id0")
+			if err != nil || link.ID != "id0" {
+				t.Fatalf("expected id0, got %+v err=%v", link, err)
+			}
+		}
+
+		if n := backing.gets.Load(); n != 1 {
+			t.Fatalf("expected 1 Get on the store, got %d", n)
+		}
+		if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+			t.Fatalf("expected 2 hits, 1 miss and 1 entry, got %+v", stats)
+		}
+	})
+
+	t.Run("Entries expire", func(t *testing.T) {
+		cache, backing := newTestCache(t, 10)
+		now := time.Now()
+		cache.now = func() time.Time { return now }
+
+		cache.Get(ctx, "id0")
+		now = now.Add(2 * time.Minute)
+		cache.Get(ctx, "id0")
+
+		if n := backing.gets.Load(); n != 2 {
+			t.Fatalf("expected the expired entry to be fetched again, got %d Gets", n)
+		}
+	})
+
+	t.Run("Not found is cached briefly", func(t *testing.T) {
+		cache, backing := newTestCache(t, 10)
+		now := time.Now()
+		cache.now = func() time.Time { return now }
+
+		for range 2 {
+			if _, err := cache.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+		}
+		if n := backing.gets.Load(); n != 1 {
+			t.Fatalf("expected 1 Get on the store, got %d", n)
+		}
+
+		now = now.Add(2 * time.Second)
+		cache.Get(ctx, "missing")
+		if n := backing.gets.Load(); n != 2 {
+			t.Fatalf("expected the negative entry to expire after its shorter TTL, got %d Gets", n)
+		}
+	})
+
+	t.Run("Saving drops a cached not found", func(t *testing.T) {
+		cache, _ := newTestCache(t, 10)
+
+		cache.Get(ctx, "new")
+		if err := cache.Save(ctx, ShortLink{ID: "new", URL: "https://example.com", CreatedAt: time.Now()}); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		if _, err := cache.Get(ctx, "new"); err != nil {
+			t.Fatalf("expected the saved link, got %v", err)
+		}
+	})
+
+	t.Run("Update and delete invalidate", func(t *testing.T) {
+		cache, _ := newTestCache(t, 10)
+
+		cache.Get(ctx, "id0")
+		if _, err := cache.Update(ctx, "id0", "https://example.org"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		link, _ := cache.Get(ctx, "id0")
+		if link.URL != "https://example.org" {
+			t.Fatalf("expected the updated URL, got %q", link.URL)
+		}
+
+		if err := cache.Delete(ctx, "id0"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		link, _ = cache.Get(ctx, "id0")
+		if link.DeletedAt == nil {
+			t.Fatal("expected the cached link to be deleted")
+		}
+	})
+
+	t.Run("Hit refreshes the entry", func(t *testing.T) {
+		cache, backing := newTestCache(t, 10)
+
+		cache.Get(ctx, "id0")
+		if _, err := cache.Hit(ctx, "id0", time.Now()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		link, _ := cache.Get(ctx, "id0")
+		if link.Hits != 1 {
+			t.Fatalf("expected hits=1, got %d", link.Hits)
+		}
+		if n := backing.gets.Load(); n != 1 {
+			t.Fatalf("expected the hit to update the cache instead of dropping it, got %d Gets", n)
+		}
+	})
+
+	t.Run("Least recently used is evicted", func(t *testing.T) {
+		cache, backing := newTestCache(t, 2)
+
+		cache.Get(ctx, "id0")
+		cache.Get(ctx, "id1")
+		cache.Get(ctx, "id0") // id1 is now the least recently used
+		cache.Get(ctx, "id2")
+
+		if stats := cache.Stats(); stats.Entries != 2 {
+			t.Fatalf("expected 2 entries, got %d", stats.Entries)
+		}
+
+		before := backing.gets.Load()
+		cache.Get(ctx, "id0")
+		if backing.gets.Load() != before {
+			t.Fatal("expected id0 to still be cached")
+		}
+		cache.Get(ctx, "id1")
+		if backing.gets.Load() != before+1 {
+			t.Fatal("expected id1 to have been evicted")
+		}
+	})
+
+	t.Run("Concurrent misses share one fetch", func(t *testing.T) {
+		cache, backing := newTestCache(t, 10)
+		backing.release = make(chan struct{})
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for range 20 {
+			wg.Go(func() {
+				if _, err := cache.Get(ctx, "id0"); err != nil {
+					errs <- err
+				}
+			})
+		}
+
+		// give every goroutine the chance to miss before the fetch completes
+		time.Sleep(50 * time.Millisecond)
+		close(backing.release)
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := backing.gets.Load(); n != 1 {
+			t.Fatalf("expected 1 Get on the store, got %d", n)
+		}
+	})
+
+	t.Run("Waiters outlive a cancelled fetch", func(t *testing.T) {
+		cache, backing := newTestCache(t, 10)
+		backing.release = make(chan struct{})
+
+		leaderCtx, cancel := context.WithCancel(ctx)
+		leaderErr := make(chan error, 1)
+		go func() {
+			_, err := cache.Get(leaderCtx, "id0")
+			leaderErr <- err
+		}()
+		for backing.gets.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		waiter := make(chan error, 1)
+		go func() {
+			link, err := cache.Get(ctx, "id0")
+			if err == nil && link.ID != "id0" {
+				err = fmt.Errorf("got %+v", link)
+			}
+			waiter <- err
+		}()
+
+		// let the waiter start waiting on the leader's fetch, then give up on that
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+		if err := <-leaderErr; err == nil {
+			t.Fatal("expected the cancelled caller to fail")
+		}
+
+		close(backing.release)
+		if err := <-waiter; err != nil {
+			t.Fatalf("expected the waiter to get the link, got %v", err)
+		}
+	})
+}
+
+func TestCachedStore_HitAggregator(t *testing.T) {
+	ctx := context.Background()
+
+	cache := NewCachedStore(NewMemStore(), 10, time.Minute, time.Second)
+	hits := NewHitAggregator(cache, time.Hour, 100)
+	shortener := NewShortener(cache, NewBase62Generator(), WithHitAggregator(hits))
+
+	link, err := shortener.Create(ctx, "https://example.com")
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	for range 5 {
+		if _, err := shortener.Resolve(ctx, link.ID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// caches the link with no hits flushed yet
+	if stats, err := shortener.Stats(ctx, link.ID); err != nil || stats.Hits != 5 {
+		t.Fatalf("expected hits=5 before the flush, got %d (err=%v)", stats.Hits, err)
+	}
+
+	if err := hits.Flush(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if stats, err := shortener.Stats(ctx, link.ID); err != nil || stats.Hits != 5 {
+		t.Fatalf("expected hits=5 after the flush, got %d (err=%v)", stats.Hits, err)
+	}
+}
@@ -0,0 +1,321 @@
+package shorten
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClicksDisabled = errors.New("click recording is not enabled")
+	ErrInvalidBucket  = errors.New("invalid bucket, must be hour or day")
+	ErrInvalidRange   = errors.New("invalid time range")
+)
+
+// most buckets one time series may have, e.g. ~41 days by the hour
+const maxTimeseriesBuckets = 1000
+
+// Visit is what the redirect handler knows about one click
+type Visit struct {
+	At        time.Time
+	Method    string // request method; HEAD and OPTIONS are bots by default, see BotClassifier
+	IP        string // client IP, used only to derive Click.IPHash and Click.Visitor
+	Referrer  string // the Referer header as sent, if any
+	UserAgent string
+}
+
+// Click is one recorded redirect
+type Click struct {
+	LinkID       string
+	At           time.Time
+	ReferrerHost string // lowercase host of the referring page; "" for direct traffic
+	AgentClass   string // one of the Agent* classes, see classifyUserAgent
+	Browser      string // browser family, "" if unknown
+	OS           string // operating system family, "" if unknown
+	IPHash       string // keyed hash of the client IP, never the IP itself
+	Visitor      uint64 // keyed hash of the IP and user agent, for unique visitor counts (bots aren't counted)
+}
+
+// Bucket is the width of one point in a click time series. Buckets start on the hour / at midnight UTC
+type Bucket string
+
+const (
+	BucketHour Bucket = "hour"
+	BucketDay  Bucket = "day"
+)
+
+func parseBucket(raw string) (Bucket, error) {
+	switch Bucket(raw) {
+	case "", BucketDay:
+		return BucketDay, nil
+	case BucketHour:
+		return BucketHour, nil
+	default:
+		return "", ErrInvalidBucket
+	}
+}
+
+// start returns the start of the bucket t falls in
+func (b Bucket) start(t time.Time) time.Time {
+	t = t.UTC()
+	if b == BucketHour {
+		return t.Truncate(time.Hour)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func (b Bucket) next(t time.Time) time.Time {
+	if b == BucketHour {
+		return t.Add(time.Hour)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// ClickCount is the number of clicks in the bucket starting at Start
+type ClickCount struct {
+	Start  time.Time
+	Clicks int64
+}
+
+// ClickStore keeps click events
+type ClickStore interface {
+	// RecordClicks saves a batch of clicks and adds their visitors to the links' daily visitor
+	// sketches. Clicks for links that no longer exist are dropped
+	RecordClicks(ctx context.Context, clicks []Click) error
+	// UniqueVisitors estimates how many distinct visitors a link had on the (UTC) days from from to to
+	UniqueVisitors(ctx context.Context, id string, from, to time.Time) (int64, error)
+	// ClickCounts counts a link's clicks in [from, to) per bucket. Empty buckets are left out
+	ClickCounts(ctx context.Context, id string, from, to time.Time, bucket Bucket) ([]ClickCount, error)
+	// ClickBreakdown counts a link's clicks in [from, to) by referrer, browser, OS and agent class,
+	// keeping the top limit values of each (agent classes are never cut)
+	ClickBreakdown(ctx context.Context, id string, from, to time.Time, limit int) (Breakdown, error)
+}
+
+// ClickRecorder turns visits into Clicks and saves them in batches, every interval or once
+// batchSize of them are waiting, so recording never slows a redirect down.
+// If the store falls behind, at most clickBufferBatches batches are held and newer clicks are dropped
+type ClickRecorder struct {
+	store     ClickStore
+	salt      []byte
+	interval  time.Duration
+	batchSize int
+
+	mu      sync.Mutex
+	buffer  []Click
+	dropped int64 // clicks dropped since the last successful flush
+
+	full chan struct{} // nudges Run to flush early
+}
+
+const clickBufferBatches = 10
+
+// NewClickRecorder returns a recorder that saves to store. salt keys the IP hash: keep it secret,
+// and the same across servers and restarts, or the same visitor will look like several
+func NewClickRecorder(store ClickStore, salt []byte, interval time.Duration, batchSize int) *ClickRecorder {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	return &ClickRecorder{
+		store:     store,
+		salt:      salt,
+		interval:  interval,
+		batchSize: batchSize,
+		full:      make(chan struct{}, 1),
+	}
+}
+
+// Record queues a click on link id. bot marks a visit the Shortener's BotClassifier caught
+// even if the User-Agent doesn't look like one
+func (rec *ClickRecorder) Record(id string, visit Visit, bot bool) {
+	agent := parseUserAgent(visit.UserAgent)
+	if bot {
+		agent.Class = AgentBot
+	}
+	click := Click{
+		LinkID:       id,
+		At:           visit.At,
+		ReferrerHost: referrerHost(visit.Referrer),
+		AgentClass:   agent.Class,
+		Browser:      agent.Browser,
+		OS:           agent.OS,
+		IPHash:       rec.hashIP(visit.IP),
+		Visitor:      rec.visitorFingerprint(visit),
+	}
+
+	rec.mu.Lock()
+	if len(rec.buffer) >= clickBufferBatches*rec.batchSize {
+		rec.dropped++
+		rec.mu.Unlock()
+		return
+	}
+	rec.buffer = append(rec.buffer, click)
+	n := len(rec.buffer)
+	rec.mu.Unlock()
+
+	if n >= rec.batchSize {
+		select {
+		case rec.full <- struct{}{}:
+		default: // a flush has already been asked for
+		}
+	}
+}
+
+// hashIP is an HMAC rather than a plain hash, since the IPv4 space is small enough to hash exhaustively
+func (rec *ClickRecorder) hashIP(ip string) string {
+	if ip == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, rec.salt)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// visitorFingerprint tells visitors apart for the unique visitor count: people behind the same
+// IP (an office, a mobile carrier) mostly differ in user agent. It's keyed like hashIP
+func (rec *ClickRecorder) visitorFingerprint(visit Visit) uint64 {
+	mac := hmac.New(sha256.New, rec.salt)
+	mac.Write([]byte(visit.IP))
+	mac.Write([]byte{0})
+	mac.Write([]byte(visit.UserAgent))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// referrerHost reduces a Referer header to its host, which is all the stats need
+func referrerHost(referrer string) string {
+	if referrer == "" {
+		return ""
+	}
+
+	u, err := url.Parse(referrer)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// Run flushes every interval (or when a batch fills up) until ctx is cancelled.
+// It's meant to be run in its own goroutine
+func (rec *ClickRecorder) Run(ctx context.Context) {
+	runFlusher(ctx, "clicks", rec.interval, rec.full, rec.Flush)
+}
+
+// Flush saves everything that's queued. If that fails the clicks are queued again for the next flush
+func (rec *ClickRecorder) Flush(ctx context.Context) error {
+	rec.mu.Lock()
+	batch := rec.buffer
+	rec.buffer = nil
+	dropped := rec.dropped
+	rec.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if err := rec.store.RecordClicks(ctx, batch); err != nil {
+		rec.mu.Lock()
+		// what's queued meanwhile is newer, so the failed batch goes first
+		rec.buffer = append(batch, rec.buffer...)
+		if excess := len(rec.buffer) - clickBufferBatches*rec.batchSize; excess > 0 {
+			rec.buffer = rec.buffer[:len(rec.buffer)-excess]
+			rec.dropped += int64(excess)
+		}
+		rec.mu.Unlock()
+		return err
+	}
+
+	if dropped > 0 {
+		rec.mu.Lock()
+		rec.dropped -= dropped
+		rec.mu.Unlock()
+		log.Printf("clicks: dropped %d clicks because the store was falling behind", dropped)
+	}
+
+	return nil
+}
+
+// Drain saves whatever is queued, retrying failures with backoff until ctx ends.
+// Call it once Run has stopped and no more redirects are being served
+func (rec *ClickRecorder) Drain(ctx context.Context) error {
+	err := drainFlusher(ctx, "clicks", rec.Flush)
+	if err != nil {
+		rec.mu.Lock()
+		lost := len(rec.buffer)
+		rec.mu.Unlock()
+		return fmt.Errorf("%d clicks were not saved: %w", lost, err)
+	}
+	return nil
+}
+
+// Timeseries counts a link's clicks per bucket over [from, to), including empty buckets.
+// Clicks show up once the ClickRecorder has flushed them
+func (s *Shortener) Timeseries(ctx context.Context, id string, from, to time.Time, bucket Bucket) ([]ClickCount, error) {
+	if s.clicks == nil {
+		return nil, ErrClicksDisabled
+	}
+
+	if bucket != BucketHour && bucket != BucketDay {
+		return nil, ErrInvalidBucket
+	}
+	if !from.Before(to) {
+		return nil, fmt.Errorf("%w: from must be before to", ErrInvalidRange)
+	}
+
+	// 404 / 410 for links that don't exist (any more)
+	if _, err := s.Stats(ctx, id); err != nil {
+		return nil, err
+	}
+
+	var points []ClickCount
+	for start := bucket.start(from); start.Before(to); start = bucket.next(start) {
+		if len(points) == maxTimeseriesBuckets {
+			return nil, fmt.Errorf("%w: more than %d buckets, use a shorter range or a wider bucket", ErrInvalidRange, maxTimeseriesBuckets)
+		}
+		points = append(points, ClickCount{Start: start})
+	}
+
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
+	counts, err := s.clicks.store.ClickCounts(ctx, id, points[0].Start, to, bucket)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	// both are sorted by start, so merge them in one pass
+	j := 0
+	for i := range points {
+		for j < len(counts) && counts[j].Start.Before(points[i].Start) {
+			j++
+		}
+		if j < len(counts) && counts[j].Start.Equal(points[i].Start) {
+			points[i].Clicks = counts[j].Clicks
+		}
+	}
+
+	return points, nil
+}
+
+// UniqueVisitors estimates how many distinct visitors a link had on the days from from to to.
+// Like Timeseries, visitors count once the ClickRecorder has flushed their clicks
+func (s *Shortener) UniqueVisitors(ctx context.Context, id string, from, to time.Time) (int64, error) {
+	if s.clicks == nil {
+		return 0, ErrClicksDisabled
+	}
+
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
+	n, err := s.clicks.store.UniqueVisitors(ctx, id, from, to)
+	return n, contextError(ctx, err)
+}
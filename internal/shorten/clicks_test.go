@@ -0,0 +1,330 @@
+package shorten
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClickShortener(t *testing.T) (*Shortener, *ClickRecorder, *MemStore) {
+	t.Helper()
+
+	store := NewMemStore()
+	clicks := NewClickRecorder(store, []byte("test-salt"), time.Hour, 100)
+	return NewShortener(store, NewBase62Generator(), WithClickRecorder(clicks)), clicks, store
+}
+
+func TestClickRecorder(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Visits become clicks", func(t *testing.T) {
+		shortener, clicks, store := newTestClickShortener(t)
+		link, err := shortener.Create(ctx, "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		at := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+		_, err = shortener.ResolveVisit(ctx, link.ID, Visit{
+			At:        at,
+			IP:        "203.0.113.7",
+			Referrer:  "https://News.Example.org/some/page?q=1",
+			UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(store.clicks.buf) != 0 {
+			t.Fatal("expected clicks to be buffered until the flush")
+		}
+		if err := clicks.Flush(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(store.clicks.buf) != 1 {
+			t.Fatalf("expected 1 click, got %d", len(store.clicks.buf))
+		}
+		click := store.clicks.buf[0]
+
+		if click.LinkID != link.ID || !click.At.Equal(at) {
+			t.Fatalf("unexpected click %+v", click)
+		}
+		if click.ReferrerHost != "news.example.org" {
+			t.Fatalf("expected referrer host news.example.org, got %q", click.ReferrerHost)
+		}
+		if click.AgentClass != AgentMobile {
+			t.Fatalf("expected agent class %q, got %q", AgentMobile, click.AgentClass)
+		}
+		if click.IPHash == "" || strings.Contains(click.IPHash, "203.0.113.7") {
+			t.Fatalf("expected a hashed IP, got %q", click.IPHash)
+		}
+		if click.IPHash != clicks.hashIP("203.0.113.7") {
+			t.Fatal("expected the same IP to hash the same way")
+		}
+	})
+
+	t.Run("Failed lookups are not recorded", func(t *testing.T) {
+		shortener, clicks, store := newTestClickShortener(t)
+
+		if _, err := shortener.ResolveVisit(ctx, "missing", Visit{At: time.Now()}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+		clicks.Flush(ctx)
+
+		if len(store.clicks.buf) != 0 {
+			t.Fatalf("expected no clicks, got %d", len(store.clicks.buf))
+		}
+	})
+
+	t.Run("IP hashes depend on the salt", func(t *testing.T) {
+		a := NewClickRecorder(NewMemStore(), []byte("one"), time.Hour, 1)
+		b := NewClickRecorder(NewMemStore(), []byte("two"), time.Hour, 1)
+
+		if a.hashIP("203.0.113.7") == b.hashIP("203.0.113.7") {
+			t.Fatal("expected different salts to give different hashes")
+		}
+	})
+
+	t.Run("MemStore keeps a bounded number of clicks", func(t *testing.T) {
+		var ring clickRing
+		for i := range memClickCapacity + 5 {
+			ring.add(Click{LinkID: "a", At: time.Unix(int64(i), 0)})
+		}
+
+		if len(ring.buf) != memClickCapacity {
+			t.Fatalf("expected %d clicks, got %d", memClickCapacity, len(ring.buf))
+		}
+		// the 5 oldest were overwritten
+		for _, click := range ring.buf {
+			if click.At.Unix() < 5 {
+				t.Fatalf("expected the oldest clicks to be overwritten, found %v", click.At)
+			}
+		}
+	})
+}
+
+func TestTimeseries(t *testing.T) {
+	ctx := context.Background()
+	shortener, clicks, _ := newTestClickShortener(t)
+
+	link, err := shortener.Create(ctx, "https://example.com")
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, at := range []time.Time{
+		day.Add(1 * time.Hour),
+		day.Add(1*time.Hour + 30*time.Minute),
+		day.Add(3 * time.Hour),
+		day.Add(26 * time.Hour),
+	} {
+		if _, err := shortener.ResolveVisit(ctx, link.ID, Visit{At: at}); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+	}
+	if err := clicks.Flush(ctx); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	t.Run("By the hour, with empty buckets", func(t *testing.T) {
+		points, err := shortener.Timeseries(ctx, link.ID, day, day.Add(4*time.Hour), BucketHour)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		want := []int64{0, 2, 0, 1}
+		if len(points) != len(want) {
+			t.Fatalf("expected %d points, got %d", len(want), len(points))
+		}
+		for i, point := range points {
+			if !point.Start.Equal(day.Add(time.Duration(i) * time.Hour)) {
+				t.Fatalf("point %d: unexpected start %v", i, point.Start)
+			}
+			if point.Clicks != want[i] {
+				t.Fatalf("point %d: expected %d clicks, got %d", i, want[i], point.Clicks)
+			}
+		}
+	})
+
+	t.Run("By the day", func(t *testing.T) {
+		// from is rounded down to the start of its bucket
+		points, err := shortener.Timeseries(ctx, link.ID, day.Add(6*time.Hour), day.AddDate(0, 0, 2), BucketDay)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(points) != 2 || points[0].Clicks != 3 || points[1].Clicks != 1 {
+			t.Fatalf("expected [3 1], got %+v", points)
+		}
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		if _, err := shortener.Timeseries(ctx, link.ID, day, day.Add(-time.Hour), BucketHour); !errors.Is(err, ErrInvalidRange) {
+			t.Fatalf("expected ErrInvalidRange, got %v", err)
+		}
+		if _, err := shortener.Timeseries(ctx, link.ID, day, day.AddDate(1, 0, 0), BucketHour); !errors.Is(err, ErrInvalidRange) {
+			t.Fatalf("expected ErrInvalidRange for too many buckets, got %v", err)
+		}
+		if _, err := shortener.Timeseries(ctx, link.ID, day, day.Add(time.Hour), Bucket("week")); !errors.Is(err, ErrInvalidBucket) {
+			t.Fatalf("expected ErrInvalidBucket, got %v", err)
+		}
+		if _, err := shortener.Timeseries(ctx, "missing", day, day.Add(time.Hour), BucketHour); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Disabled without a recorder", func(t *testing.T) {
+		plain := newTestShortener(t, NewBase62Generator())
+		if _, err := plain.Timeseries(ctx, link.ID, day, day.Add(time.Hour), BucketHour); !errors.Is(err, ErrClicksDisabled) {
+			t.Fatalf("expected ErrClicksDisabled, got %v", err)
+		}
+	})
+}
+
+func TestHandleTimeseries(t *testing.T) {
+	shortener, clicks, _ := newTestClickShortener(t)
+	mux := http.NewServeMux()
+	RegisterRoutes(mux, shortener)
+
+	link, err := shortener.Create(context.Background(), "https://example.com")
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	// a real redirect, so the handler's visit gets recorded
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/"+link.ID, nil))
+	if rr.Code != http.StatusFound {
+		t.Fatalf("expected status %d, got %d", http.StatusFound, rr.Code)
+	}
+	clicks.Flush(context.Background())
+
+	t.Run("Counts per bucket", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stats/"+link.ID+"/timeseries?bucket=hour", nil))
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		var resp timeseriesResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if resp.Bucket != BucketHour || resp.Total != 1 {
+			t.Fatalf("expected 1 click by the hour, got %+v", resp)
+		}
+		if len(resp.Points) < 24 {
+			t.Fatalf("expected a day of hourly points by default, got %d", len(resp.Points))
+		}
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"bad bucket", "/stats/" + link.ID + "/timeseries?bucket=week", http.StatusBadRequest},
+		{"bad time", "/stats/" + link.ID + "/timeseries?from=yesterday", http.StatusBadRequest},
+		{"unknown link", "/stats/missing/timeseries", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rr.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, rr.Code)
+			}
+		})
+	}
+}
+
+func TestUniqueVisitors(t *testing.T) {
+	ctx := context.Background()
+	shortener, clicks, _ := newTestClickShortener(t)
+
+	link, err := shortener.Create(ctx, "https://example.com")
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	visit := func(at time.Time, ip string) {
+		t.Helper()
+		if _, err := shortener.ResolveVisit(ctx, link.ID, Visit{At: at, IP: ip, UserAgent: firefoxUA}); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+	}
+
+	// three people on the first day, one of them clicking a lot, and one of them again the next day
+	for range 5 {
+		visit(day, "203.0.113.1")
+	}
+	visit(day, "203.0.113.2")
+	visit(day, "203.0.113.3")
+	visit(day.AddDate(0, 0, 1), "203.0.113.1")
+	visit(day.AddDate(0, 0, 1), "203.0.113.4")
+
+	if err := clicks.Flush(ctx); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     int64
+	}{
+		{"first day", day, day, 3},
+		{"second day", day.AddDate(0, 0, 1), day.AddDate(0, 0, 1), 2},
+		{"both days count returning visitors once", day, day.AddDate(0, 0, 1), 4},
+		{"no visits", day.AddDate(0, 0, 5), day.AddDate(0, 0, 6), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := shortener.UniqueVisitors(ctx, link.ID, tt.from, tt.to)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("Reported by /stats", func(t *testing.T) {
+		mux := http.NewServeMux()
+		RegisterRoutes(mux, shortener)
+
+		fresh, err := shortener.Create(ctx, "https://example.com/fresh")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		for _, ip := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.1"} {
+			req := httptest.NewRequest(http.MethodGet, "/"+fresh.ID, nil)
+			req.RemoteAddr = ip + ":1234"
+			mux.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		clicks.Flush(ctx)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stats/"+fresh.ID, nil))
+
+		var resp statsResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if resp.UniqueVisitors == nil || *resp.UniqueVisitors != 2 {
+			t.Fatalf("expected uniqueVisitors=2, got %v", resp.UniqueVisitors)
+		}
+	})
+}
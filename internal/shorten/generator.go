@@ -1,38 +1,101 @@
 package shorten
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"strings"
 	"sync"
 )
 
 // Generator interface so you can swap generator implementations without touching handlers
 type IDGenerator interface {
-	Next(url string) (string, error)
+	Next(ctx context.Context, url string) (string, error)
 }
 
 // ---------------------------------------------------------
 
+// CounterAllocator hands out blocks of counter values from durable storage (hi/lo allocation).
+// Every call must return a range that no other call, on this or any other server, has been given.
+type CounterAllocator interface {
+	// AllocateBlock reserves size consecutive counter values and returns the first one
+	AllocateBlock(ctx context.Context, size uint64) (uint64, error)
+}
+
 // Generator 1: A deterministic base62 generator
 // It has zero collisions (each id is generated from an incremented counter value, i.e., each one is generated using a new number)
+//
+// By default the counter only lives in memory, so it starts from 0 again on every restart. With an allocator it
+// reserves a block of values at a time from durable storage instead, so IDs stay unique across restarts and replicas
+// while only costing one round trip per block. (Values left in a block when the server stops are simply skipped.)
 type Base62Generator struct {
-	mu      sync.Mutex
-	counter uint64
+	counter blockCounter
 }
 
 func NewBase62Generator() *Base62Generator {
 	return &Base62Generator{}
 }
 
+// NewBlockBase62Generator returns a Base62Generator that takes its counter values from alloc, blockSize at a time
+func NewBlockBase62Generator(alloc CounterAllocator, blockSize uint64) *Base62Generator {
+	return &Base62Generator{counter: newBlockCounter(alloc, blockSize)}
+}
+
 // You need to have a "Next()" function so the Base62Generator implements the IDGenerator interface
-func (g *Base62Generator) Next(_ string) (string, error) {
-	g.mu.Lock()
-	defer g.mu.Unlock()
+func (g *Base62Generator) Next(ctx context.Context, _ string) (string, error) {
+	n, err := g.counter.next(ctx)
+	if err != nil {
+		return "", err
+	}
 
-	g.counter++
+	return encodeBase62(n), nil
+}
+
+// blockCounter is the counter behind the sequential generators. Its zero value counts in memory from 1.
+type blockCounter struct {
+	mu      sync.Mutex
+	counter uint64
 
-	return encodeBase62(g.counter), nil
+	alloc     CounterAllocator
+	blockSize uint64
+	blockEnd  uint64 // last counter value in the current block
+}
+
+func newBlockCounter(alloc CounterAllocator, blockSize uint64) blockCounter {
+	if blockSize == 0 {
+		blockSize = 1
+	}
+
+	return blockCounter{
+		alloc:     alloc,
+		blockSize: blockSize,
+	}
+}
+
+func (c *blockCounter) next(ctx context.Context) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// current block used up (or none reserved yet) -> reserve the next one
+	if c.alloc != nil && c.counter >= c.blockEnd {
+		start, err := c.alloc.AllocateBlock(ctx, c.blockSize)
+		if err != nil {
+			return 0, fmt.Errorf("allocate id block: %w", err)
+		}
+		c.counter = start - 1
+		c.blockEnd = start + c.blockSize - 1
+	}
+
+	c.counter++
+
+	return c.counter, nil
 }
 
 const base62Chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
@@ -58,6 +121,27 @@ func encodeBase62(n uint64) string {
 	return string(encoded)
 }
 
+// decodeBase62 is the inverse of encodeBase62 (leading zeros are allowed)
+func decodeBase62(s string) (uint64, error) {
+	if s == "" {
+		return 0, errors.New("empty base62 string")
+	}
+
+	var n uint64
+	for i := 0; i < len(s); i++ {
+		digit := strings.IndexByte(base62Chars, s[i])
+		if digit < 0 {
+			return 0, fmt.Errorf("invalid base62 character %q", s[i])
+		}
+		if n > (math.MaxUint64-uint64(digit))/62 {
+			return 0, errors.New("base62 value overflows uint64")
+		}
+		n = n*62 + uint64(digit)
+	}
+
+	return n, nil
+}
+
 // ------------------------------------------------------------
 
 // Generator 2: URLs generated by hashing them using SHA-256. (Note that for SHA-256, the same input (URL) will give you the same hash)
@@ -71,7 +155,7 @@ func NewHashGenerator(length int) *HashGenerator {
 	return &HashGenerator{length: length}
 }
 
-func (h *HashGenerator) Next(url string) (string, error) {
+func (h *HashGenerator) Next(_ context.Context, url string) (string, error) {
 	// hash the URL
 	hash := sha256.Sum256([]byte(url))
 
@@ -84,3 +168,207 @@ func (h *HashGenerator) Next(url string) (string, error) {
 
 	return encoded[:h.length], nil
 }
+
+// ------------------------------------------------------------
+
+// Generator 3: Cryptographically random IDs drawn from crypto/rand.
+// Unlike the counter these can't be enumerated by counting upwards, and unlike the hash they don't reveal
+// whether two people shortened the same URL. Collisions are possible but, with a long enough ID, rare
+// enough for Create's retry loop to absorb.
+type RandomGenerator struct {
+	length   int
+	alphabet string
+	random   io.Reader // crypto/rand.Reader outside of tests
+}
+
+// UnambiguousAlphabet is base62 without the characters that are easy to misread: 0/O/o, 1/l/I
+const UnambiguousAlphabet = "23456789abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// NewRandomGenerator returns a generator for IDs of the given length made from the characters in alphabet
+// (base62 if alphabet is empty). The alphabet may only use the characters aliases can, [A-Za-z0-9_-],
+// and must have at least 2 of them with none repeated.
+func NewRandomGenerator(length int, alphabet string) (*RandomGenerator, error) {
+	if alphabet == "" {
+		alphabet = base62Chars
+	}
+
+	if length <= 0 {
+		return nil, errors.New("id length must be positive")
+	}
+	if len(alphabet) < 2 {
+		return nil, errors.New("alphabet must have at least 2 characters")
+	}
+
+	seen := make(map[byte]bool, len(alphabet))
+	for i := 0; i < len(alphabet); i++ {
+		c := alphabet[i]
+		if !isIDChar(rune(c)) {
+			return nil, fmt.Errorf("alphabet may only contain letters, digits, '-' and '_', got %q", c)
+		}
+		if seen[c] {
+			return nil, fmt.Errorf("alphabet has duplicate character %q", c)
+		}
+		seen[c] = true
+	}
+
+	return &RandomGenerator{
+		length:   length,
+		alphabet: alphabet,
+		random:   rand.Reader,
+	}, nil
+}
+
+func (g *RandomGenerator) Next(_ context.Context, _ string) (string, error) {
+	n := len(g.alphabet)
+
+	// Rejection sampling: taking b % n directly would favour the first 256 % n characters.
+	// Only bytes below the largest multiple of n are used, so every character is equally likely.
+	limit := 256 - (256 % n)
+
+	id := make([]byte, 0, g.length)
+	buf := make([]byte, g.length)
+
+	for len(id) < g.length {
+		if _, err := io.ReadFull(g.random, buf); err != nil {
+			return "", fmt.Errorf("read random bytes: %w", err)
+		}
+
+		for _, b := range buf {
+			if int(b) >= limit {
+				continue // rejected
+			}
+			id = append(id, g.alphabet[int(b)%n])
+			if len(id) == g.length {
+				break
+			}
+		}
+	}
+
+	return string(id), nil
+}
+
+// ------------------------------------------------------------
+
+// Generator 4: Sequential counter, but passed through a keyed permutation before encoding.
+// The counter keeps the zero-collision guarantee of Base62Generator, while the permutation (a Feistel network
+// over a fixed number of bits) scrambles it so consecutive IDs look unrelated and /1, /2, /3 can't be walked.
+// It's a bijection, so with the key an admin can turn an ID back into its counter value (see Decode).
+// IDs are zero-padded to a fixed length, since the permuted values are spread over the whole range anyway.
+type PermutedGenerator struct {
+	counter blockCounter
+	perm    feistel
+	width   int // number of base62 characters needed for the largest bits-wide value
+}
+
+var ErrCounterExhausted = errors.New("counter has outgrown the permutation's bit width")
+
+const feistelRounds = 4
+
+// NewPermutedGenerator returns a generator that permutes counter values over [0, 2^bits) using key.
+// bits must be even and between 16 and 64, and the key at least 16 bytes. alloc may be nil for an
+// in-memory counter, otherwise counter values are reserved from it blockSize at a time.
+func NewPermutedGenerator(key []byte, bits int, alloc CounterAllocator, blockSize uint64) (*PermutedGenerator, error) {
+	if bits < 16 || bits > 64 || bits%2 != 0 {
+		return nil, errors.New("bits must be an even number between 16 and 64")
+	}
+	if len(key) < 16 {
+		return nil, errors.New("permutation key must be at least 16 bytes")
+	}
+
+	maxValue := uint64(math.MaxUint64)
+	if bits < 64 {
+		maxValue = 1<<bits - 1
+	}
+
+	return &PermutedGenerator{
+		counter: newBlockCounter(alloc, blockSize),
+		perm:    feistel{key: key, halfBits: uint(bits / 2)},
+		width:   len(encodeBase62(maxValue)),
+	}, nil
+}
+
+func (g *PermutedGenerator) Next(ctx context.Context, _ string) (string, error) {
+	n, err := g.counter.next(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if n > g.perm.max() {
+		return "", ErrCounterExhausted
+	}
+
+	return g.encode(g.perm.forward(n)), nil
+}
+
+// Decode recovers the counter value an ID was generated from
+func (g *PermutedGenerator) Decode(id string) (uint64, error) {
+	if len(id) != g.width {
+		return 0, fmt.Errorf("id must be %d characters long", g.width)
+	}
+
+	n, err := decodeBase62(id)
+	if err != nil {
+		return 0, err
+	}
+	if n > g.perm.max() {
+		return 0, errors.New("id is out of range for this permutation")
+	}
+
+	return g.perm.inverse(n), nil
+}
+
+func (g *PermutedGenerator) encode(n uint64) string {
+	encoded := encodeBase62(n)
+	return strings.Repeat("0", g.width-len(encoded)) + encoded
+}
+
+// feistel is a balanced Feistel network over 2*halfBits bits. The round function is a truncated
+// HMAC-SHA256 of the round number and the right half, so without the key the output can't be predicted.
+type feistel struct {
+	key      []byte
+	halfBits uint
+}
+
+func (f feistel) max() uint64 {
+	if f.halfBits == 32 {
+		return math.MaxUint64
+	}
+	return 1<<(2*f.halfBits) - 1
+}
+
+func (f feistel) mask() uint64 {
+	return 1<<f.halfBits - 1
+}
+
+func (f feistel) forward(n uint64) uint64 {
+	left, right := n>>f.halfBits, n&f.mask()
+
+	for round := 0; round < feistelRounds; round++ {
+		left, right = right, left^f.round(round, right)
+	}
+
+	return left<<f.halfBits | right
+}
+
+func (f feistel) inverse(n uint64) uint64 {
+	left, right := n>>f.halfBits, n&f.mask()
+
+	// undo the rounds in reverse order
+	for round := feistelRounds - 1; round >= 0; round-- {
+		left, right = right^f.round(round, left), left
+	}
+
+	return left<<f.halfBits | right
+}
+
+func (f feistel) round(round int, half uint64) uint64 {
+	var msg [9]byte
+	msg[0] = byte(round)
+	binary.BigEndian.PutUint64(msg[1:], half)
+
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	return binary.BigEndian.Uint64(sum[:8]) & f.mask()
+}
@@ -1,7 +1,11 @@
 package shorten
 
 import (
+	"context"
+	"bytes"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -12,7 +16,7 @@ func TestBase62Generator_Next(t *testing.T) {
 	seen := make(map[string]bool, n)
 	
 	for i := 0; i < n; i++ {
-		id, err := generator.Next("")
+		id, err := generator.Next(context.Background(), "")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -24,18 +28,56 @@ func TestBase62Generator_Next(t *testing.T) {
 	}
 }
 
+func TestBlockBase62Generator_UniqueAcrossRestarts(t *testing.T) {
+	// both generators share one allocator, like two replicas (or one server before and
+	// after a restart) sharing a database
+	alloc := NewMemStore()
+	first := NewBlockBase62Generator(alloc, 10)
+	second := NewBlockBase62Generator(alloc, 10)
+
+	seen := make(map[string]bool)
+
+	for i := 0; i < 25; i++ {
+		for _, generator := range []*Base62Generator{first, second} {
+			id, err := generator.Next(context.Background(), "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if seen[id] {
+				t.Fatalf("duplicate id %q", id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+type failingAllocator struct{}
+
+func (failingAllocator) AllocateBlock(context.Context, uint64) (uint64, error) {
+	return 0, errors.New("database unavailable")
+}
+
+func TestBlockBase62Generator_AllocationError(t *testing.T) {
+	generator := NewBlockBase62Generator(failingAllocator{}, 10)
+
+	if _, err := generator.Next(context.Background(), ""); err == nil {
+		t.Fatal("expected error when no block can be allocated, got nil")
+	}
+}
+
 // Test: Same input -> Same output
 func TestHashGenerator_Deterministic(t *testing.T) {
 	generator := NewHashGenerator(8)
 
 	url := "https://example.com"
 
-	id1, err := generator.Next(url)
+	id1, err := generator.Next(context.Background(), url)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	id2, err := generator.Next(url)
+	id2, err := generator.Next(context.Background(), url)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -52,12 +94,12 @@ func TestHashGenerator_DifferentInputs(t *testing.T) {
 	url1 := "https://example.com"
 	url2 := "https://example.com/other"
 
-	id1, err := generator.Next(url1)
+	id1, err := generator.Next(context.Background(), url1)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	id2, err := generator.Next(url2)
+	id2, err := generator.Next(context.Background(), url2)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	} 
@@ -77,7 +119,7 @@ func TestHashGenerator_Length(t *testing.T) {
 		t.Run(fmt.Sprintf("length=%d", length), func(t *testing.T) {
 			generator := NewHashGenerator(length)
 
-			id, err := generator.Next(url)
+			id, err := generator.Next(context.Background(), url)
 			if err != nil {
 				t.Fatalf("unexpected error: %v", err)
 			}
@@ -87,4 +129,198 @@ func TestHashGenerator_Length(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestRandomGenerator_Next(t *testing.T) {
+	generator, err := NewRandomGenerator(10, UnambiguousAlphabet)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	const n = 1000
+	seen := make(map[string]bool, n)
+
+	for i := 0; i < n; i++ {
+		id, err := generator.Next(context.Background(), "https://example.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(id) != 10 {
+			t.Fatalf("expected id length 10, got %d", len(id))
+		}
+
+		if strings.ContainsAny(id, "0Oo1lI") {
+			t.Fatalf("id %q contains a look-alike character", id)
+		}
+
+		// same input, different output: the URL plays no part
+		if seen[id] {
+			t.Fatalf("unexpected duplicate id %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+// Test: rejection sampling means no character gets picked more often than the others
+func TestRandomGenerator_NoModuloBias(t *testing.T) {
+	// every byte value 0-255 exactly once. With a 3 character alphabet, 255 would map to 'a'
+	// under plain modulo; with rejection sampling it's thrown away, leaving 85 of each.
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+
+	generator, err := NewRandomGenerator(255, "abc")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	generator.random = bytes.NewReader(all)
+
+	id, err := generator.Next(context.Background(), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, c := range "abc" {
+		if got := strings.Count(id, string(c)); got != 85 {
+			t.Fatalf("expected %q 85 times, got %d", c, got)
+		}
+	}
+}
+
+func TestNewRandomGenerator_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		length   int
+		alphabet string
+	}{
+		{"zero length", 0, ""},
+		{"single character alphabet", 8, "a"},
+		{"duplicate characters", 8, "abca"},
+		{"non-ASCII", 8, "abcé"},
+		{"whitespace", 8, "ab c"},
+		{"slash", 8, "ab/c"},
+		{"query", 8, "ab?c"},
+		{"fragment", 8, "ab#c"},
+		{"percent", 8, "ab%c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRandomGenerator(tt.length, tt.alphabet); err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+}
+
+var testPermutationKey = []byte("0123456789abcdef0123456789abcdef")
+
+// Test: the permutation is a bijection, so it can never produce a collision
+func TestFeistel_Bijection(t *testing.T) {
+	perm := feistel{key: testPermutationKey, halfBits: 8}
+
+	seen := make(map[uint64]bool, 1<<16)
+	for n := uint64(0); n <= perm.max(); n++ {
+		out := perm.forward(n)
+		if out > perm.max() {
+			t.Fatalf("forward(%d) = %d is out of range", n, out)
+		}
+		if seen[out] {
+			t.Fatalf("forward(%d) = %d collides with an earlier value", n, out)
+		}
+		seen[out] = true
+
+		if back := perm.inverse(out); back != n {
+			t.Fatalf("inverse(forward(%d)) = %d", n, back)
+		}
+	}
+}
+
+func TestPermutedGenerator_Next(t *testing.T) {
+	generator, err := NewPermutedGenerator(testPermutationKey, 40, nil, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var prev string
+	for i := uint64(1); i <= 100; i++ {
+		id, err := generator.Next(context.Background(), "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(id) != generator.width {
+			t.Fatalf("expected fixed id length %d, got %q", generator.width, id)
+		}
+		if id == encodeBase62(i) || id == prev {
+			t.Fatalf("id %q doesn't look permuted", id)
+		}
+		prev = id
+
+		counter, err := generator.Decode(id)
+		if err != nil {
+			t.Fatalf("decode %q: %v", id, err)
+		}
+		if counter != i {
+			t.Fatalf("expected %q to decode to %d, got %d", id, i, counter)
+		}
+	}
+}
+
+func TestPermutedGenerator_KeyMatters(t *testing.T) {
+	first, err := NewPermutedGenerator(testPermutationKey, 40, nil, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := NewPermutedGenerator([]byte("a completely different secret key"), 40, nil, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	id1, _ := first.Next(context.Background(), "")
+	id2, _ := second.Next(context.Background(), "")
+
+	if id1 == id2 {
+		t.Fatalf("expected different keys to give different ids, both gave %q", id1)
+	}
+}
+
+func TestPermutedGenerator_Exhausted(t *testing.T) {
+	// a 16 bit permutation only has room for counter values up to 65535
+	alloc := NewMemStore()
+	if _, err := alloc.AllocateBlock(context.Background(), 1 << 16); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	generator, err := NewPermutedGenerator(testPermutationKey, 16, alloc, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := generator.Next(context.Background(), ""); !errors.Is(err, ErrCounterExhausted) {
+		t.Fatalf("expected ErrCounterExhausted, got %v", err)
+	}
+}
+
+func TestNewPermutedGenerator_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		key  []byte
+		bits int
+	}{
+		{"short key", []byte("short"), 40},
+		{"odd bits", testPermutationKey, 41},
+		{"too few bits", testPermutationKey, 8},
+		{"too many bits", testPermutationKey, 66},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewPermutedGenerator(tt.key, tt.bits, nil, 0); err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+}
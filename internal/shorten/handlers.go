@@ -1,38 +1,252 @@
 package shorten
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
+
+	"shortener/internal/shared"
 )
 
 const maxBodyBytes = 1 << 20 // 1MB
 
 type Handler struct {
 	service *Shortener
+
+	idempotency    IdempotencyStore // nil disables Idempotency-Key support
+	idempotencyTTL time.Duration
+
+	liveHeartbeat time.Duration
+
+	keys *shared.KeyAuth // nil leaves every endpoint open and the admin endpoints unregistered
+
+	limiter *shared.RateLimiter // nil disables rate limiting
+	limits  RateLimits
+}
+
+// RateLimits are the rate limit policies for each group of routes. A zero policy leaves its group unlimited
+type RateLimits struct {
+	Create   shared.RatePolicy // creating, updating and deleting links
+	Read     shared.RatePolicy // stats and listings
+	Redirect shared.RatePolicy // following short links, limited per IP
+	Admin    shared.RatePolicy
 }
 
-func NewHandler(s *Shortener) *Handler {
-	return &Handler{service: s}
+// how often an idle live stream sends a comment, so proxies don't time the connection out
+const defaultLiveHeartbeat = 15 * time.Second
+
+// HandlerOption configures optional Handler behaviour in NewHandler
+type HandlerOption func(*Handler)
+
+// WithIdempotency enables the Idempotency-Key header on the create endpoints.
+// Keys and the responses they produced are kept in store for ttl
+func WithIdempotency(store IdempotencyStore, ttl time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.idempotency = store
+		h.idempotencyTTL = ttl
+	}
+}
+
+// WithLiveHeartbeat sets how often idle live streams send a heartbeat
+func WithLiveHeartbeat(interval time.Duration) HandlerOption {
+	return func(h *Handler) {
+		if interval > 0 {
+			h.liveHeartbeat = interval
+		}
+	}
+}
+
+// WithAPIKeys requires an API key with the right scope on every endpoint but redirects, and
+// registers the admin endpoints (e.g. the live stream of every link, minting keys)
+func WithAPIKeys(keys *shared.KeyAuth) HandlerOption {
+	return func(h *Handler) {
+		h.keys = keys
+	}
+}
+
+// WithRateLimits limits how fast each client can call each group of routes (see RateLimits).
+// The proxies limiter trusts also decide which address clicks are recorded from
+func WithRateLimits(limiter *shared.RateLimiter, limits RateLimits) HandlerOption {
+	return func(h *Handler) {
+		// unnamed policies would share their buckets
+		limits.Create.Name = cmp.Or(limits.Create.Name, "create")
+		limits.Read.Name = cmp.Or(limits.Read.Name, "read")
+		limits.Redirect.Name = cmp.Or(limits.Redirect.Name, "redirect")
+		limits.Admin.Name = cmp.Or(limits.Admin.Name, "admin")
+
+		h.limiter = limiter
+		h.limits = limits
+	}
+}
+
+func NewHandler(s *Shortener, opts ...HandlerOption) *Handler {
+	h := &Handler{service: s, liveHeartbeat: defaultLiveHeartbeat}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
 }
 
 type shortenRequest struct {
 	URL string `json:"url"`
+
+	// optional expiry: either an absolute time or a TTL from now, not both
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	TTLSeconds *int64     `json:"ttlSeconds,omitempty"`
+
+	// optional cap on the number of redirects, for one-time links and the like
+	MaxHits *int64 `json:"maxHits,omitempty"`
+
+	// optional vanity short ID, e.g. "spring-sale"
+	Alias string `json:"alias,omitempty"`
+}
+
+type batchRequest struct {
+	Items []shortenRequest `json:"items"`
+}
+
+// batchResult is the outcome for one item: Status is what POST /shorten would have returned for it
+type batchResult struct {
+	Status    int    `json:"status"`
+	Short     string `json:"short,omitempty"`
+	URL       string `json:"url,omitempty"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	MaxHits   int64  `json:"maxHits,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"` // same order as the request's items
+}
+
+type updateRequest struct {
+	URL string `json:"url"`
 }
 
 type shortenResponse struct {
-	Short string `json:"short"`
-	URL   string `json:"url"`
+	Short     string `json:"short"`
+	URL       string `json:"url"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	MaxHits   int64  `json:"maxHits,omitempty"`
 }
 
 type statsResponse struct {
 	URL       string `json:"url"`
 	Short     string `json:"short"`
 	Hits      int64  `json:"hits"`
+	BotHits   int64  `json:"botHits"`
 	CreatedAt string `json:"createdAt"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	MaxHits   int64  `json:"maxHits,omitempty"`
+	Owner     string `json:"owner,omitempty"`
+
+	// approximate, and only on /stats/{id} when clicks are recorded
+	UniqueVisitors *int64 `json:"uniqueVisitors,omitempty"`
+}
+
+type timeseriesPoint struct {
+	Start  string `json:"start"`
+	Clicks int64  `json:"clicks"`
+}
+
+type timeseriesResponse struct {
+	Short  string            `json:"short"`
+	Bucket Bucket            `json:"bucket"`
+	From   string            `json:"from"`
+	To     string            `json:"to"`
+	Total  int64             `json:"total"`
+	Points []timeseriesPoint `json:"points"`
+}
+
+type breakdownEntry struct {
+	Name   string `json:"name"`
+	Clicks int64  `json:"clicks"`
+}
+
+type breakdownResponse struct {
+	Short     string           `json:"short"`
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Total     int64            `json:"total"`
+	Humans    int64            `json:"humans"`
+	Bots      int64            `json:"bots"`
+	Referrers []breakdownEntry `json:"referrers"`
+	Browsers  []breakdownEntry `json:"browsers"`
+	OS        []breakdownEntry `json:"os"`
+	Devices   []breakdownEntry `json:"devices"`
+}
+
+// liveClick is the data of one "click" event on a live stream
+type liveClick struct {
+	Short    string `json:"short"`
+	At       string `json:"at"`
+	Bot      bool   `json:"bot"`
+	Referrer string `json:"referrer,omitempty"`
+	Device   string `json:"device"`
+	Browser  string `json:"browser,omitempty"`
+	OS       string `json:"os,omitempty"`
+}
+
+// liveDropped is the data of a "dropped" event: how many clicks this stream has missed in all
+type liveDropped struct {
+	Dropped int64 `json:"dropped"`
+}
+
+type webhookRequest struct {
+	URL    string      `json:"url"`
+	Secret string      `json:"secret,omitempty"` // generated if not given
+	Events []EventType `json:"events,omitempty"` // every event if empty
+}
+
+type webhookResponse struct {
+	ID        string      `json:"id"`
+	URL       string      `json:"url"`
+	Secret    string      `json:"secret,omitempty"` // only when the webhook is created
+	Events    []EventType `json:"events"`
+	CreatedAt string      `json:"createdAt"`
+}
+
+type webhookListResponse struct {
+	Webhooks []webhookResponse `json:"webhooks"`
+}
+
+type apiKeyRequest struct {
+	Name   string   `json:"name"`
+	Owner  string   `json:"owner,omitempty"` // the key's name if not given
+	Scopes []string `json:"scopes"`
+}
+
+type apiKeyResponse struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Owner      string   `json:"owner"`
+	Key        string   `json:"key,omitempty"` // only when the key is minted
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"createdAt"`
+	LastUsedAt string   `json:"lastUsedAt,omitempty"`
+	RevokedAt  string   `json:"revokedAt,omitempty"`
+}
+
+type apiKeyListResponse struct {
+	Keys []apiKeyResponse `json:"keys"`
+}
+
+type listResponse struct {
+	Links      []statsResponse `json:"links"`
+	NextCursor string          `json:"nextCursor,omitempty"`
 }
 
 type apiError struct {
@@ -49,26 +263,75 @@ func writeError(w http.ResponseWriter, status int, msg string) {
 	writeJSON(w, status, apiError{Error: msg})
 }
 
-func (h *Handler) HandleShorten(w http.ResponseWriter, r *http.Request) {
-	// 1) method
-	// This one's basically redundant since Go already blocks other methods when you indicate the method in your path string when
-	// registering a handler.
-	// But I'll leave it in for now in case say someone forgets and registers a handler without indicating it should only accept POST requests.
-	if r.Method != http.MethodPost {
-		w.Header().Set("Allow", http.MethodPost)
-		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
-		return
+// writeStatusError writes err with the given status, see errorMessage
+func writeStatusError(w http.ResponseWriter, status int, err error) {
+	writeError(w, status, errorMessage(status, err))
+}
+
+// errorMessage is what to tell the client about err. A 4xx is the client's doing and err says what
+// to fix. From 500 up it's ours: err is logged and the client gets a fixed message instead, since
+// it can carry driver errors, queries and hosts that clients have no business seeing
+func errorMessage(status int, err error) string {
+	if status < http.StatusInternalServerError {
+		return err.Error()
 	}
 
-	// 2) limit body size to prevent DoS attacks
+	log.Printf("http: responding %d: %v", status, err)
+	if status == http.StatusServiceUnavailable {
+		return "database is not responding, try again later"
+	}
+	return "internal server error"
+}
+
+// options turns the optional request fields into CreateOptions
+func (req shortenRequest) options(now time.Time) (CreateOptions, error) {
+	opts := CreateOptions{Alias: req.Alias}
+
+	switch {
+	case req.ExpiresAt != nil && req.TTLSeconds != nil:
+		return opts, errors.New("use either expiresAt or ttlSeconds, not both")
+	case req.ExpiresAt != nil:
+		opts.ExpiresAt = req.ExpiresAt
+	case req.TTLSeconds != nil:
+		if *req.TTLSeconds <= 0 {
+			return opts, errors.New("ttlSeconds must be positive")
+		}
+		// time.Duration is in nanoseconds, so guard against overflowing it
+		if *req.TTLSeconds > math.MaxInt64/int64(time.Second) {
+			return opts, errors.New("ttlSeconds is too large")
+		}
+		expiresAt := now.Add(time.Duration(*req.TTLSeconds) * time.Second)
+		opts.ExpiresAt = &expiresAt
+	}
+
+	if req.MaxHits != nil {
+		if *req.MaxHits <= 0 {
+			return opts, ErrInvalidMaxHits
+		}
+		opts.MaxHits = *req.MaxHits
+	}
+
+	return opts, nil
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// decodeJSON decodes a single JSON object from the request body into dst.
+// If it fails it writes the error response itself and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any) bool {
+	// limit body size to prevent DoS attacks
 	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
 	dec := json.NewDecoder(r.Body)
 
-	// 3) disallow unknown fields
+	// disallow unknown fields
 	dec.DisallowUnknownFields()
 
-	var req shortenRequest
-	if err := dec.Decode(&req); err != nil {
+	if err := dec.Decode(dst); err != nil {
 		var syntaxErr *json.SyntaxError
 		var unmarshalTypeErr *json.UnmarshalTypeError
 
@@ -85,35 +348,206 @@ func (h *Handler) HandleShorten(w http.ResponseWriter, r *http.Request) {
 			// includes errors from DisallowUnknownFields()
 			writeError(w, http.StatusBadRequest, err.Error())
 		}
-		return
+		return false
 	}
 
-	// 4) make sure there's no extra JSON after the first object
+	// make sure there's no extra JSON after the first object
 	if err := dec.Decode(&struct{}{}); err != io.EOF {
 		writeError(w, http.StatusBadRequest, "multiple JSON values in body")
+		return false
+	}
+
+	return true
+}
+
+func (h *Handler) HandleShorten(w http.ResponseWriter, r *http.Request) {
+	// 1) method
+	// This one's basically redundant since Go already blocks other methods when you indicate the method in your path string when
+	// registering a handler.
+	// But I'll leave it in for now in case say someone forgets and registers a handler without indicating it should only accept POST requests.
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// 2) decode the body (size limit, unknown fields, trailing data)
+	var req shortenRequest
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	// 5) generate short code
-	link, err := h.service.Create(req.URL)
+	// 3) work out the optional settings
+	opts, err := req.options(time.Now())
 	if err != nil {
-		switch {
-		case errors.Is(err, ErrInvalidURL):
-			writeError(w, http.StatusBadRequest, err.Error())
-		default:
-			writeError(w, http.StatusInternalServerError, err.Error())
-		}
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts.Owner, _ = requestOwner(r)
+
+	// 4) generate short code (or, in dedupe mode, find the existing one)
+	link, created, err := h.service.CreateOrGet(r.Context(), req.URL, opts)
+	if err != nil {
+		writeStatusError(w, createErrorStatus(err), err)
+		return
+	}
+
+	// 5) write response: 201 for a new link, 200 when an existing one was reused
+	writeJSON(w, createdStatus(created), newShortenResponse(link))
+}
+
+func createdStatus(created bool) int {
+	if created {
+		return http.StatusCreated
+	}
+	return http.StatusOK
+}
+
+func newShortenResponse(link ShortLink) shortenResponse {
+	return shortenResponse{
+		Short:     link.ID,
+		URL:       link.URL,
+		ExpiresAt: formatOptionalTime(link.ExpiresAt),
+		MaxHits:   link.MaxHits,
+	}
+}
+
+// createErrorStatus maps an error from creating a link to an HTTP status
+func createErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidURL), errors.Is(err, ErrInvalidExpiry), errors.Is(err, ErrInvalidMaxHits),
+		errors.Is(err, ErrInvalidAlias):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrAliasTaken):
+		return http.StatusConflict
+	case unavailable(err):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *Handler) HandleShortenBatch(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	// 6) write response
-	resp := shortenResponse{
-		Short: link.ID,
-		URL:   link.URL,
+	// check the size before doing any work, so one huge request can't tie up the server
+	switch {
+	case len(req.Items) == 0:
+		writeError(w, http.StatusBadRequest, ErrEmptyBatch.Error())
+		return
+	case len(req.Items) > h.service.MaxBatchSize():
+		writeError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("%s: %d items, the maximum is %d", ErrBatchTooLarge, len(req.Items), h.service.MaxBatchSize()))
+		return
 	}
+
+	now := time.Now()
+	owner, _ := requestOwner(r)
+	resp := batchResponse{Results: make([]batchResult, len(req.Items))}
+
+	// items with bad options never reach the service; the rest keep track of where they came from
+	var (
+		items   []BatchItem
+		indexes []int
+	)
+
+	for i, item := range req.Items {
+		opts, err := item.options(now)
+		if err != nil {
+			resp.Results[i] = batchResult{Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		opts.Owner = owner
+		items = append(items, BatchItem{URL: item.URL, Options: opts})
+		indexes = append(indexes, i)
+	}
+
+	if len(items) > 0 {
+		results, err := h.service.CreateBatch(r.Context(), items)
+		if err != nil {
+			writeStatusError(w, createErrorStatus(err), err)
+			return
+		}
+
+		for j, result := range results {
+			i := indexes[j]
+			if result.Err != nil {
+				status := createErrorStatus(result.Err)
+				resp.Results[i] = batchResult{Status: status, Error: errorMessage(status, result.Err)}
+				continue
+			}
+			resp.Results[i] = batchResult{
+				Status:    createdStatus(result.Created),
+				Short:     result.Link.ID,
+				URL:       result.Link.URL,
+				ExpiresAt: formatOptionalTime(result.Link.ExpiresAt),
+				MaxHits:   result.Link.MaxHits,
+			}
+		}
+	}
+
+	// per-item outcomes are in the body, so the request itself succeeded even if some items didn't
 	writeJSON(w, http.StatusOK, resp)
 }
 
+// unavailable reports whether err comes from a store call that ran out of time (see WithTimeouts)
+// or was abandoned because the client went away. A retry may well work, so it's a 503 rather than a 500
+func unavailable(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// requestOwner is who the request acts for: the owner of its API key. scoped is false when the
+// request may see every link, which is for admins and for servers that run without API keys
+func requestOwner(r *http.Request) (owner string, scoped bool) {
+	p, ok := shared.PrincipalFromContext(r.Context())
+	if !ok {
+		return "", false
+	}
+	return p.Owner, !p.Has(shared.ScopeAdmin)
+}
+
+// checkOwner writes an error and returns false unless the request may see and change the link.
+// Other owners' links are reported as not found, so their IDs can't be probed for
+func (h *Handler) checkOwner(w http.ResponseWriter, r *http.Request, id string) bool {
+	owner, scoped := requestOwner(r)
+	if !scoped {
+		return true
+	}
+
+	linkOwner, err := h.service.Owner(r.Context(), id)
+	if err == nil && linkOwner != owner {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeLinkError(w, err)
+		return false
+	}
+	return true
+}
+
+// writeLinkError maps the errors you can get when looking up a single link to a response
+func writeLinkError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, "short link not found")
+	case errors.Is(err, ErrDeleted):
+		writeError(w, http.StatusGone, "short link has been deleted")
+	case errors.Is(err, ErrExpired):
+		writeError(w, http.StatusGone, "short link has expired")
+	case errors.Is(err, ErrHitLimitReached):
+		writeError(w, http.StatusGone, "short link has reached its maximum number of hits")
+	case errors.Is(err, ErrInvalidURL):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case unavailable(err):
+		writeStatusError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeStatusError(w, http.StatusInternalServerError, err)
+	}
+}
+
 func (h *Handler) HandleRedirect(w http.ResponseWriter, r *http.Request) {
 	id := strings.TrimPrefix(r.URL.Path, "/")
 	if id == "" {
@@ -121,18 +555,37 @@ func (h *Handler) HandleRedirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	url, err := h.service.Resolve(id)
+	url, err := h.service.ResolveVisit(r.Context(), id, Visit{
+		At:        time.Now(),
+		Method:    r.Method,
+		IP:        h.clientIP(r),
+		Referrer:  r.Referer(),
+		UserAgent: r.UserAgent(),
+	})
 	if err != nil {
-		if errors.Is(err, ErrNotFound) {
-			writeError(w, http.StatusNotFound, "short link not found")
-			return
-		}
-		writeError(w, http.StatusInternalServerError, err.Error())
+		writeLinkError(w, err)
+		return
 	}
 
 	http.Redirect(w, r, url, http.StatusFound) // 302 redirect
 }
 
+// clientIP is the address the request came from, without the port. Behind the proxies the
+// rate limiter trusts, that's the client's address from X-Forwarded-For rather than the proxy's
+func (h *Handler) clientIP(r *http.Request) string {
+	if h.limiter != nil {
+		if addr := h.limiter.ClientIP(r); addr.IsValid() {
+			return addr.String()
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func (h *Handler) HandleStats(w http.ResponseWriter, r *http.Request) {
 	// id := strings.TrimPrefix(r.URL.Path, "/stats/")
 	id := strings.TrimPrefix(r.URL.Path, "/stats")
@@ -141,23 +594,518 @@ func (h *Handler) HandleStats(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "misssing id")
 		return
 	}
+	if !h.checkOwner(w, r, id) {
+		return
+	}
 
-	link, err := h.service.Stats(id)
+	link, err := h.service.Stats(r.Context(), id)
 	if err != nil {
-		if errors.Is(err, ErrNotFound) {
-			writeError(w, http.StatusNotFound, "short link not found")
-			return
-		}
-		writeError(w, http.StatusInternalServerError, err.Error())
+		writeLinkError(w, err)
 		return
 	}
 
-	resp := statsResponse{
+	resp := newStatsResponse(link)
+
+	visitors, err := h.service.UniqueVisitors(r.Context(), id, link.CreatedAt, time.Now())
+	switch {
+	case err == nil:
+		resp.UniqueVisitors = &visitors
+	case !errors.Is(err, ErrClicksDisabled):
+		writeLinkError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func newStatsResponse(link ShortLink) statsResponse {
+	return statsResponse{
 		URL:       link.URL,
 		Short:     link.ID,
 		Hits:      link.Hits,
+		BotHits:   link.BotHits,
 		CreatedAt: link.CreatedAt.Format(time.RFC3339),
+		ExpiresAt: formatOptionalTime(link.ExpiresAt),
+		MaxHits:   link.MaxHits,
+		Owner:     link.Owner,
+	}
+}
+
+// default window when a time series request doesn't say, per bucket size
+var defaultTimeseriesRange = map[Bucket]time.Duration{
+	BucketHour: 24 * time.Hour,
+	BucketDay:  30 * 24 * time.Hour,
+}
+
+// parseTimeWindow reads the from and to query parameters (RFC 3339 times).
+// to defaults to now, and from to window before to
+func parseTimeWindow(q url.Values, window time.Duration) (from, to time.Time, err error) {
+	to = time.Now()
+	if raw := q.Get("to"); raw != "" {
+		if to, err = time.Parse(time.RFC3339, raw); err != nil {
+			return from, to, errors.New("to must be an RFC 3339 time")
+		}
+	}
+
+	from = to.Add(-window)
+	if raw := q.Get("from"); raw != "" {
+		if from, err = time.Parse(time.RFC3339, raw); err != nil {
+			return from, to, errors.New("from must be an RFC 3339 time")
+		}
+	}
+
+	return from, to, nil
+}
+
+func (h *Handler) HandleTimeseries(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	q := r.URL.Query()
+
+	bucket, err := parseBucket(q.Get("bucket"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	from, to, err := parseTimeWindow(q, defaultTimeseriesRange[bucket])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !h.checkOwner(w, r, id) {
+		return
+	}
+
+	points, err := h.service.Timeseries(r.Context(), id, from, to, bucket)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidBucket), errors.Is(err, ErrInvalidRange):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, ErrClicksDisabled):
+			writeError(w, http.StatusNotImplemented, ErrClicksDisabled.Error())
+		default:
+			writeLinkError(w, err)
+		}
+		return
+	}
+
+	resp := timeseriesResponse{
+		Short:  id,
+		Bucket: bucket,
+		From:   from.UTC().Format(time.RFC3339),
+		To:     to.UTC().Format(time.RFC3339),
+		Points: make([]timeseriesPoint, len(points)),
+	}
+	for i, point := range points {
+		resp.Points[i] = timeseriesPoint{Start: point.Start.Format(time.RFC3339), Clicks: point.Clicks}
+		resp.Total += point.Clicks
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// default window for a breakdown request that doesn't say
+const defaultBreakdownRange = 30 * 24 * time.Hour
+
+func (h *Handler) HandleBreakdown(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	q := r.URL.Query()
+
+	from, to, err := parseTimeWindow(q, defaultBreakdownRange)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit := 0
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+	if !h.checkOwner(w, r, id) {
+		return
+	}
+
+	b, err := h.service.Breakdown(r.Context(), id, from, to, limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidRange):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, ErrClicksDisabled):
+			writeError(w, http.StatusNotImplemented, ErrClicksDisabled.Error())
+		default:
+			writeLinkError(w, err)
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, breakdownResponse{
+		Short:     id,
+		From:      from.UTC().Format(time.RFC3339),
+		To:        to.UTC().Format(time.RFC3339),
+		Total:     b.Total,
+		Humans:    b.Humans,
+		Bots:      b.Bots,
+		Referrers: newBreakdownEntries(b.Referrers),
+		Browsers:  newBreakdownEntries(b.Browsers),
+		OS:        newBreakdownEntries(b.OSes),
+		Devices:   newBreakdownEntries(b.Devices),
+	})
+}
+
+func newBreakdownEntries(entries []BreakdownEntry) []breakdownEntry {
+	out := make([]breakdownEntry, len(entries))
+	for i, entry := range entries {
+		out[i] = breakdownEntry{Name: entry.Name, Clicks: entry.Clicks}
+	}
+	return out
+}
+
+// HandleList serves GET /links?cursor=&limit=&sort=created_at|hits. With sort=hits the pages are
+// approximate: a link that gets enough hits while they're being read can be left out, see ListSort
+func (h *Handler) HandleList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	limit := 0
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	var page LinkPage
+	var err error
+	if owner, scoped := requestOwner(r); scoped {
+		page, err = h.service.ListByOwner(r.Context(), owner, q.Get("cursor"), limit, q.Get("sort"))
+	} else {
+		page, err = h.service.List(r.Context(), q.Get("cursor"), limit, q.Get("sort"))
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidCursor), errors.Is(err, ErrInvalidSort):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case unavailable(err):
+			writeStatusError(w, http.StatusServiceUnavailable, err)
+		default:
+			writeStatusError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	resp := listResponse{
+		Links:      make([]statsResponse, 0, len(page.Links)),
+		NextCursor: page.NextCursor,
+	}
+	for _, link := range page.Links {
+		resp.Links = append(resp.Links, newStatsResponse(link))
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) HandleUpdate(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing id")
+		return
+	}
+
+	var req updateRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !h.checkOwner(w, r, id) {
+		return
+	}
+
+	link, err := h.service.Update(r.Context(), id, req.URL)
+	if err != nil {
+		writeLinkError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newStatsResponse(link))
+}
+
+func (h *Handler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing id")
+		return
+	}
+	if !h.checkOwner(w, r, id) {
+		return
+	}
+
+	if err := h.service.Delete(r.Context(), id); err != nil {
+		writeLinkError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newWebhookResponse(hook Webhook) webhookResponse {
+	events := hook.Events
+	if events == nil {
+		events = []EventType{}
+	}
+
+	return webhookResponse{
+		ID:        hook.ID,
+		URL:       hook.URL,
+		Secret:    hook.Secret,
+		Events:    events,
+		CreatedAt: hook.CreatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+func writeWebhookError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidWebhook):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrWebhooksDisabled):
+		writeError(w, http.StatusNotImplemented, ErrWebhooksDisabled.Error())
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, "webhook not found")
+	case unavailable(err):
+		writeStatusError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeStatusError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (h *Handler) HandleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req webhookRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	hook, err := h.service.CreateWebhook(r.Context(), req.URL, req.Secret, req.Events)
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newWebhookResponse(hook))
+}
+
+func (h *Handler) HandleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := h.service.ListWebhooks(r.Context())
+	if err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	resp := webhookListResponse{Webhooks: make([]webhookResponse, len(hooks))}
+	for i, hook := range hooks {
+		resp.Webhooks[i] = newWebhookResponse(hook)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.DeleteWebhook(r.Context(), r.PathValue("id")); err != nil {
+		writeWebhookError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newAPIKeyResponse(key shared.APIKey, secret string) apiKeyResponse {
+	resp := apiKeyResponse{
+		ID:        key.ID,
+		Name:      key.Name,
+		Owner:     key.Owner,
+		Key:       secret,
+		Scopes:    make([]string, len(key.Scopes)),
+		CreatedAt: key.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	for i, scope := range key.Scopes {
+		resp.Scopes[i] = string(scope)
+	}
+	if key.LastUsedAt != nil {
+		resp.LastUsedAt = key.LastUsedAt.UTC().Format(time.RFC3339)
+	}
+	if key.RevokedAt != nil {
+		resp.RevokedAt = key.RevokedAt.UTC().Format(time.RFC3339)
+	}
+	return resp
+}
+
+func writeAPIKeyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, shared.ErrInvalidAPIKey):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, shared.ErrAPIKeyNotFound):
+		writeError(w, http.StatusNotFound, "api key not found")
+	case unavailable(err):
+		writeStatusError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeStatusError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// HandleCreateAPIKey mints a key. Its secret is in this response and nowhere else
+func (h *Handler) HandleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	scopes, err := shared.ParseScopes(req.Scopes)
+	if err != nil {
+		writeAPIKeyError(w, err)
+		return
+	}
+
+	secret, key, err := h.keys.Mint(r.Context(), req.Name, req.Owner, scopes)
+	if err != nil {
+		writeAPIKeyError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newAPIKeyResponse(key, secret))
+}
+
+func (h *Handler) HandleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.keys.List(r.Context())
+	if err != nil {
+		writeAPIKeyError(w, err)
+		return
+	}
+
+	resp := apiKeyListResponse{Keys: make([]apiKeyResponse, len(keys))}
+	for i, key := range keys {
+		resp.Keys[i] = newAPIKeyResponse(key, "")
 	}
 
 	writeJSON(w, http.StatusOK, resp)
 }
+
+func (h *Handler) HandleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if err := h.keys.Revoke(r.Context(), r.PathValue("id")); err != nil {
+		writeAPIKeyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleLive streams the clicks on one link as Server-Sent Events
+func (h *Handler) HandleLive(w http.ResponseWriter, r *http.Request) {
+	if !h.checkOwner(w, r, r.PathValue("id")) {
+		return
+	}
+
+	sub, err := h.service.Subscribe(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeLiveError(w, err)
+		return
+	}
+
+	h.streamLive(w, r, sub)
+}
+
+// HandleLiveAll streams the clicks on every link as Server-Sent Events
+func (h *Handler) HandleLiveAll(w http.ResponseWriter, r *http.Request) {
+	sub, err := h.service.SubscribeAll()
+	if err != nil {
+		writeLiveError(w, err)
+		return
+	}
+
+	h.streamLive(w, r, sub)
+}
+
+func writeLiveError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrLiveDisabled):
+		writeError(w, http.StatusNotImplemented, ErrLiveDisabled.Error())
+	case errors.Is(err, ErrLiveClosed):
+		writeError(w, http.StatusServiceUnavailable, ErrLiveClosed.Error())
+	default:
+		writeLinkError(w, err)
+	}
+}
+
+// streamLive writes sub's events until the client goes away or the broker shuts down.
+// A client that falls behind gets a "dropped" event with its running total of missed clicks
+func (h *Handler) streamLive(w http.ResponseWriter, r *http.Request, sub *LiveSubscription) {
+	defer sub.Close()
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // stop nginx from holding events back
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return // streaming isn't possible on this connection
+	}
+
+	heartbeat := time.NewTicker(h.liveHeartbeat)
+	defer heartbeat.Stop()
+
+	var dropped int64
+	for {
+		var err error
+
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			if n := sub.Dropped(); n > dropped {
+				dropped = n
+				err = writeEvent(w, "dropped", liveDropped{Dropped: n})
+			}
+			if err == nil {
+				err = writeEvent(w, "click", newLiveClick(ev))
+			}
+		case <-heartbeat.C:
+			_, err = io.WriteString(w, ": heartbeat\n\n")
+		}
+
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func newLiveClick(ev ClickEvent) liveClick {
+	return liveClick{
+		Short:    ev.LinkID,
+		At:       ev.At.UTC().Format(time.RFC3339Nano),
+		Bot:      ev.Bot,
+		Referrer: ev.ReferrerHost,
+		Device:   ev.AgentClass,
+		Browser:  ev.Browser,
+		OS:       ev.OS,
+	}
+}
+
+// writeEvent writes one Server-Sent Event with v as its JSON data
+func writeEvent(w io.Writer, event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
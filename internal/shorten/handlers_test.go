@@ -1,13 +1,17 @@
 package shorten
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
+
+	"shortener/internal/shared"
 )
 
 func newTestGenerator() IDGenerator {
@@ -26,8 +30,8 @@ func TestHandleShorten(t *testing.T) {
 		rr := httptest.NewRecorder()
 		handler.HandleShorten(rr, req)
 
-		if status := rr.Code; status != http.StatusOK {
-			t.Errorf("expected status %d, got %d", http.StatusOK, status)
+		if status := rr.Code; status != http.StatusCreated {
+			t.Errorf("expected status %d, got %d", http.StatusCreated, status)
 		}
 
 		var resp shortenResponse
@@ -43,6 +47,96 @@ func TestHandleShorten(t *testing.T) {
 		}
 	})
 
+	t.Run("with ttlSeconds", func(t *testing.T) {
+		shortener := newTestShortener(t, newTestGenerator())
+		handler := NewHandler(shortener)
+
+		body := `{"url":"https://example.com","ttlSeconds":3600}`
+		req := httptest.NewRequest(http.MethodPost, "/shorten", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+
+		handler.HandleShorten(rr, req)
+
+		if status := rr.Code; status != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d", http.StatusCreated, status)
+		}
+
+		var resp shortenResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		expiresAt, err := time.Parse(time.RFC3339, resp.ExpiresAt)
+		if err != nil {
+			t.Fatalf("expiresAt is not valid RFC3339: %v", err)
+		}
+		if until := time.Until(expiresAt); until < 59*time.Minute || until > time.Hour {
+			t.Errorf("expected expiry about an hour from now, got %s", until)
+		}
+	})
+
+	t.Run("invalid expiry", func(t *testing.T) {
+		tests := []struct {
+			name string
+			body string
+		}{
+			{"both expiresAt and ttlSeconds", `{"url":"https://example.com","expiresAt":"2999-01-01T00:00:00Z","ttlSeconds":60}`},
+			{"non-positive ttl", `{"url":"https://example.com","ttlSeconds":0}`},
+			{"huge ttl", `{"url":"https://example.com","ttlSeconds":9223372036854775807}`},
+			{"expiresAt in the past", `{"url":"https://example.com","expiresAt":"2000-01-01T00:00:00Z"}`},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				shortener := newTestShortener(t, newTestGenerator())
+				handler := NewHandler(shortener)
+
+				req := httptest.NewRequest(http.MethodPost, "/shorten", strings.NewReader(tt.body))
+				rr := httptest.NewRecorder()
+
+				handler.HandleShorten(rr, req)
+
+				if status := rr.Code; status != http.StatusBadRequest {
+					t.Errorf("expected status %d, got %d", http.StatusBadRequest, status)
+				}
+			})
+		}
+	})
+
+	t.Run("alias", func(t *testing.T) {
+		shortener := newTestShortener(t, newTestGenerator())
+		handler := NewHandler(shortener)
+
+		body := `{"url":"https://example.com","alias":"spring-sale"}`
+
+		want := []int{http.StatusCreated, http.StatusConflict}
+		for i, status := range want {
+			req := httptest.NewRequest(http.MethodPost, "/shorten", strings.NewReader(body))
+			rr := httptest.NewRecorder()
+
+			handler.HandleShorten(rr, req)
+
+			if rr.Code != status {
+				t.Fatalf("request %d: expected status %d, got %d", i+1, status, rr.Code)
+			}
+		}
+	})
+
+	t.Run("reserved alias", func(t *testing.T) {
+		shortener := newTestShortener(t, newTestGenerator())
+		handler := NewHandler(shortener)
+
+		body := `{"url":"https://example.com","alias":"shorten"}`
+		req := httptest.NewRequest(http.MethodPost, "/shorten", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+
+		handler.HandleShorten(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
 	t.Run("wrong HTTP method", func(t *testing.T) {
 		shortener := newTestShortener(t, newTestGenerator())
 		handler := NewHandler(shortener)
@@ -137,7 +231,7 @@ func TestHandleRedirect_OK(t *testing.T) {
 	url := "https://example.com"
 
 	// setup
-	link, err := shortener.Create(url)
+	link, err := shortener.Create(context.Background(), url)
 	if err != nil {
 		t.Fatalf("setup failed: %v", err)
 	}
@@ -177,6 +271,23 @@ func TestHandleRedirect_NotFound(t *testing.T) {
 	}
 }
 
+func TestHandleRedirect_Timeout(t *testing.T) {
+	shortener := NewShortener(slowStore{NewMemStore()}, newTestGenerator(), WithTimeouts(10*time.Millisecond, time.Second))
+	handler := NewHandler(shortener)
+
+	req := httptest.NewRequest(http.MethodGet, "/abc", nil)
+	rr := httptest.NewRecorder()
+
+	handler.HandleRedirect(rr, req)
+
+	res := rr.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, res.StatusCode)
+	}
+}
+
 func TestHandleRedirect_MissingID(t *testing.T) {
 	shortener := newTestShortener(t, newTestGenerator())
 	handler := NewHandler(shortener)
@@ -200,14 +311,14 @@ func TestHandleStats(t *testing.T) {
 
 		url := "https://example.com"
 
-		link, err := shortener.Create(url)
+		link, err := shortener.Create(context.Background(), url)
 		if err != nil {
 			t.Fatalf("setup failed: %v", err)
 		}
 
 		// increment hits
 		for i := 0; i < 3; i++ {
-			_, err := shortener.Resolve(link.ID)
+			_, err := shortener.Resolve(context.Background(), link.ID)
 			if err != nil {
 				t.Fatalf("setup resolve failed: %v", err)
 			}
@@ -281,4 +392,442 @@ func TestHandleStats(t *testing.T) {
 			t.Fatalf("expected status 404, got %d", res.StatusCode)
 		}
 	})	
-}
\ No newline at end of file
+}
+
+func TestHandleList(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		shortener := newTestShortener(t, newTestGenerator())
+		handler := NewHandler(shortener)
+
+		for i := 0; i < 3; i++ {
+			if _, err := shortener.Create(context.Background(), fmt.Sprintf("https://example.com/%d", i)); err != nil {
+				t.Fatalf("setup failed: %v", err)
+			}
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/links?limit=2", nil)
+		rr := httptest.NewRecorder()
+
+		handler.HandleList(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var body listResponse
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		if len(body.Links) != 2 {
+			t.Fatalf("expected 2 links, got %d", len(body.Links))
+		}
+		if body.NextCursor == "" {
+			t.Fatal("expected a next cursor")
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/links?limit=2&cursor="+body.NextCursor, nil)
+		rr = httptest.NewRecorder()
+
+		handler.HandleList(rr, req)
+
+		body = listResponse{}
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		if len(body.Links) != 1 {
+			t.Fatalf("expected 1 link on the last page, got %d", len(body.Links))
+		}
+		if body.NextCursor != "" {
+			t.Fatalf("expected no next cursor on the last page, got %q", body.NextCursor)
+		}
+	})
+
+	t.Run("Bad query", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			query string
+		}{
+			{"non-numeric limit", "?limit=abc"},
+			{"negative limit", "?limit=-1"},
+			{"unknown sort", "?sort=url"},
+			{"garbage cursor", "?cursor=garbage"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				shortener := newTestShortener(t, newTestGenerator())
+				handler := NewHandler(shortener)
+
+				req := httptest.NewRequest(http.MethodGet, "/links"+tt.query, nil)
+				rr := httptest.NewRecorder()
+
+				handler.HandleList(rr, req)
+
+				if rr.Code != http.StatusBadRequest {
+					t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+				}
+			})
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		shortener := NewShortener(slowStore{NewMemStore()}, newTestGenerator(), WithTimeouts(10*time.Millisecond, time.Second))
+		handler := NewHandler(shortener)
+
+		req := httptest.NewRequest(http.MethodGet, "/links", nil)
+		rr := httptest.NewRecorder()
+
+		handler.HandleList(rr, req)
+
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, rr.Code)
+		}
+		if strings.Contains(rr.Body.String(), "canceling statement") {
+			t.Fatalf("expected the driver error not to reach the client, got %s", rr.Body.String())
+		}
+	})
+}
+
+func TestHandleUpdate(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		shortener := newTestShortener(t, newTestGenerator())
+		handler := NewHandler(shortener)
+
+		link, err := shortener.Create(context.Background(), "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		body := `{"url":"https://example.org"}`
+		req := httptest.NewRequest(http.MethodPatch, "/links/"+link.ID, strings.NewReader(body))
+		req.SetPathValue("id", link.ID)
+		rr := httptest.NewRecorder()
+
+		handler.HandleUpdate(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var resp statsResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if resp.URL != "https://example.org" {
+			t.Fatalf("expected url %q, got %q", "https://example.org", resp.URL)
+		}
+	})
+
+	t.Run("Invalid URL", func(t *testing.T) {
+		shortener := newTestShortener(t, newTestGenerator())
+		handler := NewHandler(shortener)
+
+		link, err := shortener.Create(context.Background(), "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		body := `{"url":"not a url"}`
+		req := httptest.NewRequest(http.MethodPatch, "/links/"+link.ID, strings.NewReader(body))
+		req.SetPathValue("id", link.ID)
+		rr := httptest.NewRecorder()
+
+		handler.HandleUpdate(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		shortener := newTestShortener(t, newTestGenerator())
+		handler := NewHandler(shortener)
+
+		body := `{"url":"https://example.org"}`
+		req := httptest.NewRequest(http.MethodPatch, "/links/madethisup", strings.NewReader(body))
+		req.SetPathValue("id", "madethisup")
+		rr := httptest.NewRecorder()
+
+		handler.HandleUpdate(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+func TestHandleDelete(t *testing.T) {
+	shortener := newTestShortener(t, newTestGenerator())
+	handler := NewHandler(shortener)
+
+	link, err := shortener.Create(context.Background(), "https://example.com")
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/links/"+link.ID, nil)
+	req.SetPathValue("id", link.ID)
+	rr := httptest.NewRecorder()
+
+	handler.HandleDelete(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, rr.Code)
+	}
+
+	// the redirect should now say the link is gone rather than that it never existed
+	req = httptest.NewRequest(http.MethodGet, "/"+link.ID, nil)
+	rr = httptest.NewRecorder()
+
+	handler.HandleRedirect(rr, req)
+
+	if rr.Code != http.StatusGone {
+		t.Fatalf("expected status %d, got %d", http.StatusGone, rr.Code)
+	}
+}
+
+func TestHandleRedirect_Expired(t *testing.T) {
+	shortener := newTestShortener(t, newTestGenerator())
+	handler := NewHandler(shortener)
+
+	link, err := shortener.CreateWithOptions(context.Background(), "https://example.com", CreateOptions{
+		ExpiresAt: timePtr(time.Now().Add(10 * time.Millisecond)),
+	})
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "/"+link.ID, nil)
+	rr := httptest.NewRecorder()
+
+	handler.HandleRedirect(rr, req)
+
+	if rr.Code != http.StatusGone {
+		t.Fatalf("expected status %d, got %d", http.StatusGone, rr.Code)
+	}
+}
+
+func TestHandleRedirect_MaxHits(t *testing.T) {
+	shortener := newTestShortener(t, newTestGenerator())
+	handler := NewHandler(shortener)
+
+	body := `{"url":"https://example.com","maxHits":1}`
+	req := httptest.NewRequest(http.MethodPost, "/shorten", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	handler.HandleShorten(rr, req)
+
+	var resp shortenResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.MaxHits != 1 {
+		t.Fatalf("expected maxHits 1 in response, got %d", resp.MaxHits)
+	}
+
+	want := []int{http.StatusFound, http.StatusGone}
+	for i, status := range want {
+		req := httptest.NewRequest(http.MethodGet, "/"+resp.Short, nil)
+		rr := httptest.NewRecorder()
+
+		handler.HandleRedirect(rr, req)
+
+		if rr.Code != status {
+			t.Fatalf("redirect %d: expected status %d, got %d", i+1, status, rr.Code)
+		}
+	}
+}
+
+func TestHandleShortenBatch(t *testing.T) {
+	t.Run("Per-item results", func(t *testing.T) {
+		shortener := newTestShortener(t, newTestGenerator())
+		handler := NewHandler(shortener)
+
+		body := `{"items":[
+			{"url":"https://example.com/a"},
+			{"url":"ftp://example.com"},
+			{"url":"https://example.com/b","alias":"promo"},
+			{"url":"https://example.com/c","ttlSeconds":-5}
+		]}`
+		req := httptest.NewRequest(http.MethodPost, "/shorten/batch", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+
+		handler.HandleShortenBatch(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var resp batchResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		want := []int{http.StatusCreated, http.StatusBadRequest, http.StatusCreated, http.StatusBadRequest}
+		if len(resp.Results) != len(want) {
+			t.Fatalf("expected %d results, got %d", len(want), len(resp.Results))
+		}
+
+		for i, status := range want {
+			if resp.Results[i].Status != status {
+				t.Errorf("item %d: expected status %d, got %d", i, status, resp.Results[i].Status)
+			}
+		}
+
+		if resp.Results[2].Short != "promo" {
+			t.Errorf("expected item 2 to have short id %q, got %+v", "promo", resp.Results[2])
+		}
+		if resp.Results[1].Error == "" {
+			t.Error("expected item 1 to have an error message")
+		}
+	})
+
+	t.Run("Too many items", func(t *testing.T) {
+		shortener := NewShortener(NewMemStore(), newTestGenerator(), WithMaxBatchSize(2))
+		handler := NewHandler(shortener)
+
+		body := `{"items":[{"url":"https://a.com"},{"url":"https://b.com"},{"url":"https://c.com"}]}`
+		req := httptest.NewRequest(http.MethodPost, "/shorten/batch", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+
+		handler.HandleShortenBatch(rr, req)
+
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("expected status %d, got %d", http.StatusRequestEntityTooLarge, rr.Code)
+		}
+	})
+
+	t.Run("Empty batch", func(t *testing.T) {
+		shortener := newTestShortener(t, newTestGenerator())
+		handler := NewHandler(shortener)
+
+		req := httptest.NewRequest(http.MethodPost, "/shorten/batch", strings.NewReader(`{"items":[]}`))
+		rr := httptest.NewRecorder()
+
+		handler.HandleShortenBatch(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+}
+
+func TestHandleShorten_Dedupe(t *testing.T) {
+	shortener := NewShortener(NewMemStore(), newTestGenerator(), WithDedupe())
+	handler := NewHandler(shortener)
+
+	var first shortenResponse
+	bodies := []string{`{"url":"https://example.com"}`, `{"url":"HTTPS://Example.com:443"}`}
+	want := []int{http.StatusCreated, http.StatusOK}
+
+	for i, body := range bodies {
+		req := httptest.NewRequest(http.MethodPost, "/shorten", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+
+		handler.HandleShorten(rr, req)
+
+		if rr.Code != want[i] {
+			t.Fatalf("request %d: expected status %d, got %d", i+1, want[i], rr.Code)
+		}
+
+		var resp shortenResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		if i == 0 {
+			first = resp
+		} else if resp.Short != first.Short {
+			t.Fatalf("expected the existing link %q to be reused, got %q", first.Short, resp.Short)
+		}
+	}
+}
+
+func TestHandler_ClientIP(t *testing.T) {
+	shortener := newTestShortener(t, newTestGenerator())
+	proxies, _ := shared.ParseTrustedProxies("10.0.0.0/8")
+
+	tests := []struct {
+		name    string
+		handler *Handler
+		remote  string
+		want    string
+	}{
+		{"No limiter", NewHandler(shortener), "10.0.0.1:1234", "10.0.0.1"},
+		{"Untrusted remote", NewHandler(shortener, WithRateLimits(shared.NewRateLimiter(proxies), RateLimits{})), "203.0.113.9:1234", "203.0.113.9"},
+		{"Trusted proxy", NewHandler(shortener, WithRateLimits(shared.NewRateLimiter(proxies), RateLimits{})), "10.0.0.1:1234", "198.51.100.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/abc", nil)
+			req.RemoteAddr = tt.remote
+			req.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+			if got := tt.handler.clientIP(req); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// brokenStore is a MemStore whose writes and redirects fail with an error that mustn't reach clients
+type brokenStore struct {
+	*MemStore
+}
+
+var errBrokenStore = errors.New(`pq: password authentication failed for user "shortener"`)
+
+func (store brokenStore) Save(context.Context, ShortLink, ...EventType) error {
+	return errBrokenStore
+}
+
+// SaveMany fails each link, rather than the whole call
+func (store brokenStore) SaveMany(_ context.Context, links []ShortLink, _ ...EventType) ([]error, error) {
+	errs := make([]error, len(links))
+	for i := range errs {
+		errs[i] = errBrokenStore
+	}
+	return errs, nil
+}
+
+func (store brokenStore) Hit(context.Context, string, time.Time) (ShortLink, error) {
+	return ShortLink{}, errBrokenStore
+}
+
+func TestHandler_ServerErrors(t *testing.T) {
+	handler := NewHandler(NewShortener(brokenStore{NewMemStore()}, newTestGenerator()))
+
+	tests := []struct {
+		name  string
+		serve func(w http.ResponseWriter)
+	}{
+		{"Shorten", func(w http.ResponseWriter) {
+			handler.HandleShorten(w, httptest.NewRequest(http.MethodPost, "/shorten", strings.NewReader(`{"url":"https://example.com"}`)))
+		}},
+		{"Batch item", func(w http.ResponseWriter) {
+			handler.HandleShortenBatch(w, httptest.NewRequest(http.MethodPost, "/shorten/batch", strings.NewReader(`{"items":[{"url":"https://example.com"}]}`)))
+		}},
+		{"Redirect", func(w http.ResponseWriter) {
+			handler.HandleRedirect(w, httptest.NewRequest(http.MethodGet, "/abc", nil))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tt.serve(rr)
+
+			if !strings.Contains(rr.Body.String(), "internal server error") {
+				t.Fatalf("expected a generic error, got %d %s", rr.Code, rr.Body.String())
+			}
+			if strings.Contains(rr.Body.String(), "password") {
+				t.Fatalf("expected the store error not to reach the client, got %s", rr.Body.String())
+			}
+		})
+	}
+}
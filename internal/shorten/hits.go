@@ -0,0 +1,235 @@
+package shorten
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HitAggregator counts redirects in memory and writes them to the store in batches, instead of
+// one UPDATE per click. Popular links would otherwise have every redirect queueing on the same row lock.
+//
+// Counts are flushed every interval, or sooner once maxPending links have hits waiting.
+// A failed flush keeps its counts for the next one, so nothing is lost unless the process dies
+// or the store stays down long enough for hitPendingFactor times maxPending links to pile up,
+// after which hits for links that aren't pending yet are dropped (and counted in HitStats).
+// Call Drain on shutdown to write out whatever is left.
+type HitAggregator struct {
+	store      Store
+	interval   time.Duration
+	maxPending int
+
+	flushing sync.Mutex // one flush at a time, so there's only ever one batch in flight
+
+	mu       sync.Mutex
+	pending  map[string]HitCount
+	inFlight map[string]HitCount // the batch being written, still counted by Pending
+
+	full chan struct{} // nudges Run to flush early
+
+	flushes  atomic.Int64 // flushes that wrote something
+	failures atomic.Int64
+	flushed  atomic.Int64 // hits and bot hits written
+	dropped  atomic.Int64 // hits and bot hits lost to the pending limit
+}
+
+// HitStats are running totals for the aggregator since it was created
+type HitStats struct {
+	PendingLinks int // links with hits waiting for the next flush
+	Flushes      int64
+	Failures     int64
+	FlushedHits  int64
+	DroppedHits  int64
+}
+
+const (
+	drainInitialBackoff = 100 * time.Millisecond
+	drainMaxBackoff     = 2 * time.Second
+
+	// how many times maxPending links may have hits waiting, while flushes keep failing,
+	// before hits for any more links are dropped
+	hitPendingFactor = 100
+)
+
+func NewHitAggregator(store Store, interval time.Duration, maxPending int) *HitAggregator {
+	if maxPending <= 0 {
+		maxPending = 1
+	}
+
+	return &HitAggregator{
+		store:      store,
+		interval:   interval,
+		maxPending: maxPending,
+		pending:    make(map[string]HitCount),
+		inFlight:   make(map[string]HitCount),
+		full:       make(chan struct{}, 1),
+	}
+}
+
+// Add counts one hit for id
+func (a *HitAggregator) Add(id string) {
+	a.add(id, HitCount{Hits: 1})
+}
+
+// AddBot counts one bot hit for id
+func (a *HitAggregator) AddBot(id string) {
+	a.add(id, HitCount{BotHits: 1})
+}
+
+func (a *HitAggregator) add(id string, n HitCount) {
+	a.mu.Lock()
+	a.count(id, n)
+	pending := len(a.pending)
+	a.mu.Unlock()
+
+	if pending >= a.maxPending {
+		select {
+		case a.full <- struct{}{}:
+		default: // a flush has already been asked for
+		}
+	}
+}
+
+// count adds n to id's pending hits, unless id would be one link too many. Callers must hold mu
+func (a *HitAggregator) count(id string, n HitCount) {
+	count, ok := a.pending[id]
+	if !ok && len(a.pending) >= a.maxPending*hitPendingFactor {
+		a.dropped.Add(n.Hits + n.BotHits)
+		return
+	}
+
+	count.Hits += n.Hits
+	count.BotHits += n.BotHits
+	a.pending[id] = count
+}
+
+// Pending returns the hits counted for id that haven't been written to the store yet, including
+// the ones a flush is writing right now. Just as that write commits, they can be counted both
+// here and in the store for a moment; better that than not at all
+func (a *HitAggregator) Pending(id string) HitCount {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	count := a.pending[id]
+	count.Hits += a.inFlight[id].Hits
+	count.BotHits += a.inFlight[id].BotHits
+	return count
+}
+
+func (a *HitAggregator) Stats() HitStats {
+	a.mu.Lock()
+	pending := len(a.pending)
+	a.mu.Unlock()
+
+	return HitStats{
+		PendingLinks: pending,
+		Flushes:      a.flushes.Load(),
+		Failures:     a.failures.Load(),
+		FlushedHits:  a.flushed.Load(),
+		DroppedHits:  a.dropped.Load(),
+	}
+}
+
+// Run flushes every interval (or when enough hits pile up) until ctx is cancelled.
+// It's meant to be run in its own goroutine
+func (a *HitAggregator) Run(ctx context.Context) {
+	runFlusher(ctx, "hits", a.interval, a.full, a.Flush)
+}
+
+// Flush writes every pending count to the store in one AddHits call.
+// If that fails the counts are put back, to be retried by the next flush
+func (a *HitAggregator) Flush(ctx context.Context) error {
+	a.flushing.Lock()
+	defer a.flushing.Unlock()
+
+	a.mu.Lock()
+	batch := a.pending
+	a.pending = make(map[string]HitCount)
+	a.inFlight = batch
+	a.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := a.store.AddHits(ctx, batch)
+
+	a.mu.Lock()
+	a.inFlight = make(map[string]HitCount)
+	if err != nil {
+		for id, n := range batch {
+			a.count(id, n)
+		}
+	}
+	a.mu.Unlock()
+
+	if err != nil {
+		a.failures.Add(1)
+		return err
+	}
+
+	var n int64
+	for _, count := range batch {
+		n += count.Hits + count.BotHits
+	}
+	a.flushes.Add(1)
+	a.flushed.Add(n)
+	return nil
+}
+
+// Drain flushes until nothing is pending, retrying failures with backoff until ctx ends.
+// Call it once Run has stopped and no more redirects are being served
+func (a *HitAggregator) Drain(ctx context.Context) error {
+	err := drainFlusher(ctx, "hits", a.Flush)
+	if err != nil {
+		a.mu.Lock()
+		lost := len(a.pending)
+		a.mu.Unlock()
+		return fmt.Errorf("hits for %d links were not saved: %w", lost, err)
+	}
+	return nil
+}
+
+// runFlusher calls flush every interval, and as soon as something arrives on early, until ctx
+// is cancelled. Failures are logged; it's up to flush to keep what it couldn't write for next time
+func runFlusher(ctx context.Context, name string, interval time.Duration, early <-chan struct{}, flush func(context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-early:
+		}
+
+		if err := flush(ctx); err != nil {
+			log.Printf("%s: flush failed, will retry: %v", name, err)
+		}
+	}
+}
+
+// drainFlusher calls flush until it succeeds, backing off between attempts, or until ctx ends
+func drainFlusher(ctx context.Context, name string, flush func(context.Context) error) error {
+	backoff := drainInitialBackoff
+
+	for {
+		err := flush(ctx)
+		if err == nil {
+			return nil
+		}
+		log.Printf("%s: drain failed, retrying in %s: %v", name, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff = min(2*backoff, drainMaxBackoff)
+	}
+}
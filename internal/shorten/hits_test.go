@@ -0,0 +1,288 @@
+package shorten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyStore is a MemStore whose AddHits fails while failing is set
+type flakyStore struct {
+	*MemStore
+	failing atomic.Bool
+	calls   atomic.Int64
+}
+
+func (store *flakyStore) AddHits(ctx context.Context, counts map[string]HitCount) error {
+	store.calls.Add(1)
+	if store.failing.Load() {
+		return errors.New("database unavailable")
+	}
+	return store.MemStore.AddHits(ctx, counts)
+}
+
+// blockingHitStore is a MemStore whose AddHits waits for release, after saying it has started
+type blockingHitStore struct {
+	*MemStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (store *blockingHitStore) AddHits(ctx context.Context, counts map[string]HitCount) error {
+	store.started <- struct{}{}
+	<-store.release
+	return store.MemStore.AddHits(ctx, counts)
+}
+
+func newTestHitStore(t *testing.T) *flakyStore {
+	t.Helper()
+
+	store := &flakyStore{MemStore: NewMemStore()}
+	for _, id := range []string{"a", "b"} {
+		if err := store.Save(context.Background(), ShortLink{ID: id, URL: "https://example.com", CreatedAt: time.Now()}); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+	}
+	return store
+}
+
+func storedHits(t *testing.T, store Store, id string) int64 {
+	t.Helper()
+
+	link, err := store.Get(context.Background(), id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return link.Hits
+}
+
+func TestHitAggregator(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Flush writes the counts in one batch", func(t *testing.T) {
+		store := newTestHitStore(t)
+		hits := NewHitAggregator(store, time.Hour, 100)
+
+		for range 3 {
+			hits.Add("a")
+		}
+		hits.Add("b")
+		hits.Add("gone") // links can disappear before their hits are flushed
+
+		if got := storedHits(t, store, "a"); got != 0 {
+			t.Fatalf("expected no hits before the flush, got %d", got)
+		}
+		if got := hits.Pending("a").Hits; got != 3 {
+			t.Fatalf("expected 3 pending hits, got %d", got)
+		}
+
+		if err := hits.Flush(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if a, b := storedHits(t, store, "a"), storedHits(t, store, "b"); a != 3 || b != 1 {
+			t.Fatalf("expected a=3 b=1, got a=%d b=%d", a, b)
+		}
+		if n := store.calls.Load(); n != 1 {
+			t.Fatalf("expected 1 AddHits call, got %d", n)
+		}
+		if got := hits.Pending("a").Hits; got != 0 {
+			t.Fatalf("expected nothing pending after the flush, got %d", got)
+		}
+	})
+
+	t.Run("Failed flush keeps the counts", func(t *testing.T) {
+		store := newTestHitStore(t)
+		hits := NewHitAggregator(store, time.Hour, 100)
+
+		hits.Add("a")
+		store.failing.Store(true)
+		if err := hits.Flush(ctx); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+
+		hits.Add("a")
+		store.failing.Store(false)
+		if err := hits.Flush(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if got := storedHits(t, store, "a"); got != 2 {
+			t.Fatalf("expected hits=2, got %d", got)
+		}
+	})
+
+	t.Run("Drain retries until the store recovers", func(t *testing.T) {
+		store := newTestHitStore(t)
+		hits := NewHitAggregator(store, time.Hour, 100)
+
+		hits.Add("a")
+		store.failing.Store(true)
+		time.AfterFunc(150*time.Millisecond, func() { store.failing.Store(false) })
+
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		if err := hits.Drain(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := storedHits(t, store, "a"); got != 1 {
+			t.Fatalf("expected hits=1, got %d", got)
+		}
+	})
+
+	t.Run("Drain gives up when ctx ends", func(t *testing.T) {
+		store := newTestHitStore(t)
+		hits := NewHitAggregator(store, time.Hour, 100)
+
+		hits.Add("a")
+		store.failing.Store(true)
+
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		if err := hits.Drain(ctx); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+
+	t.Run("Hits being flushed are still pending", func(t *testing.T) {
+		store := &blockingHitStore{MemStore: newTestHitStore(t).MemStore, started: make(chan struct{}), release: make(chan struct{})}
+		hits := NewHitAggregator(store, time.Hour, 100)
+
+		hits.Add("a")
+		done := make(chan error)
+		go func() { done <- hits.Flush(ctx) }()
+
+		<-store.started
+		if got := hits.Pending("a").Hits; got != 1 {
+			t.Fatalf("expected the hit in flight to be pending, got %d", got)
+		}
+		close(store.release)
+
+		if err := <-done; err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := hits.Pending("a").Hits + storedHits(t, store, "a"); got != 1 {
+			t.Fatalf("expected the hit to be counted once after the flush, got %d", got)
+		}
+	})
+
+	t.Run("Pending links are capped while flushes fail", func(t *testing.T) {
+		store := newTestHitStore(t)
+		hits := NewHitAggregator(store, time.Hour, 1)
+		store.failing.Store(true)
+
+		limit := hitPendingFactor
+		for i := range limit + 1 {
+			hits.Add(fmt.Sprintf("link%d", i))
+		}
+		if err := hits.Flush(ctx); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+		hits.Add("link0") // already pending, so still counted
+
+		stats := hits.Stats()
+		if stats.PendingLinks != limit || stats.DroppedHits != 1 {
+			t.Fatalf("expected %d pending links and 1 dropped hit, got %+v", limit, stats)
+		}
+		if got := hits.Pending("link0").Hits; got != 2 {
+			t.Fatalf("expected 2 hits for link0, got %d", got)
+		}
+	})
+
+	t.Run("Run flushes early when enough links are pending", func(t *testing.T) {
+		store := newTestHitStore(t)
+		hits := NewHitAggregator(store, time.Hour, 2)
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go hits.Run(ctx)
+
+		hits.Add("a")
+		hits.Add("b")
+
+		deadline := time.Now().Add(2 * time.Second)
+		for storedHits(t, store, "b") != 1 {
+			if time.Now().After(deadline) {
+				t.Fatal("expected a flush once the size threshold was reached")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+}
+
+func TestResolve_HitAggregator(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewMemStore()
+	hits := NewHitAggregator(store, time.Hour, 100)
+	shortener := NewShortener(store, NewBase62Generator(), WithHitAggregator(hits))
+
+	t.Run("Hits are counted asynchronously", func(t *testing.T) {
+		link, err := shortener.Create(ctx, "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		for range 2 {
+			if _, err := shortener.Resolve(ctx, link.ID); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		if got := storedHits(t, store, link.ID); got != 0 {
+			t.Fatalf("expected the store not to be updated yet, got hits=%d", got)
+		}
+
+		// Stats already includes what's pending
+		stats, err := shortener.Stats(ctx, link.ID)
+		if err != nil || stats.Hits != 2 {
+			t.Fatalf("expected hits=2, got %d (err=%v)", stats.Hits, err)
+		}
+
+		if err := hits.Flush(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := storedHits(t, store, link.ID); got != 2 {
+			t.Fatalf("expected hits=2 after the flush, got %d", got)
+		}
+	})
+
+	t.Run("Capped links are counted straight away", func(t *testing.T) {
+		link, err := shortener.CreateWithOptions(ctx, "https://example.com", CreateOptions{MaxHits: 1})
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		if _, err := shortener.Resolve(ctx, link.ID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := shortener.Resolve(ctx, link.ID); !errors.Is(err, ErrHitLimitReached) {
+			t.Fatalf("expected ErrHitLimitReached, got %v", err)
+		}
+		if got := hits.Pending(link.ID).Hits; got != 0 {
+			t.Fatalf("expected no pending hits for a capped link, got %d", got)
+		}
+	})
+
+	t.Run("Inactive links are not counted", func(t *testing.T) {
+		link, err := shortener.Create(ctx, "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		if err := shortener.Delete(ctx, link.ID); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		if _, err := shortener.Resolve(ctx, link.ID); !errors.Is(err, ErrDeleted) {
+			t.Fatalf("expected ErrDeleted, got %v", err)
+		}
+		if got := hits.Pending(link.ID).Hits; got != 0 {
+			t.Fatalf("expected no pending hits, got %d", got)
+		}
+	})
+}
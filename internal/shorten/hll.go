@@ -0,0 +1,107 @@
+package shorten
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// HyperLogLog sketch for counting distinct visitors in a fixed amount of space.
+// With 2^12 one-byte registers a sketch is 4KB and the estimate is typically within ~1.6%.
+// Sketches merge by taking the larger of each register, so daily sketches can be combined
+// into one for any range of days without counting anyone twice.
+const (
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+)
+
+type hyperLogLog struct {
+	registers []byte
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]byte, hllRegisters)}
+}
+
+// hllFromBytes loads a sketch saved with bytes
+func hllFromBytes(b []byte) (*hyperLogLog, error) {
+	if len(b) != hllRegisters {
+		return nil, fmt.Errorf("hyperloglog sketch must be %d bytes, got %d", hllRegisters, len(b))
+	}
+	return &hyperLogLog{registers: append([]byte(nil), b...)}, nil
+}
+
+func (h *hyperLogLog) bytes() []byte {
+	return h.registers
+}
+
+// add records an item by its 64-bit hash, which must be uniformly distributed
+func (h *hyperLogLog) add(hash uint64) {
+	// the first bits pick the register, the rest are where we look for a run of leading zeros
+	idx := hash >> (64 - hllPrecision)
+	rest := hash<<hllPrecision | 1<<(hllPrecision-1) // the guard bit caps the run length
+	rank := byte(bits.LeadingZeros64(rest) + 1)
+
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// estimate returns the approximate number of distinct items added
+func (h *hyperLogLog) estimate() int64 {
+	m := float64(hllRegisters)
+
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	e := alpha * m * m / sum
+
+	// small cardinalities: linear counting over the empty registers is more accurate
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+
+	return int64(e + 0.5)
+}
+
+// linkDay identifies one link's visitor sketch for one UTC day
+type linkDay struct {
+	id  string
+	day time.Time // midnight UTC
+}
+
+// sketchVisitors builds the daily visitor sketches for a batch of clicks, leaving out bots
+func sketchVisitors(clicks []Click) map[linkDay]*hyperLogLog {
+	sketches := make(map[linkDay]*hyperLogLog)
+
+	for _, click := range clicks {
+		if click.AgentClass == AgentBot {
+			continue
+		}
+		key := linkDay{id: click.LinkID, day: BucketDay.start(click.At)}
+		sketch, ok := sketches[key]
+		if !ok {
+			sketch = newHyperLogLog()
+			sketches[key] = sketch
+		}
+		sketch.add(click.Visitor)
+	}
+
+	return sketches
+}
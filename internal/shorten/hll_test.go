@@ -0,0 +1,81 @@
+package shorten
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// testHash spreads i over 64 bits, like the visitor fingerprints do
+func testHash(i int) uint64 {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(i))
+	sum := sha256.Sum256(buf[:])
+	return binary.BigEndian.Uint64(sum[:])
+}
+
+func TestHyperLogLog(t *testing.T) {
+	t.Run("Estimates are close", func(t *testing.T) {
+		for _, n := range []int{0, 1, 10, 1000, 50000} {
+			h := newHyperLogLog()
+			for i := range n {
+				h.add(testHash(i))
+			}
+
+			got := h.estimate()
+			if diff := math.Abs(float64(got - int64(n))); diff > math.Max(1, 0.05*float64(n)) {
+				t.Fatalf("n=%d: estimate %d is off by more than 5%%", n, got)
+			}
+		}
+	})
+
+	t.Run("Repeats are not counted", func(t *testing.T) {
+		h := newHyperLogLog()
+		for range 100 {
+			for i := range 10 {
+				h.add(testHash(i))
+			}
+		}
+
+		if got := h.estimate(); got != 10 {
+			t.Fatalf("expected 10, got %d", got)
+		}
+	})
+
+	t.Run("Merge is a union", func(t *testing.T) {
+		a, b, both := newHyperLogLog(), newHyperLogLog(), newHyperLogLog()
+		for i := range 3000 {
+			a.add(testHash(i))
+			both.add(testHash(i))
+		}
+		for i := 2000; i < 5000; i++ {
+			b.add(testHash(i))
+			both.add(testHash(i))
+		}
+
+		a.merge(b)
+		if a.estimate() != both.estimate() {
+			t.Fatalf("expected the merged estimate %d to equal the union's %d", a.estimate(), both.estimate())
+		}
+	})
+
+	t.Run("Bytes round trip", func(t *testing.T) {
+		h := newHyperLogLog()
+		for i := range 500 {
+			h.add(testHash(i))
+		}
+
+		loaded, err := hllFromBytes(h.bytes())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if loaded.estimate() != h.estimate() {
+			t.Fatalf("expected %d, got %d", h.estimate(), loaded.estimate())
+		}
+
+		if _, err := hllFromBytes([]byte{1, 2, 3}); err == nil {
+			t.Fatal("expected error for a short sketch, got nil")
+		}
+	})
+}
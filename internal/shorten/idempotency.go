@@ -0,0 +1,162 @@
+package shorten
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"shortener/internal/shared"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+)
+
+// IdempotencyRecord remembers what a request with a given Idempotency-Key returned,
+// so a client retrying after a timeout gets the same response instead of a second link
+type IdempotencyRecord struct {
+	Key         string
+	Fingerprint string // hash of the method, path and body the key was first used with
+	Status      int    // 0 while the first request is still being handled
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+func (rec IdempotencyRecord) completed() bool {
+	return rec.Status != 0
+}
+
+// IdempotencyStore keeps IdempotencyRecords for the idempotency window
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey saves rec unless an unexpired record with the same key exists.
+	// It returns the record that's now stored, and whether it's the one that was passed in
+	ReserveIdempotencyKey(ctx context.Context, rec IdempotencyRecord) (IdempotencyRecord, bool, error)
+	// CompleteIdempotencyKey stores the response for a reserved key
+	CompleteIdempotencyKey(ctx context.Context, key string, status int, body []byte) error
+	// ReleaseIdempotencyKey drops a reservation, so the key can be used again straight away
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+	// DeleteExpiredIdempotencyKeys removes records that expired before the given time
+	DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int64, error)
+}
+
+// idempotencyFingerprint identifies the request a key was used for. Reusing a key for a
+// different request is a client bug, and gets a 422 rather than somebody else's response
+func idempotencyFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordingResponseWriter passes everything through to the client while keeping a copy,
+// so the response can be stored for replays
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingResponseWriter) WriteHeader(code int) {
+	rw.status = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// idempotent wraps a JSON create handler with Idempotency-Key support. Requests without the
+// header (or when the handler has no IdempotencyStore) go straight through.
+//
+// The first request with a key reserves it, runs, and stores its response. Retries with the same
+// key and body get that response replayed (with an Idempotent-Replayed header); the same key with
+// a different body gets 422, and a retry while the first request is still running gets 409.
+// 5xx responses aren't stored, so a retry after a server error really is retried.
+func (h *Handler) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || h.idempotency == nil {
+			next(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLen {
+			writeError(w, http.StatusBadRequest, "Idempotency-Key is too long")
+			return
+		}
+		// every API key has its own keys, so no one gets another key's response replayed
+		if p, ok := shared.PrincipalFromContext(r.Context()); ok {
+			key = p.KeyID + ":" + key
+		}
+
+		// the body is needed for the fingerprint, so read it here and hand the handler a copy
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := idempotencyFingerprint(r, body)
+
+		now := time.Now()
+		rec, reserved, err := h.idempotency.ReserveIdempotencyKey(r.Context(), IdempotencyRecord{
+			Key:         key,
+			Fingerprint: fingerprint,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(h.idempotencyTTL),
+		})
+		if err != nil {
+			writeStatusError(w, createErrorStatus(err), err)
+			return
+		}
+
+		if !reserved {
+			switch {
+			case rec.Fingerprint != fingerprint:
+				writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+			case !rec.completed():
+				writeError(w, http.StatusConflict, "a request with this Idempotency-Key is still in progress")
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(rec.Status)
+				w.Write(rec.Body)
+			}
+			return
+		}
+
+		rw := &recordingResponseWriter{ResponseWriter: w}
+
+		// the outcome must be recorded even if the client hung up meanwhile, or the handler
+		// panicked, otherwise the key would stay "in progress" until it expires
+		panicked := true
+		defer func() {
+			ctx := context.WithoutCancel(r.Context())
+			var err error
+			if panicked || rw.status >= http.StatusInternalServerError {
+				err = h.idempotency.ReleaseIdempotencyKey(ctx, key)
+			} else {
+				err = h.idempotency.CompleteIdempotencyKey(ctx, key, rw.status, rw.body.Bytes())
+			}
+			if err != nil {
+				// the response has already gone out; the worst case is a retry that isn't deduplicated
+				log.Printf("idempotency: store response for key %q: %v", key, err)
+			}
+		}()
+
+		next(rw, r)
+		panicked = false
+	}
+}
@@ -0,0 +1,160 @@
+package shorten
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newIdempotentMux(t *testing.T, store *MemStore, ttl time.Duration) *http.ServeMux {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	RegisterRoutes(mux, NewShortener(store, NewBase62Generator()), WithIdempotency(store, ttl))
+	return mux
+}
+
+func postWithKey(mux *http.ServeMux, path string, key string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	t.Run("Retry replays the first response", func(t *testing.T) {
+		store := NewMemStore()
+		mux := newIdempotentMux(t, store, time.Hour)
+
+		body := `{"url":"https://example.com"}`
+		first := postWithKey(mux, "/shorten", "key-1", body)
+		retry := postWithKey(mux, "/shorten", "key-1", body)
+
+		if first.Code != http.StatusCreated || retry.Code != http.StatusCreated {
+			t.Fatalf("expected 201 twice, got %d and %d", first.Code, retry.Code)
+		}
+		if first.Body.String() != retry.Body.String() {
+			t.Fatalf("expected identical bodies, got %q and %q", first.Body.String(), retry.Body.String())
+		}
+		if retry.Header().Get("Idempotent-Replayed") != "true" {
+			t.Fatal("expected the retry to be marked as replayed")
+		}
+
+		// and only one link was actually created
+		links, _ := store.List(context.Background(), ListOptions{Sort: SortCreatedAt, Limit: 10})
+		if len(links) != 1 {
+			t.Fatalf("expected 1 link, got %d", len(links))
+		}
+	})
+
+	t.Run("Same key, different body", func(t *testing.T) {
+		mux := newIdempotentMux(t, NewMemStore(), time.Hour)
+
+		postWithKey(mux, "/shorten", "key-1", `{"url":"https://example.com"}`)
+		rr := postWithKey(mux, "/shorten", "key-1", `{"url":"https://example.org"}`)
+
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected status %d, got %d", http.StatusUnprocessableEntity, rr.Code)
+		}
+	})
+
+	t.Run("Key still in progress", func(t *testing.T) {
+		store := NewMemStore()
+		mux := newIdempotentMux(t, store, time.Hour)
+
+		body := `{"url":"https://example.com"}`
+		req := httptest.NewRequest(http.MethodPost, "/shorten", strings.NewReader(body))
+		_, _, err := store.ReserveIdempotencyKey(context.Background(), IdempotencyRecord{
+			Key:         "key-1",
+			Fingerprint: idempotencyFingerprint(req, []byte(body)),
+			CreatedAt:   time.Now(),
+			ExpiresAt:   time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		rr := postWithKey(mux, "/shorten", "key-1", body)
+		if rr.Code != http.StatusConflict {
+			t.Fatalf("expected status %d, got %d", http.StatusConflict, rr.Code)
+		}
+	})
+
+	t.Run("Expired key can be reused", func(t *testing.T) {
+		mux := newIdempotentMux(t, NewMemStore(), time.Millisecond)
+
+		first := postWithKey(mux, "/shorten", "key-1", `{"url":"https://example.com"}`)
+		time.Sleep(5 * time.Millisecond)
+		second := postWithKey(mux, "/shorten", "key-1", `{"url":"https://example.com"}`)
+
+		var a, b shortenResponse
+		json.Unmarshal(first.Body.Bytes(), &a)
+		json.Unmarshal(second.Body.Bytes(), &b)
+
+		if a.Short == b.Short {
+			t.Fatalf("expected a new link once the key expired, both got %q", a.Short)
+		}
+	})
+
+	t.Run("Batch endpoint", func(t *testing.T) {
+		mux := newIdempotentMux(t, NewMemStore(), time.Hour)
+
+		body := `{"items":[{"url":"https://example.com/a"},{"url":"https://example.com/b"}]}`
+		first := postWithKey(mux, "/shorten/batch", "batch-1", body)
+		retry := postWithKey(mux, "/shorten/batch", "batch-1", body)
+
+		if first.Body.String() != retry.Body.String() {
+			t.Fatalf("expected identical bodies, got %q and %q", first.Body.String(), retry.Body.String())
+		}
+	})
+
+	t.Run("Panicking handler releases the key", func(t *testing.T) {
+		h := NewHandler(NewShortener(NewMemStore(), NewBase62Generator()), WithIdempotency(NewMemStore(), time.Hour))
+
+		fail := true
+		handler := h.idempotent(func(w http.ResponseWriter, r *http.Request) {
+			if fail {
+				panic("boom")
+			}
+			w.WriteHeader(http.StatusCreated)
+		})
+		serve := func() (rr *httptest.ResponseRecorder, panicked bool) {
+			defer func() { panicked = recover() != nil }()
+
+			req := httptest.NewRequest(http.MethodPost, "/shorten", strings.NewReader(`{"url":"https://example.com"}`))
+			req.Header.Set("Idempotency-Key", "key-1")
+			rr = httptest.NewRecorder()
+			handler(rr, req)
+			return rr, false
+		}
+
+		if _, panicked := serve(); !panicked {
+			t.Fatal("expected the panic to reach the server")
+		}
+
+		fail = false
+		if rr, _ := serve(); rr.Code != http.StatusCreated {
+			t.Fatalf("expected the retry to run, got %d", rr.Code)
+		}
+	})
+
+	t.Run("No key, no idempotency", func(t *testing.T) {
+		mux := newIdempotentMux(t, NewMemStore(), time.Hour)
+
+		body := `{"url":"https://example.com"}`
+		first := postWithKey(mux, "/shorten", "", body)
+		second := postWithKey(mux, "/shorten", "", body)
+
+		if first.Body.String() == second.Body.String() {
+			t.Fatal("expected two different links without an Idempotency-Key")
+		}
+	})
+}
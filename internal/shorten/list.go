@@ -0,0 +1,109 @@
+package shorten
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("invalid sort, must be created_at or hits")
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// ListSort is the column a listing is ordered by. Both orders are descending
+// (newest first / most hits first), with short_id as the tie-breaker so the order is total.
+//
+// Paging by hits is approximate: the cursor holds the hits the last link had when its page was
+// read, and links keep getting hits meanwhile. One that gets past the cursor between two pages
+// is skipped. Hits only grow, so no link is listed twice
+type ListSort string
+
+const (
+	SortCreatedAt ListSort = "created_at"
+	SortHits      ListSort = "hits"
+)
+
+func parseListSort(raw string) (ListSort, error) {
+	switch ListSort(raw) {
+	case "", SortCreatedAt:
+		return SortCreatedAt, nil
+	case SortHits:
+		return SortHits, nil
+	default:
+		return "", ErrInvalidSort
+	}
+}
+
+// Cursor is the keyset position of the last link on a page. The next page starts
+// strictly after it in the listing order.
+type Cursor struct {
+	Sort      ListSort  `json:"s"`
+	CreatedAt time.Time `json:"c"`
+	Hits      int64     `json:"h"`
+	ID        string    `json:"i"`
+}
+
+func cursorFor(sort ListSort, link ShortLink) Cursor {
+	return Cursor{
+		Sort:      sort,
+		CreatedAt: link.CreatedAt,
+		Hits:      link.Hits,
+		ID:        link.ID,
+	}
+}
+
+// Cursors are opaque to clients: base64(JSON) so we can change what's in them later
+func (c Cursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	var c Cursor
+	if err := json.Unmarshal(raw, &c); err != nil || c.ID == "" {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+// after reports whether link comes strictly after the cursor in the listing order
+func (c Cursor) after(link ShortLink) bool {
+	switch c.Sort {
+	case SortHits:
+		if link.Hits != c.Hits {
+			return link.Hits < c.Hits
+		}
+	default:
+		if !link.CreatedAt.Equal(c.CreatedAt) {
+			return link.CreatedAt.Before(c.CreatedAt)
+		}
+	}
+	return link.ID < c.ID
+}
+
+// ListOptions is what a Store needs to fetch one page.
+// After is nil for the first page, and Owner is nil to list every owner's links.
+type ListOptions struct {
+	Sort  ListSort
+	After *Cursor
+	Limit int
+	Owner *string
+}
+
+type LinkPage struct {
+	Links      []ShortLink
+	NextCursor string // empty on the last page
+}
@@ -0,0 +1,189 @@
+package shorten
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrLiveDisabled = errors.New("live click streams are not enabled")
+	ErrLiveClosed   = errors.New("live click streams have been shut down")
+)
+
+// ClickEvent is a click as it's streamed live. Unlike Click it says nothing about who clicked
+type ClickEvent struct {
+	LinkID       string
+	At           time.Time
+	Bot          bool
+	ReferrerHost string
+	AgentClass   string
+	Browser      string
+	OS           string
+}
+
+func newClickEvent(id string, visit Visit, bot bool) ClickEvent {
+	agent := parseUserAgent(visit.UserAgent)
+	if bot {
+		agent.Class = AgentBot
+	}
+
+	return ClickEvent{
+		LinkID:       id,
+		At:           visit.At,
+		Bot:          bot,
+		ReferrerHost: referrerHost(visit.Referrer),
+		AgentClass:   agent.Class,
+		Browser:      agent.Browser,
+		OS:           agent.OS,
+	}
+}
+
+// LiveBroker fans click events out to live subscribers, in process.
+// Publishing never waits: each subscriber has a buffer of its own, and a subscriber that
+// doesn't keep up misses the events that don't fit instead of slowing redirects down
+type LiveBroker struct {
+	buffer int
+
+	mu     sync.RWMutex
+	subs   map[string]map[*LiveSubscription]struct{} // by link ID; "" is subscribed to every link
+	closed bool
+}
+
+func NewLiveBroker(buffer int) *LiveBroker {
+	if buffer <= 0 {
+		buffer = 1
+	}
+
+	return &LiveBroker{
+		buffer: buffer,
+		subs:   make(map[string]map[*LiveSubscription]struct{}),
+	}
+}
+
+// LiveSubscription receives the click events for one link, or for all of them
+type LiveSubscription struct {
+	broker  *LiveBroker
+	linkID  string
+	events  chan ClickEvent
+	dropped atomic.Int64
+}
+
+// Events delivers the clicks. It's closed once the subscription or the broker is closed
+func (sub *LiveSubscription) Events() <-chan ClickEvent {
+	return sub.events
+}
+
+// Dropped is how many events this subscriber has missed because its buffer was full
+func (sub *LiveSubscription) Dropped() int64 {
+	return sub.dropped.Load()
+}
+
+// Close unsubscribes. It's safe to call more than once, and after the broker has closed
+func (sub *LiveSubscription) Close() {
+	sub.broker.remove(sub)
+}
+
+// Subscribe starts receiving the clicks on link id, or on every link if id is ""
+func (b *LiveBroker) Subscribe(id string) (*LiveSubscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrLiveClosed
+	}
+
+	sub := &LiveSubscription{
+		broker: b,
+		linkID: id,
+		events: make(chan ClickEvent, b.buffer),
+	}
+
+	if b.subs[id] == nil {
+		b.subs[id] = make(map[*LiveSubscription]struct{})
+	}
+	b.subs[id][sub] = struct{}{}
+
+	return sub, nil
+}
+
+func (b *LiveBroker) remove(sub *LiveSubscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs := b.subs[sub.linkID]
+	if _, ok := subs[sub]; !ok {
+		return // already closed
+	}
+
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(b.subs, sub.linkID)
+	}
+	close(sub.events)
+}
+
+// watching reports whether anyone would receive an event for link id,
+// so callers can skip building events nobody will see
+func (b *LiveBroker) watching(id string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return len(b.subs[id]) > 0 || len(b.subs[""]) > 0
+}
+
+// Publish hands ev to everyone subscribed to its link and to all links
+func (b *LiveBroker) Publish(ev ClickEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, id := range []string{ev.LinkID, ""} {
+		for sub := range b.subs[id] {
+			select {
+			case sub.events <- ev:
+			default:
+				sub.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// Close ends every subscription and turns away new ones. Live streams would otherwise
+// keep their connections (and a graceful shutdown) open forever
+func (b *LiveBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for _, subs := range b.subs {
+		for sub := range subs {
+			close(sub.events)
+		}
+	}
+	clear(b.subs)
+}
+
+// Subscribe streams the clicks on link id as they happen. Deleted links can't be watched
+func (s *Shortener) Subscribe(ctx context.Context, id string) (*LiveSubscription, error) {
+	if s.live == nil {
+		return nil, ErrLiveDisabled
+	}
+
+	// 404 / 410 for links that don't exist (any more)
+	if _, err := s.Stats(ctx, id); err != nil {
+		return nil, err
+	}
+
+	return s.live.Subscribe(id)
+}
+
+// SubscribeAll streams the clicks on every link as they happen
+func (s *Shortener) SubscribeAll() (*LiveSubscription, error) {
+	if s.live == nil {
+		return nil, ErrLiveDisabled
+	}
+
+	return s.live.Subscribe("")
+}
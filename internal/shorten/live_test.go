@@ -0,0 +1,298 @@
+package shorten
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"shortener/internal/shared"
+)
+
+func TestLiveBroker(t *testing.T) {
+	t.Run("Subscribers get their link's events and all-link subscribers get everything", func(t *testing.T) {
+		broker := NewLiveBroker(10)
+		a, _ := broker.Subscribe("a")
+		all, _ := broker.Subscribe("")
+		defer a.Close()
+		defer all.Close()
+
+		broker.Publish(ClickEvent{LinkID: "a"})
+		broker.Publish(ClickEvent{LinkID: "b"})
+
+		if got := len(a.Events()); got != 1 {
+			t.Fatalf("expected 1 event for a, got %d", got)
+		}
+		if ev := <-a.Events(); ev.LinkID != "a" {
+			t.Fatalf("expected an event for a, got %q", ev.LinkID)
+		}
+		if got := len(all.Events()); got != 2 {
+			t.Fatalf("expected 2 events for the all-links subscriber, got %d", got)
+		}
+		if !broker.watching("a") || !broker.watching("zzz") {
+			t.Fatal("expected every link to be watched while there's an all-links subscriber")
+		}
+	})
+
+	t.Run("Slow subscribers drop events", func(t *testing.T) {
+		broker := NewLiveBroker(2)
+		sub, _ := broker.Subscribe("a")
+		defer sub.Close()
+
+		for range 5 {
+			broker.Publish(ClickEvent{LinkID: "a"})
+		}
+
+		if got := len(sub.Events()); got != 2 {
+			t.Fatalf("expected a full buffer of 2, got %d", got)
+		}
+		if got := sub.Dropped(); got != 3 {
+			t.Fatalf("expected 3 dropped events, got %d", got)
+		}
+	})
+
+	t.Run("Closing a subscription unsubscribes it", func(t *testing.T) {
+		broker := NewLiveBroker(10)
+		sub, _ := broker.Subscribe("a")
+
+		sub.Close()
+		sub.Close() // twice is fine
+
+		if _, ok := <-sub.Events(); ok {
+			t.Fatal("expected the events channel to be closed")
+		}
+		if broker.watching("a") {
+			t.Fatal("expected nobody to be watching a")
+		}
+		broker.Publish(ClickEvent{LinkID: "a"}) // must not panic
+	})
+
+	t.Run("Closing the broker ends every subscription", func(t *testing.T) {
+		broker := NewLiveBroker(10)
+		a, _ := broker.Subscribe("a")
+		all, _ := broker.Subscribe("")
+
+		broker.Close()
+
+		for _, sub := range []*LiveSubscription{a, all} {
+			if _, ok := <-sub.Events(); ok {
+				t.Fatal("expected the events channel to be closed")
+			}
+			sub.Close()
+		}
+		if _, err := broker.Subscribe("a"); !errors.Is(err, ErrLiveClosed) {
+			t.Fatalf("expected ErrLiveClosed, got %v", err)
+		}
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Redirects are published", func(t *testing.T) {
+		broker := NewLiveBroker(10)
+		shortener := NewShortener(NewMemStore(), NewBase62Generator(), WithLiveBroker(broker))
+		link, err := shortener.Create(ctx, "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		sub, err := shortener.Subscribe(ctx, link.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer sub.Close()
+
+		_, err = shortener.ResolveVisit(ctx, link.ID, Visit{
+			At:        time.Now(),
+			Method:    http.MethodGet,
+			Referrer:  "https://news.example.org/page",
+			UserAgent: firefoxUA,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := shortener.ResolveVisit(ctx, link.ID, Visit{At: time.Now(), UserAgent: slackUA}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		ev := <-sub.Events()
+		if ev.LinkID != link.ID || ev.Bot || ev.ReferrerHost != "news.example.org" || ev.Browser != "Firefox" {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+		if ev := <-sub.Events(); !ev.Bot || ev.AgentClass != AgentBot {
+			t.Fatalf("expected a bot event, got %+v", ev)
+		}
+	})
+
+	t.Run("Failed redirects are not published", func(t *testing.T) {
+		broker := NewLiveBroker(10)
+		shortener := NewShortener(NewMemStore(), NewBase62Generator(), WithLiveBroker(broker))
+		all, _ := shortener.SubscribeAll()
+		defer all.Close()
+
+		if _, err := shortener.Resolve(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+		if got := len(all.Events()); got != 0 {
+			t.Fatalf("expected no events, got %d", got)
+		}
+	})
+
+	t.Run("Unknown links can't be watched", func(t *testing.T) {
+		shortener := NewShortener(NewMemStore(), NewBase62Generator(), WithLiveBroker(NewLiveBroker(10)))
+
+		if _, err := shortener.Subscribe(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Disabled without a broker", func(t *testing.T) {
+		shortener := NewShortener(NewMemStore(), NewBase62Generator())
+
+		if _, err := shortener.SubscribeAll(); !errors.Is(err, ErrLiveDisabled) {
+			t.Fatalf("expected ErrLiveDisabled, got %v", err)
+		}
+	})
+}
+
+// readEvent reads one SSE message (up to the blank line) and returns its lines
+func readEvent(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestHandleLive(t *testing.T) {
+	ctx := context.Background()
+
+	broker := NewLiveBroker(10)
+	store := NewMemStore()
+	shortener := NewShortener(store, NewBase62Generator(), WithLiveBroker(broker))
+	link, err := shortener.CreateWithOptions(ctx, "https://example.com", CreateOptions{Owner: "stats"})
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	keys := shared.NewKeyAuth(store)
+	statsKey, _, _ := keys.Mint(ctx, "stats", "", []shared.Scope{shared.ScopeReadStats})
+	adminKey, _, _ := keys.Mint(ctx, "admin", "", []shared.Scope{shared.ScopeAdmin})
+
+	mux := http.NewServeMux()
+	RegisterRoutes(mux, shortener, WithLiveHeartbeat(20*time.Millisecond), WithAPIKeys(keys))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path, key string) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		req.Header.Set("X-API-Key", key)
+		return http.DefaultClient.Do(req)
+	}
+
+	t.Run("Streams clicks and heartbeats", func(t *testing.T) {
+		resp, err := get("/stats/"+link.ID+"/live", statsKey)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("expected a 200 event stream, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		stream := bufio.NewReader(resp.Body)
+
+		if lines := readEvent(t, stream); len(lines) != 1 || lines[0] != ": heartbeat" {
+			t.Fatalf("expected a heartbeat, got %q", lines)
+		}
+
+		if _, err := shortener.Resolve(ctx, link.ID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		lines := readEvent(t, stream)
+		for len(lines) == 1 && lines[0] == ": heartbeat" {
+			lines = readEvent(t, stream)
+		}
+		if len(lines) != 2 || lines[0] != "event: click" {
+			t.Fatalf("expected a click event, got %q", lines)
+		}
+		var click liveClick
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &click); err != nil {
+			t.Fatalf("failed to decode event: %v", err)
+		}
+		if click.Short != link.ID {
+			t.Fatalf("expected a click on %s, got %+v", link.ID, click)
+		}
+	})
+
+	t.Run("Unknown link", func(t *testing.T) {
+		resp, err := get("/stats/missing/live", statsKey)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected 404, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Admin stream needs an admin key", func(t *testing.T) {
+		resp, err := get("/admin/live", statsKey)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected 403, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Streams end when the broker closes", func(t *testing.T) {
+		resp, err := get("/admin/live", adminKey)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+
+		broker.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			stream := bufio.NewReader(resp.Body)
+			for {
+				if _, err := stream.ReadString('\n'); err != nil {
+					done <- err
+					return
+				}
+			}
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected the stream to end")
+		}
+	})
+}
@@ -1,31 +1,163 @@
 package shorten
 
-import "sync"
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"shortener/internal/shared"
+)
 
 type MemStore struct {
 	mu   sync.RWMutex
 	data map[string]ShortLink
+
+	// reverse map: normalized URL -> IDs of the links pointing at it, oldest first
+	byURL map[string][]string
+
+	counter uint64 // last value handed out by AllocateBlock
+
+	idempotency map[string]IdempotencyRecord
+
+	clicks clickRing
+
+	// daily visitor sketches per link, kept for as long as the link
+	visitors map[string]map[time.Time]*hyperLogLog
+
+	expiryClaimed map[string]bool // IDs of the links ClaimExpired has returned
+
+	webhooks     map[string]Webhook
+	deliveries   map[int64]memDelivery
+	lastDelivery int64
+
+	apiKeys map[string]shared.APIKey // by ID
+}
+
+// memDelivery is a WebhookDelivery before it's joined with its webhook
+type memDelivery struct {
+	WebhookDelivery
+	nextAttempt time.Time
+	lastError   string
+}
+
+// how many clicks a MemStore keeps; older ones are overwritten
+const memClickCapacity = 10000
+
+// clickRing keeps the most recent clicks in a fixed amount of memory
+type clickRing struct {
+	buf  []Click
+	next int // where the next click goes once buf is full
+}
+
+func (ring *clickRing) add(click Click) {
+	if len(ring.buf) < memClickCapacity {
+		ring.buf = append(ring.buf, click)
+		return
+	}
+	ring.buf[ring.next] = click
+	ring.next = (ring.next + 1) % memClickCapacity
 }
 
 func NewMemStore() *MemStore {
 	return &MemStore{
-		data: make(map[string]ShortLink),
+		data:          make(map[string]ShortLink),
+		byURL:         make(map[string][]string),
+		idempotency:   make(map[string]IdempotencyRecord),
+		visitors:      make(map[string]map[time.Time]*hyperLogLog),
+		expiryClaimed: make(map[string]bool),
+		webhooks:      make(map[string]Webhook),
+		deliveries:    make(map[int64]memDelivery),
+		apiKeys:       make(map[string]shared.APIKey),
+	}
+}
+
+// put adds a new link and indexes it. Callers must hold the write lock
+func (store *MemStore) put(link ShortLink) {
+	store.data[link.ID] = link
+	key := normalizeURL(link.URL)
+	store.byURL[key] = append(store.byURL[key], link.ID)
+}
+
+// unindex removes a link from the reverse map. Callers must hold the write lock
+func (store *MemStore) unindex(link ShortLink) {
+	key := normalizeURL(link.URL)
+	ids := store.byURL[key]
+
+	for i, id := range ids {
+		if id == link.ID {
+			ids = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
 	}
+
+	if len(ids) == 0 {
+		delete(store.byURL, key)
+		return
+	}
+	store.byURL[key] = ids
 }
 
-func (store *MemStore) Save(link ShortLink) error {
+func (store *MemStore) Save(_ context.Context, link ShortLink, events ...EventType) error {
+	queued, err := linkEvents(events, link)
+	if err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err := store.checkNew(link); err != nil {
+		return err
+	}
+	store.put(link)
+	store.enqueue(queued)
+
+	return nil
+}
+
+func (store *MemStore) SaveMany(_ context.Context, links []ShortLink, events ...EventType) ([]error, error) {
+	queued, err := linkEvents(events, links...)
+	if err != nil {
+		return nil, err
+	}
+
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
+	errs := make([]error, len(links))
+	for i, link := range links {
+		if err := store.checkNew(link); err != nil {
+			errs[i] = err
+			continue
+		}
+		store.put(link)
+		store.enqueue(queued[i*len(events) : (i+1)*len(events)])
+	}
+
+	return errs, nil
+}
+
+// checkNew is what stops a link from being saved, like the primary key and link_canonical_url_idx
+// in Postgres. Callers must hold the lock
+func (store *MemStore) checkNew(link ShortLink) error {
 	if _, exists := store.data[link.ID]; exists {
 		return ErrDuplicateID
 	}
-	store.data[link.ID] = link
+
+	if link.Canonical {
+		for _, id := range store.byURL[normalizeURL(link.URL)] {
+			if other := store.data[id]; other.Canonical && other.reusable() && other.Owner == link.Owner {
+				return ErrDuplicateURL
+			}
+		}
+	}
 
 	return nil
 }
 
-func (store *MemStore) Get(id string) (ShortLink, error) {
+func (store *MemStore) Get(_ context.Context, id string) (ShortLink, error) {
 	store.mu.RLock()
 	defer store.mu.RUnlock()
 
@@ -37,21 +169,95 @@ func (store *MemStore) Get(id string) (ShortLink, error) {
 	return link, nil
 }
 
-// func (store *MemStore) List() []ShortLink {
-// 	store.mu.RLock()
-// 	defer store.mu.RUnlock()
+func (store *MemStore) FindByURL(_ context.Context, url string, owner string) (ShortLink, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	// byURL is oldest first, so this is the oldest reusable link unless a canonical one turns up
+	var found *ShortLink
+	for _, id := range store.byURL[normalizeURL(url)] {
+		link := store.data[id]
+		if !link.reusable() || link.Owner != owner {
+			continue
+		}
+		if link.Canonical {
+			return link, nil
+		}
+		if found == nil {
+			found = &link
+		}
+	}
+
+	if found == nil {
+		return ShortLink{}, ErrNotFound
+	}
+	return *found, nil
+}
+
+func (store *MemStore) List(_ context.Context, opts ListOptions) ([]ShortLink, error) {
+	store.mu.RLock()
+
+	// take a snapshot, not the internal map, so we can sort without holding the lock
+	links := make([]ShortLink, 0, len(store.data))
+	for _, v := range store.data {
+		if v.DeletedAt != nil {
+			continue
+		}
+		if opts.Owner != nil && v.Owner != *opts.Owner {
+			continue
+		}
+		if opts.After != nil && !opts.After.after(v) {
+			continue
+		}
+		links = append(links, v)
+	}
+
+	store.mu.RUnlock()
+
+	sort.Slice(links, func(i, j int) bool {
+		// links[i] sorts first if links[j] comes after it in the listing order
+		return cursorFor(opts.Sort, links[i]).after(links[j])
+	})
+
+	if len(links) > opts.Limit {
+		links = links[:opts.Limit]
+	}
+
+	return links, nil
+}
+
+func (store *MemStore) ClaimExpired(_ context.Context, now time.Time, limit int, events ...EventType) ([]ShortLink, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
 
-// 	// return a snapshot, not the internal map
-// 	copy := make([]ShortLink, 0, len(store.data))
+	var links []ShortLink
+	for id, link := range store.data {
+		if link.DeletedAt != nil || link.ExpiresAt == nil || link.ExpiresAt.After(now) || store.expiryClaimed[id] {
+			continue
+		}
+		links = append(links, link)
+	}
 
-// 	for _, v := range store.data {
-// 		copy = append(copy, v)
-// 	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].ExpiresAt.Before(*links[j].ExpiresAt)
+	})
+	if len(links) > limit {
+		links = links[:limit]
+	}
+
+	queued, err := linkEvents(events, links...)
+	if err != nil {
+		return nil, err
+	}
 
-// 	return copy
-// }
+	for _, link := range links {
+		store.expiryClaimed[link.ID] = true
+	}
+	store.enqueue(queued)
+	return links, nil
+}
 
-func (store *MemStore) IncrementHits(id string) error {
+func (store *MemStore) IncrementHits(_ context.Context, id string) error {
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
@@ -64,3 +270,469 @@ func (store *MemStore) IncrementHits(id string) error {
 	store.data[id] = link
 	return nil
 }
+
+func (store *MemStore) AddHits(_ context.Context, counts map[string]HitCount) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for id, n := range counts {
+		link, ok := store.data[id]
+		if !ok {
+			continue
+		}
+		link.Hits += n.Hits
+		link.BotHits += n.BotHits
+		store.data[id] = link
+	}
+	return nil
+}
+
+func (store *MemStore) Hit(_ context.Context, id string, now time.Time) (ShortLink, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	link, ok := store.data[id]
+	if !ok {
+		return ShortLink{}, ErrNotFound
+	}
+
+	if err := link.checkActive(now); err != nil {
+		return ShortLink{}, err
+	}
+
+	link.Hits++
+	store.data[id] = link
+	return link, nil
+}
+
+func (store *MemStore) RecordClicks(_ context.Context, clicks []Click) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, click := range clicks {
+		if _, ok := store.data[click.LinkID]; ok {
+			store.clicks.add(click)
+		}
+	}
+
+	for key, sketch := range sketchVisitors(clicks) {
+		if _, ok := store.data[key.id]; !ok {
+			continue
+		}
+
+		days := store.visitors[key.id]
+		if days == nil {
+			days = make(map[time.Time]*hyperLogLog)
+			store.visitors[key.id] = days
+		}
+		if existing, ok := days[key.day]; ok {
+			existing.merge(sketch)
+		} else {
+			days[key.day] = sketch
+		}
+	}
+
+	return nil
+}
+
+func (store *MemStore) UniqueVisitors(_ context.Context, id string, from, to time.Time) (int64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	from, to = BucketDay.start(from), BucketDay.start(to)
+
+	merged := newHyperLogLog()
+	for day, sketch := range store.visitors[id] {
+		if day.Before(from) || day.After(to) {
+			continue
+		}
+		merged.merge(sketch)
+	}
+
+	return merged.estimate(), nil
+}
+
+func (store *MemStore) ClickCounts(_ context.Context, id string, from, to time.Time, bucket Bucket) ([]ClickCount, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	counts := make(map[time.Time]int64)
+	for _, click := range store.clicks.buf {
+		if click.LinkID != id || click.At.Before(from) || !click.At.Before(to) {
+			continue
+		}
+		counts[bucket.start(click.At)]++
+	}
+
+	result := make([]ClickCount, 0, len(counts))
+	for start, n := range counts {
+		result = append(result, ClickCount{Start: start, Clicks: n})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Start.Before(result[j].Start)
+	})
+
+	return result, nil
+}
+
+func (store *MemStore) ClickBreakdown(_ context.Context, id string, from, to time.Time, limit int) (Breakdown, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	counts := newBreakdownCounts()
+	for _, click := range store.clicks.buf {
+		if click.LinkID != id || click.At.Before(from) || !click.At.Before(to) {
+			continue
+		}
+		counts.referrers[click.ReferrerHost]++
+		counts.browsers[click.Browser]++
+		counts.oses[click.OS]++
+		counts.agents[click.AgentClass]++
+	}
+
+	return counts.breakdown(limit), nil
+}
+
+func (store *MemStore) Update(_ context.Context, id string, url string, events ...EventType) (ShortLink, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	old, ok := store.data[id]
+	if !ok {
+		return ShortLink{}, ErrNotFound
+	}
+	if old.DeletedAt != nil {
+		return ShortLink{}, ErrDeleted
+	}
+
+	link := old
+	link.URL = url
+	link.Canonical = false // see PGStore.Update
+
+	queued, err := linkEvents(events, link)
+	if err != nil {
+		return ShortLink{}, err
+	}
+
+	store.unindex(old)
+	store.put(link)
+	store.enqueue(queued)
+	return link, nil
+}
+
+func (store *MemStore) Delete(_ context.Context, id string, events ...EventType) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	link, ok := store.data[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if link.DeletedAt != nil {
+		return ErrDeleted
+	}
+
+	now := time.Now()
+	link.DeletedAt = &now
+
+	queued, err := linkEvents(events, link)
+	if err != nil {
+		return err
+	}
+
+	store.data[id] = link
+	store.enqueue(queued)
+	return nil
+}
+
+func (store *MemStore) DeleteExpired(_ context.Context, before time.Time) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var n int64
+	for id, link := range store.data {
+		if link.ExpiresAt != nil && link.ExpiresAt.Before(before) {
+			store.unindex(link)
+			delete(store.data, id)
+			delete(store.visitors, id)
+			delete(store.expiryClaimed, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (store *MemStore) AllocateBlock(_ context.Context, size uint64) (uint64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	start := store.counter + 1
+	store.counter += size
+	return start, nil
+}
+
+func (store *MemStore) ReserveIdempotencyKey(_ context.Context, rec IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// an expired record is as good as no record
+	if existing, ok := store.idempotency[rec.Key]; ok && existing.ExpiresAt.After(rec.CreatedAt) {
+		return existing, false, nil
+	}
+
+	store.idempotency[rec.Key] = rec
+	return rec, true, nil
+}
+
+func (store *MemStore) CompleteIdempotencyKey(_ context.Context, key string, status int, body []byte) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	rec, ok := store.idempotency[key]
+	if !ok {
+		return ErrNotFound
+	}
+
+	rec.Status = status
+	rec.Body = append([]byte(nil), body...)
+	store.idempotency[key] = rec
+	return nil
+}
+
+func (store *MemStore) ReleaseIdempotencyKey(_ context.Context, key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.idempotency, key)
+	return nil
+}
+
+func (store *MemStore) DeleteExpiredIdempotencyKeys(_ context.Context, before time.Time) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var n int64
+	for key, rec := range store.idempotency {
+		if rec.ExpiresAt.Before(before) {
+			delete(store.idempotency, key)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (store *MemStore) SaveWebhook(_ context.Context, hook Webhook) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, exists := store.webhooks[hook.ID]; exists {
+		return ErrDuplicateID
+	}
+	hook.Events = append([]EventType(nil), hook.Events...)
+	store.webhooks[hook.ID] = hook
+	return nil
+}
+
+func (store *MemStore) ListWebhooks(_ context.Context) ([]Webhook, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	hooks := make([]Webhook, 0, len(store.webhooks))
+	for _, hook := range store.webhooks {
+		hook.Events = append([]EventType(nil), hook.Events...)
+		hooks = append(hooks, hook)
+	}
+
+	sort.Slice(hooks, func(i, j int) bool {
+		if !hooks[i].CreatedAt.Equal(hooks[j].CreatedAt) {
+			return hooks[i].CreatedAt.Before(hooks[j].CreatedAt)
+		}
+		return hooks[i].ID < hooks[j].ID
+	})
+	return hooks, nil
+}
+
+func (store *MemStore) DeleteWebhook(_ context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.webhooks[id]; !ok {
+		return ErrNotFound
+	}
+	delete(store.webhooks, id)
+
+	for deliveryID, delivery := range store.deliveries {
+		if delivery.WebhookID == id {
+			delete(store.deliveries, deliveryID)
+		}
+	}
+	return nil
+}
+
+func (store *MemStore) EnqueueWebhookEvents(_ context.Context, events []WebhookEvent) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.enqueue(events)
+	return nil
+}
+
+// enqueue adds the deliveries of events, like EnqueueWebhookEvents. Callers must hold the write lock
+func (store *MemStore) enqueue(events []WebhookEvent) {
+	// a zero due time puts new deliveries ahead of any retries, like they'd be due straight away
+	for _, ev := range events {
+		for _, hook := range store.webhooks {
+			if !hook.wants(ev.Type) {
+				continue
+			}
+
+			store.lastDelivery++
+			store.deliveries[store.lastDelivery] = memDelivery{
+				WebhookDelivery: WebhookDelivery{
+					ID:        store.lastDelivery,
+					WebhookID: hook.ID,
+					EventID:   ev.ID,
+					EventType: ev.Type,
+					Payload:   ev.Payload,
+				},
+			}
+		}
+	}
+}
+
+func (store *MemStore) ClaimWebhookDeliveries(_ context.Context, now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var due []memDelivery
+	for _, delivery := range store.deliveries {
+		if !delivery.nextAttempt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].nextAttempt.Equal(due[j].nextAttempt) {
+			return due[i].nextAttempt.Before(due[j].nextAttempt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]WebhookDelivery, len(due))
+	for i, delivery := range due {
+		delivery.nextAttempt = now.Add(lease)
+		store.deliveries[delivery.ID] = delivery
+
+		hook := store.webhooks[delivery.WebhookID]
+		claimed[i] = delivery.WebhookDelivery
+		claimed[i].URL = hook.URL
+		claimed[i].Secret = hook.Secret
+	}
+	return claimed, nil
+}
+
+func (store *MemStore) RetryWebhookDelivery(_ context.Context, id int64, next time.Time, lastError string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delivery, ok := store.deliveries[id]
+	if !ok {
+		return nil // its webhook was deleted meanwhile
+	}
+
+	delivery.Attempts++
+	delivery.nextAttempt = next
+	delivery.lastError = lastError
+	store.deliveries[id] = delivery
+	return nil
+}
+
+func (store *MemStore) DeleteWebhookDelivery(_ context.Context, id int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.deliveries, id)
+	return nil
+}
+
+func (store *MemStore) SaveAPIKey(_ context.Context, key shared.APIKey) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, existing := range store.apiKeys {
+		if existing.ID == key.ID || existing.Hash == key.Hash {
+			return ErrDuplicateID
+		}
+	}
+	store.apiKeys[key.ID] = copyAPIKey(key)
+	return nil
+}
+
+func (store *MemStore) FindAPIKey(_ context.Context, hash string) (shared.APIKey, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, key := range store.apiKeys {
+		if key.Hash == hash {
+			return copyAPIKey(key), nil
+		}
+	}
+	return shared.APIKey{}, shared.ErrAPIKeyNotFound
+}
+
+func (store *MemStore) ListAPIKeys(_ context.Context) ([]shared.APIKey, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	keys := make([]shared.APIKey, 0, len(store.apiKeys))
+	for _, key := range store.apiKeys {
+		keys = append(keys, copyAPIKey(key))
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+func (store *MemStore) RevokeAPIKey(_ context.Context, id string, at time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key, ok := store.apiKeys[id]
+	if !ok {
+		return shared.ErrAPIKeyNotFound
+	}
+	if key.RevokedAt == nil {
+		key.RevokedAt = &at
+		store.apiKeys[id] = key
+	}
+	return nil
+}
+
+func (store *MemStore) TouchAPIKey(_ context.Context, id string, at time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key, ok := store.apiKeys[id]
+	if !ok {
+		return nil // no such key, so nothing to record
+	}
+	key.LastUsedAt = &at
+	store.apiKeys[id] = key
+	return nil
+}
+
+// copyAPIKey keeps callers from sharing the stored key's scopes
+func copyAPIKey(key shared.APIKey) shared.APIKey {
+	key.Scopes = slices.Clone(key.Scopes)
+	return key
+}
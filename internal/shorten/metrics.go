@@ -0,0 +1,82 @@
+package shorten
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"shortener/internal/metrics"
+)
+
+// shortenerCounts are running totals of what a Shortener has done, exported by RegisterMetrics
+type shortenerCounts struct {
+	created    atomic.Int64
+	collisions atomic.Int64 // generated IDs that were already taken, each one costing a retry
+
+	resolves [resolveResults]atomic.Int64
+}
+
+// outcomes of a redirect, as the result label of shortener_resolves_total
+const (
+	resolveOK = iota
+	resolveBot
+	resolveNotFound
+	resolveGone
+	resolveError
+	resolveResults
+)
+
+var resolveResultNames = [resolveResults]string{"ok", "bot", "not_found", "gone", "error"}
+
+func (c *shortenerCounts) resolved(err error, bot bool) {
+	result := resolveOK
+	switch {
+	case err == nil && bot:
+		result = resolveBot
+	case err == nil:
+	case errors.Is(err, ErrNotFound):
+		result = resolveNotFound
+	case errors.Is(err, ErrDeleted), errors.Is(err, ErrExpired), errors.Is(err, ErrHitLimitReached):
+		result = resolveGone
+	default:
+		result = resolveError
+	}
+
+	c.resolves[result].Add(1)
+}
+
+// RegisterMetrics exports the Shortener's create, resolve and collision counts to reg
+func (s *Shortener) RegisterMetrics(reg *metrics.Registry) {
+	reg.CounterFunc("shortener_links_created_total", "Short links created, including in batches.", nil,
+		func() float64 { return float64(s.counts.created.Load()) })
+	reg.CounterFunc("shortener_id_collisions_total", "Generated short IDs that were already taken and had to be retried.", nil,
+		func() float64 { return float64(s.counts.collisions.Load()) })
+
+	for result, name := range resolveResultNames {
+		reg.CounterFunc("shortener_resolves_total", "Redirect lookups, by result.", metrics.Labels{"result": name},
+			func() float64 { return float64(s.counts.resolves[result].Load()) })
+	}
+}
+
+// RegisterMetrics exports the cache's hit rate and size to reg
+func (store *CachedStore) RegisterMetrics(reg *metrics.Registry) {
+	reg.CounterFunc("shortener_cache_hits_total", "Link lookups answered from the cache.", nil,
+		func() float64 { return float64(store.Stats().Hits) })
+	reg.CounterFunc("shortener_cache_misses_total", "Link lookups that went to the store.", nil,
+		func() float64 { return float64(store.Stats().Misses) })
+	reg.GaugeFunc("shortener_cache_entries", "Links in the cache, including cached misses.", nil,
+		func() float64 { return float64(store.Stats().Entries) })
+}
+
+// RegisterMetrics exports the aggregator's flush stats to reg
+func (a *HitAggregator) RegisterMetrics(reg *metrics.Registry) {
+	reg.GaugeFunc("shortener_hits_pending_links", "Links with hits waiting to be flushed to the store.", nil,
+		func() float64 { return float64(a.Stats().PendingLinks) })
+	reg.CounterFunc("shortener_hit_flushes_total", "Hit flushes that wrote to the store.", nil,
+		func() float64 { return float64(a.Stats().Flushes) })
+	reg.CounterFunc("shortener_hit_flush_failures_total", "Hit flushes that failed and were kept for the next one.", nil,
+		func() float64 { return float64(a.Stats().Failures) })
+	reg.CounterFunc("shortener_hits_flushed_total", "Hits and bot hits written to the store by flushes.", nil,
+		func() float64 { return float64(a.Stats().FlushedHits) })
+	reg.CounterFunc("shortener_hits_dropped_total", "Hits and bot hits dropped because too many links were waiting to be flushed.", nil,
+		func() float64 { return float64(a.Stats().DroppedHits) })
+}
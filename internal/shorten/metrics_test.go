@@ -0,0 +1,53 @@
+package shorten
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"shortener/internal/metrics"
+)
+
+func TestShortener_RegisterMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	// the second Create collides with the first link's ID once before getting a fresh one
+	shortener := NewShortener(NewMemStore(), NewSequenceGenerator("aaa", "aaa", "bbb"))
+	reg := metrics.NewRegistry()
+	shortener.RegisterMetrics(reg)
+
+	link, err := shortener.Create(ctx, "https://example.com")
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+	if _, err := shortener.Create(ctx, "https://example.org"); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	_, _ = shortener.Resolve(ctx, link.ID)
+	_, _ = shortener.ResolveVisit(ctx, link.ID, Visit{At: time.Now(), UserAgent: slackUA})
+	_, _ = shortener.Resolve(ctx, "missing")
+	_ = shortener.Delete(ctx, link.ID)
+	_, _ = shortener.Resolve(ctx, link.ID)
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		"shortener_links_created_total 2",
+		"shortener_id_collisions_total 1",
+		`shortener_resolves_total{result="ok"} 1`,
+		`shortener_resolves_total{result="bot"} 1`,
+		`shortener_resolves_total{result="not_found"} 1`,
+		`shortener_resolves_total{result="gone"} 1`,
+		`shortener_resolves_total{result="error"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("expected line %q in:\n%s", line, body)
+		}
+	}
+}
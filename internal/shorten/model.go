@@ -6,5 +6,30 @@ type ShortLink struct {
 	ID        string `json:"short"`
 	URL       string `json:"url"`
 	Hits      int64 `json:"hits"`
+	BotHits   int64 `json:"botHits"` // redirects served to crawlers and link previews, not counted in Hits
 	CreatedAt time.Time `json:"createdAt"`
-}
\ No newline at end of file
+	DeletedAt *time.Time `json:"deletedAt,omitempty"` // nil unless the link was soft-deleted
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"` // nil means the link never expires
+	MaxHits   int64 `json:"maxHits,omitempty"`        // 0 means unlimited
+	Owner     string `json:"owner,omitempty"`         // who created the link, see shared.APIKey; "" for no one in particular
+	Canonical bool `json:"-"`                          // made in dedupe mode; an owner has one reusable canonical link per URL at most
+}
+
+// checkActive reports why the link can't be followed at the given time, or nil if it can
+func (l ShortLink) checkActive(now time.Time) error {
+	if l.DeletedAt != nil {
+		return ErrDeleted
+	}
+	if l.ExpiresAt != nil && !now.Before(*l.ExpiresAt) {
+		return ErrExpired
+	}
+	if l.MaxHits > 0 && l.Hits >= l.MaxHits {
+		return ErrHitLimitReached
+	}
+	return nil
+}
+// reusable reports whether the link can be handed out again for the same URL (see WithDedupe):
+// only live links without an expiry or a hit cap, since those were made for one specific purpose
+func (l ShortLink) reusable() bool {
+	return l.DeletedAt == nil && l.ExpiresAt == nil && l.MaxHits == 0
+}
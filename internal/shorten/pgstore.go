@@ -1,12 +1,64 @@
 package shorten
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/lib/pq"
+
+	"shortener/internal/shared"
 )
 
+// linkColumns is the column list every link query selects, in the order scanLink expects
+const linkColumns = `short_id, original_url, hits, created_at, deleted_at, expires_at, max_hits, bot_hits, owner, canonical`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanLink(row rowScanner) (ShortLink, error) {
+	var link ShortLink
+	var deletedAt, expiresAt sql.NullTime
+	var maxHits sql.NullInt64
+
+	err := row.Scan(
+		&link.ID,
+		&link.URL,
+		&link.Hits,
+		&link.CreatedAt,
+		&deletedAt,
+		&expiresAt,
+		&maxHits,
+		&link.BotHits,
+		&link.Owner,
+		&link.Canonical,
+	)
+
+	if deletedAt.Valid {
+		link.DeletedAt = &deletedAt.Time
+	}
+	if expiresAt.Valid {
+		link.ExpiresAt = &expiresAt.Time
+	}
+	link.MaxHits = maxHits.Int64
+
+	return link, err
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 type PGStore struct {
 	db *sql.DB
 }
@@ -15,14 +67,56 @@ func NewPGStore(db *sql.DB) *PGStore {
 	return &PGStore{db: db}
 }
 
-func (store *PGStore) Save(link ShortLink) error {
-	_, err := store.db.Exec(`
-	INSERT INTO link (short_id, original_url, hits, created_at)
-	VALUES ($1, $2, $3, NOW())
-	`, link.ID, link.URL, link.Hits)
+// the unique index that keeps one reusable canonical link per owner and URL
+const canonicalURLIndex = "link_canonical_url_idx"
+
+// withEvents runs write, then queues each of events for every link it returns, in one transaction.
+// Without events there's nothing to keep in step with, so write runs on its own
+func (store *PGStore) withEvents(ctx context.Context, events []EventType, write func(q querier) ([]ShortLink, error)) error {
+	if len(events) == 0 {
+		_, err := write(store.db)
+		return err
+	}
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	links, err := write(tx)
+	if err != nil {
+		return err
+	}
+
+	queued, err := linkEvents(events, links...)
+	if err != nil {
+		return err
+	}
+	if err := enqueueWebhookEvents(ctx, tx, queued); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *PGStore) Save(ctx context.Context, link ShortLink, events ...EventType) error {
+	return store.withEvents(ctx, events, func(q querier) ([]ShortLink, error) {
+		return []ShortLink{link}, store.save(ctx, q, link)
+	})
+}
+
+func (store *PGStore) save(ctx context.Context, q querier, link ShortLink) error {
+	_, err := q.ExecContext(ctx, `
+	INSERT INTO link (short_id, original_url, url_key, hits, created_at, expires_at, max_hits, owner, canonical)
+	VALUES ($1, $2, $3, $4, NOW(), $5, $6, $7, $8)
+	`, link.ID, link.URL, normalizeURL(link.URL), link.Hits, link.ExpiresAt, sql.NullInt64{Int64: link.MaxHits, Valid: link.MaxHits > 0}, link.Owner, link.Canonical)
 
 	if err != nil {
 		if pqErr, ok := err.(*pq.Error); ok {
+			if pqErr.Code == "23505" && pqErr.Constraint == canonicalURLIndex {
+				return ErrDuplicateURL
+			}
 			if pqErr.Code == "23505" {
 				return ErrDuplicateID
 			}
@@ -33,19 +127,144 @@ func (store *PGStore) Save(link ShortLink) error {
 	return nil
 }
 
-func (store *PGStore) Get(id string) (ShortLink, error) {
-	var link ShortLink
+func (store *PGStore) SaveMany(ctx context.Context, links []ShortLink, events ...EventType) ([]error, error) {
+	if len(links) == 0 {
+		return nil, nil
+	}
 
-	err := store.db.QueryRow(`
-	SELECT short_id, original_url, hits, created_at 
+	var errs []error
+	err := store.withEvents(ctx, events, func(q querier) ([]ShortLink, error) {
+		var err error
+		errs, err = store.saveMany(ctx, q, links)
+		if err != nil {
+			return nil, err
+		}
+
+		var saved []ShortLink
+		for i, link := range links {
+			if errs[i] == nil {
+				saved = append(saved, link)
+			}
+		}
+		return saved, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return errs, nil
+}
+
+func (store *PGStore) saveMany(ctx context.Context, q querier, links []ShortLink) ([]error, error) {
+	ids := make([]string, len(links))
+	urls := make([]string, len(links))
+	urlKeys := make([]string, len(links))
+	hits := make([]int64, len(links))
+	expiresAt := make([]sql.NullString, len(links)) // as text, so the array literal is unambiguous
+	maxHits := make([]sql.NullInt64, len(links))
+	owners := make([]string, len(links))
+	canonical := make([]bool, len(links))
+
+	for i, link := range links {
+		ids[i] = link.ID
+		urls[i] = link.URL
+		urlKeys[i] = normalizeURL(link.URL)
+		hits[i] = link.Hits
+		if link.ExpiresAt != nil {
+			expiresAt[i] = sql.NullString{String: link.ExpiresAt.Format(time.RFC3339Nano), Valid: true}
+		}
+		maxHits[i] = sql.NullInt64{Int64: link.MaxHits, Valid: link.MaxHits > 0}
+		owners[i] = link.Owner
+		canonical[i] = link.Canonical
+	}
+
+	// A single multi-row INSERT (one array per column, zipped back into rows by unnest) is atomic
+	// and costs one round trip. Rows whose short_id is taken, or that would be a second canonical
+	// link for a URL, are skipped rather than failing the whole statement; RETURNING tells us
+	// which ones made it in.
+	rows, err := q.QueryContext(ctx, `
+	INSERT INTO link (short_id, original_url, url_key, hits, created_at, expires_at, max_hits, owner, canonical)
+	SELECT id, url, url_key, hits, NOW(), expires_at, max_hits, owner, canonical
+	FROM unnest($1::text[], $2::text[], $3::text[], $4::bigint[], $5::timestamptz[], $6::bigint[], $7::text[], $8::boolean[])
+		AS t(id, url, url_key, hits, expires_at, max_hits, owner, canonical)
+	ON CONFLICT DO NOTHING
+	RETURNING short_id
+	`, pq.Array(ids), pq.Array(urls), pq.Array(urlKeys), pq.Array(hits), pq.GenericArray{A: expiresAt}, pq.GenericArray{A: maxHits}, pq.Array(owners), pq.Array(canonical))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	saved := make(map[string]bool, len(links))
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		saved[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// ON CONFLICT DO NOTHING doesn't say which conflict it was. Only canonical links can have
+	// had either, and for those the ID is the one that can be checked
+	var skipped []string
+	for _, link := range links {
+		if !saved[link.ID] && link.Canonical {
+			skipped = append(skipped, link.ID)
+		}
+	}
+	taken, err := existingIDs(ctx, q, skipped)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(links))
+	for i, link := range links {
+		switch {
+		case saved[link.ID]:
+		case link.Canonical && !taken[link.ID]:
+			errs[i] = ErrDuplicateURL
+		default:
+			errs[i] = ErrDuplicateID
+		}
+	}
+
+	return errs, nil
+}
+
+// existingIDs reports which of ids are already used by a link
+func existingIDs(ctx context.Context, q querier, ids []string) (map[string]bool, error) {
+	existing := make(map[string]bool, len(ids))
+	if len(ids) == 0 {
+		return existing, nil
+	}
+
+	rows, err := q.QueryContext(ctx, `
+	SELECT short_id FROM link WHERE short_id = ANY($1)
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		existing[id] = true
+	}
+	return existing, rows.Err()
+}
+
+func (store *PGStore) Get(ctx context.Context, id string) (ShortLink, error) {
+	link, err := scanLink(store.db.QueryRowContext(ctx, `
+	SELECT `+linkColumns+`
 	FROM link 
 	WHERE short_id = $1
-	`, id).Scan(
-		&link.ID,
-		&link.URL,
-		&link.Hits,
-		&link.CreatedAt,
-	)
+	`, id))
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -57,8 +276,8 @@ func (store *PGStore) Get(id string) (ShortLink, error) {
 	return link, nil
 }
 
-func (store *PGStore) IncrementHits(id string) error {
-	result, err := store.db.Exec(`
+func (store *PGStore) IncrementHits(ctx context.Context, id string) error {
+	result, err := store.db.ExecContext(ctx, `
 	UPDATE link
 	SET hits = hits + 1
 	WHERE short_id = $1
@@ -79,3 +298,864 @@ func (store *PGStore) IncrementHits(id string) error {
 
 	return nil
 }
+
+// most rows AddHits puts in one UPDATE, to stay well clear of Postgres' 65535 parameter limit
+const addHitsChunkSize = 1000
+
+func (store *PGStore) AddHits(ctx context.Context, counts map[string]HitCount) error {
+	// sorted, so concurrent flushes from different servers lock the rows in the same order
+	ids := make([]string, 0, len(counts))
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	// one transaction, so a failed flush can be retried in full without counting anything twice
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for chunk := range slices.Chunk(ids, addHitsChunkSize) {
+		values := make([]string, len(chunk))
+		args := make([]any, 0, 3*len(chunk))
+		for i, id := range chunk {
+			values[i] = fmt.Sprintf("($%d::text, $%d::bigint, $%d::bigint)", 3*i+1, 3*i+2, 3*i+3)
+			args = append(args, id, counts[id].Hits, counts[id].BotHits)
+		}
+
+		_, err := tx.ExecContext(ctx, `
+		UPDATE link
+		SET hits = link.hits + v.hits,
+			bot_hits = link.bot_hits + v.bot_hits
+		FROM (VALUES `+strings.Join(values, ", ")+`) AS v (short_id, hits, bot_hits)
+		WHERE link.short_id = v.short_id
+		`, args...)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (store *PGStore) FindByURL(ctx context.Context, url string, owner string) (ShortLink, error) {
+	// the conditions mirror ShortLink.reusable, and match link_owner_url_key_idx
+	link, err := scanLink(store.db.QueryRowContext(ctx, `
+	SELECT `+linkColumns+`
+	FROM link
+	WHERE url_key = $1
+		AND deleted_at IS NULL AND expires_at IS NULL AND max_hits IS NULL
+		AND owner = $2
+	ORDER BY canonical DESC, created_at
+	LIMIT 1
+	`, normalizeURL(url), owner))
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ShortLink{}, ErrNotFound
+		}
+		return ShortLink{}, err
+	}
+
+	return link, nil
+}
+
+func (store *PGStore) List(ctx context.Context, opts ListOptions) ([]ShortLink, error) {
+	// The sort column can't be a bind parameter, so it's picked from a fixed set here,
+	// never taken from user input. The row comparison (col, short_id) < ($1, $2) is
+	// exactly the keyset condition, and it can use the matching (col DESC, short_id DESC) index.
+	orderCol := "created_at"
+	if opts.Sort == SortHits {
+		orderCol = "hits"
+	}
+
+	var (
+		conds = []string{"deleted_at IS NULL"}
+		args  []any
+	)
+
+	if opts.Owner != nil {
+		args = append(args, *opts.Owner)
+		conds = append(conds, fmt.Sprintf("owner = $%d", len(args)))
+	}
+
+	if opts.After != nil {
+		var after any = opts.After.CreatedAt
+		if opts.Sort == SortHits {
+			after = opts.After.Hits
+		}
+		args = append(args, after, opts.After.ID)
+		conds = append(conds, fmt.Sprintf("(%s, short_id) < ($%d, $%d)", orderCol, len(args)-1, len(args)))
+	}
+
+	query := `SELECT ` + linkColumns + ` FROM link WHERE ` + strings.Join(conds, " AND ")
+
+	args = append(args, opts.Limit)
+	query += fmt.Sprintf(` ORDER BY %s DESC, short_id DESC LIMIT $%d`, orderCol, len(args))
+
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []ShortLink
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+func (store *PGStore) ClaimExpired(ctx context.Context, now time.Time, limit int, events ...EventType) ([]ShortLink, error) {
+	var links []ShortLink
+	err := store.withEvents(ctx, events, func(q querier) ([]ShortLink, error) {
+		// SKIP LOCKED, so reapers on other replicas claim other links instead of waiting for these
+		rows, err := q.QueryContext(ctx, `
+		WITH due AS (
+			SELECT short_id AS id
+			FROM link
+			WHERE expires_at <= $1 AND expired_reported_at IS NULL AND deleted_at IS NULL
+			ORDER BY expires_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE link
+		SET expired_reported_at = $1
+		FROM due
+		WHERE link.short_id = due.id
+		RETURNING `+linkColumns, now, limit)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			link, err := scanLink(rows)
+			if err != nil {
+				return nil, err
+			}
+			links = append(links, link)
+		}
+		return links, rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(links, func(a, b ShortLink) int {
+		return a.ExpiresAt.Compare(*b.ExpiresAt)
+	})
+	return links, nil
+}
+
+func (store *PGStore) Hit(ctx context.Context, id string, now time.Time) (ShortLink, error) {
+	// one conditional UPDATE does the check and the increment, so Postgres' row lock
+	// serialises concurrent clicks and hits can never go past max_hits
+	link, err := scanLink(store.db.QueryRowContext(ctx, `
+	UPDATE link
+	SET hits = hits + 1
+	WHERE short_id = $1
+		AND deleted_at IS NULL
+		AND (expires_at IS NULL OR expires_at > $2)
+		AND (max_hits IS NULL OR hits < max_hits)
+	RETURNING `+linkColumns, id, now))
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ShortLink{}, store.whyNoRows(ctx, id, now)
+		}
+		return ShortLink{}, err
+	}
+
+	return link, nil
+}
+
+func (store *PGStore) RecordClicks(ctx context.Context, clicks []Click) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(clicks))
+	at := make([]string, len(clicks)) // as text, like SaveMany's expires_at
+	referrers := make([]string, len(clicks))
+	agents := make([]string, len(clicks))
+	browsers := make([]string, len(clicks))
+	oses := make([]string, len(clicks))
+	ipHashes := make([]string, len(clicks))
+
+	for i, click := range clicks {
+		ids[i] = click.LinkID
+		at[i] = click.At.Format(time.RFC3339Nano)
+		referrers[i] = click.ReferrerHost
+		agents[i] = click.AgentClass
+		browsers[i] = click.Browser
+		oses[i] = click.OS
+		ipHashes[i] = click.IPHash
+	}
+
+	// clicks and visitor sketches are saved together, so a retried batch isn't counted twice
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the join drops clicks on links purged since, which would otherwise fail the foreign key
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO click (short_id, clicked_at, referrer_host, agent_class, browser, os, ip_hash)
+	SELECT t.id, t.at, t.referrer, t.agent, t.browser, t.os, t.ip_hash
+	FROM unnest($1::text[], $2::timestamptz[], $3::text[], $4::text[], $5::text[], $6::text[], $7::text[])
+		AS t(id, at, referrer, agent, browser, os, ip_hash)
+	JOIN link ON link.short_id = t.id
+	`, pq.Array(ids), pq.Array(at), pq.Array(referrers), pq.Array(agents), pq.Array(browsers), pq.Array(oses), pq.Array(ipHashes))
+	if err != nil {
+		return err
+	}
+
+	sketches := sketchVisitors(clicks)
+
+	// sorted, so concurrent flushes lock the sketch rows in the same order
+	keys := slices.Collect(maps.Keys(sketches))
+	slices.SortFunc(keys, func(a, b linkDay) int {
+		if c := strings.Compare(a.id, b.id); c != 0 {
+			return c
+		}
+		return a.day.Compare(b.day)
+	})
+
+	for _, key := range keys {
+		if err := mergeVisitorSketch(ctx, tx, key, sketches[key]); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// mergeVisitorSketch adds sketch into the stored one for key.id and key.day.
+// Postgres can't merge sketches itself, so the row is locked, merged here and written back
+func mergeVisitorSketch(ctx context.Context, tx *sql.Tx, key linkDay, sketch *hyperLogLog) error {
+	day := key.day.Format(time.DateOnly)
+
+	// the first sketch of the day can go straight in. If another server got there first,
+	// this waits for its transaction and then does nothing
+	result, err := tx.ExecContext(ctx, `
+	INSERT INTO link_visitors (short_id, day, sketch)
+	SELECT $1, $2::date, $3
+	WHERE EXISTS (SELECT 1 FROM link WHERE short_id = $1)
+	ON CONFLICT (short_id, day) DO NOTHING
+	`, key.id, day, sketch.bytes())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	var stored []byte
+	err = tx.QueryRowContext(ctx, `
+	SELECT sketch
+	FROM link_visitors
+	WHERE short_id = $1 AND day = $2::date
+	FOR UPDATE
+	`, key.id, day).Scan(&stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil // the link has been purged
+	}
+	if err != nil {
+		return err
+	}
+
+	merged, err := hllFromBytes(stored)
+	if err != nil {
+		return err
+	}
+	merged.merge(sketch)
+
+	_, err = tx.ExecContext(ctx, `
+	UPDATE link_visitors
+	SET sketch = $3
+	WHERE short_id = $1 AND day = $2::date
+	`, key.id, day, merged.bytes())
+	return err
+}
+
+func (store *PGStore) UniqueVisitors(ctx context.Context, id string, from, to time.Time) (int64, error) {
+	rows, err := store.db.QueryContext(ctx, `
+	SELECT sketch
+	FROM link_visitors
+	WHERE short_id = $1
+		AND day >= $2::date
+		AND day <= $3::date
+	`, id, from.UTC().Format(time.DateOnly), to.UTC().Format(time.DateOnly))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	merged := newHyperLogLog()
+	for rows.Next() {
+		var stored []byte
+		if err := rows.Scan(&stored); err != nil {
+			return 0, err
+		}
+		sketch, err := hllFromBytes(stored)
+		if err != nil {
+			return 0, err
+		}
+		merged.merge(sketch)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	return merged.estimate(), nil
+}
+
+func (store *PGStore) ClickCounts(ctx context.Context, id string, from, to time.Time, bucket Bucket) ([]ClickCount, error) {
+	// bucket is "hour" or "day", which date_trunc takes as is
+	rows, err := store.db.QueryContext(ctx, `
+	SELECT date_trunc($2, clicked_at AT TIME ZONE 'UTC') AS bucket, COUNT(*)
+	FROM click
+	WHERE short_id = $1
+		AND clicked_at >= $3
+		AND clicked_at < $4
+	GROUP BY bucket
+	ORDER BY bucket
+	`, id, string(bucket), from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []ClickCount
+	for rows.Next() {
+		var count ClickCount
+		if err := rows.Scan(&count.Start, &count.Clicks); err != nil {
+			return nil, err
+		}
+		count.Start = count.Start.UTC()
+		counts = append(counts, count)
+	}
+
+	return counts, rows.Err()
+}
+
+func (store *PGStore) ClickBreakdown(ctx context.Context, id string, from, to time.Time, limit int) (Breakdown, error) {
+	// One scan, grouped four ways: in each grouping set only that column is non-NULL.
+	// Each dimension keeps its top $4 values, except agent_class, which the totals are counted from.
+	// Ties are broken by name, byte by byte like Go's string comparison, so the values cut off at
+	// the limit are the same ones MemStore (and topEntries) would cut
+	rows, err := store.db.QueryContext(ctx, `
+	SELECT dimension, value, clicks
+	FROM (
+		SELECT
+			CASE
+				WHEN GROUPING(referrer_host) = 0 THEN 'referrer'
+				WHEN GROUPING(browser) = 0 THEN 'browser'
+				WHEN GROUPING(os) = 0 THEN 'os'
+				ELSE 'agent'
+			END AS dimension,
+			COALESCE(referrer_host, browser, os, agent_class) AS value,
+			COUNT(*) AS clicks,
+			ROW_NUMBER() OVER (
+				PARTITION BY GROUPING(referrer_host), GROUPING(browser), GROUPING(os)
+				ORDER BY COUNT(*) DESC, COALESCE(referrer_host, browser, os, agent_class) COLLATE "C"
+			) AS rank
+		FROM click
+		WHERE short_id = $1
+			AND clicked_at >= $2
+			AND clicked_at < $3
+		GROUP BY GROUPING SETS ((referrer_host), (browser), (os), (agent_class))
+	) AS grouped
+	WHERE rank <= $4 OR dimension = 'agent'
+	ORDER BY dimension, clicks DESC, value COLLATE "C"
+	`, id, from, to, limit)
+	if err != nil {
+		return Breakdown{}, err
+	}
+	defer rows.Close()
+
+	counts := newBreakdownCounts()
+	for rows.Next() {
+		var dimension, value string
+		var n int64
+		if err := rows.Scan(&dimension, &value, &n); err != nil {
+			return Breakdown{}, err
+		}
+
+		switch dimension {
+		case "referrer":
+			counts.referrers[value] = n
+		case "browser":
+			counts.browsers[value] = n
+		case "os":
+			counts.oses[value] = n
+		case "agent":
+			counts.agents[value] = n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return Breakdown{}, err
+	}
+
+	return counts.breakdown(limit), nil
+}
+
+func (store *PGStore) Update(ctx context.Context, id string, url string, events ...EventType) (ShortLink, error) {
+	var link ShortLink
+	err := store.withEvents(ctx, events, func(q querier) ([]ShortLink, error) {
+		// an edited link stops being canonical: the URL it was made for is gone, and the new URL
+		// may already have a canonical link of its own
+		var err error
+		link, err = scanLink(q.QueryRowContext(ctx, `
+		UPDATE link
+		SET original_url = $2, url_key = $3, canonical = false
+		WHERE short_id = $1 AND deleted_at IS NULL
+		RETURNING `+linkColumns, id, url, normalizeURL(url)))
+		return []ShortLink{link}, err
+	})
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ShortLink{}, store.whyNoRows(ctx, id, time.Now())
+		}
+		return ShortLink{}, err
+	}
+
+	return link, nil
+}
+
+func (store *PGStore) Delete(ctx context.Context, id string, events ...EventType) error {
+	err := store.withEvents(ctx, events, func(q querier) ([]ShortLink, error) {
+		link, err := scanLink(q.QueryRowContext(ctx, `
+		UPDATE link
+		SET deleted_at = NOW()
+		WHERE short_id = $1 AND deleted_at IS NULL
+		RETURNING `+linkColumns, id))
+		return []ShortLink{link}, err
+	})
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return store.whyNoRows(ctx, id, time.Now())
+	}
+	return err
+}
+
+// whyNoRows is called when a conditional UPDATE matched nothing, to tell the caller
+// whether the link doesn't exist at all or exists but was filtered out (deleted, expired, used up)
+func (store *PGStore) whyNoRows(ctx context.Context, id string, now time.Time) error {
+	link, err := store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := link.checkActive(now); err != nil {
+		return err
+	}
+
+	// the row changed between our UPDATE and this read
+	return fmt.Errorf("link %q was modified concurrently, try again", id)
+}
+
+func (store *PGStore) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	result, err := store.db.ExecContext(ctx, `
+	DELETE FROM link
+	WHERE expires_at IS NOT NULL AND expires_at < $1
+	`, before)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// linkCounter is the id_counter row the link ID generators allocate from
+const linkCounter = "link"
+
+func (store *PGStore) AllocateBlock(ctx context.Context, size uint64) (uint64, error) {
+	// the UPDATE takes a row lock, so concurrent allocations (from any replica) queue up
+	// and each one gets its own range
+	var end uint64
+
+	err := store.db.QueryRowContext(ctx, `
+	UPDATE id_counter
+	SET value = value + $2
+	WHERE name = $1
+	RETURNING value
+	`, linkCounter, int64(size)).Scan(&end)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("id counter %q not found, have the migrations been run?", linkCounter)
+		}
+		return 0, err
+	}
+
+	return end - size + 1, nil
+}
+
+func (store *PGStore) ReserveIdempotencyKey(ctx context.Context, rec IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	// Insert the reservation, or take over the row if the old record has expired.
+	// If a live record is in the way nothing is returned, and we read that record instead.
+	var key string
+	err := store.db.QueryRowContext(ctx, `
+	INSERT INTO idempotency_key (key, fingerprint, created_at, expires_at)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (key) DO UPDATE
+	SET fingerprint = EXCLUDED.fingerprint,
+		status = NULL,
+		body = NULL,
+		created_at = EXCLUDED.created_at,
+		expires_at = EXCLUDED.expires_at
+	WHERE idempotency_key.expires_at <= EXCLUDED.created_at
+	RETURNING key
+	`, rec.Key, rec.Fingerprint, rec.CreatedAt, rec.ExpiresAt).Scan(&key)
+
+	if err == nil {
+		return rec, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return IdempotencyRecord{}, false, err
+	}
+
+	var existing IdempotencyRecord
+	var status sql.NullInt64
+
+	err = store.db.QueryRowContext(ctx, `
+	SELECT key, fingerprint, status, body, created_at, expires_at
+	FROM idempotency_key
+	WHERE key = $1
+	`, rec.Key).Scan(
+		&existing.Key,
+		&existing.Fingerprint,
+		&status,
+		&existing.Body,
+		&existing.CreatedAt,
+		&existing.ExpiresAt,
+	)
+	if err != nil {
+		// the row was released between the two statements; the client can just retry
+		return IdempotencyRecord{}, false, err
+	}
+	existing.Status = int(status.Int64)
+
+	return existing, false, nil
+}
+
+func (store *PGStore) CompleteIdempotencyKey(ctx context.Context, key string, status int, body []byte) error {
+	result, err := store.db.ExecContext(ctx, `
+	UPDATE idempotency_key
+	SET status = $2, body = $3
+	WHERE key = $1
+	`, key, status, body)
+
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (store *PGStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	_, err := store.db.ExecContext(ctx, `
+	DELETE FROM idempotency_key
+	WHERE key = $1
+	`, key)
+
+	return err
+}
+
+func (store *PGStore) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int64, error) {
+	result, err := store.db.ExecContext(ctx, `
+	DELETE FROM idempotency_key
+	WHERE expires_at < $1
+	`, before)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (store *PGStore) SaveWebhook(ctx context.Context, hook Webhook) error {
+	events := make([]string, len(hook.Events))
+	for i, event := range hook.Events {
+		events[i] = string(event)
+	}
+
+	_, err := store.db.ExecContext(ctx, `
+	INSERT INTO webhook (id, url, secret, events, created_at)
+	VALUES ($1, $2, $3, $4, $5)
+	`, hook.ID, hook.URL, hook.Secret, pq.Array(events), hook.CreatedAt)
+
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return ErrDuplicateID
+	}
+	return err
+}
+
+func (store *PGStore) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	rows, err := store.db.QueryContext(ctx, `
+	SELECT id, url, secret, events, created_at
+	FROM webhook
+	ORDER BY created_at, id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		var hook Webhook
+		var events []string
+		if err := rows.Scan(&hook.ID, &hook.URL, &hook.Secret, pq.Array(&events), &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			hook.Events = append(hook.Events, EventType(event))
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, rows.Err()
+}
+
+func (store *PGStore) DeleteWebhook(ctx context.Context, id string) error {
+	// pending deliveries go with it (ON DELETE CASCADE)
+	result, err := store.db.ExecContext(ctx, `
+	DELETE FROM webhook
+	WHERE id = $1
+	`, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (store *PGStore) EnqueueWebhookEvents(ctx context.Context, events []WebhookEvent) error {
+	return enqueueWebhookEvents(ctx, store.db, events)
+}
+
+func enqueueWebhookEvents(ctx context.Context, q querier, events []WebhookEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(events))
+	types := make([]string, len(events))
+	payloads := make([]string, len(events))
+	for i, ev := range events {
+		ids[i] = ev.ID
+		types[i] = string(ev.Type)
+		payloads[i] = string(ev.Payload)
+	}
+
+	// the matching happens here, so an event reaches webhooks created by any replica
+	_, err := q.ExecContext(ctx, `
+	INSERT INTO webhook_delivery (webhook_id, event_id, event_type, payload, next_attempt_at)
+	SELECT webhook.id, e.id, e.type, e.payload, now()
+	FROM unnest($1::text[], $2::text[], $3::text[]) WITH ORDINALITY AS e(id, type, payload, n)
+	JOIN webhook ON webhook.events = '{}' OR e.type = ANY (webhook.events)
+	ORDER BY e.n
+	`, pq.Array(ids), pq.Array(types), pq.Array(payloads))
+	return err
+}
+
+func (store *PGStore) ClaimWebhookDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	// SKIP LOCKED lets every replica claim a different batch instead of queueing up behind one another
+	rows, err := store.db.QueryContext(ctx, `
+	WITH due AS (
+		SELECT id
+		FROM webhook_delivery
+		WHERE next_attempt_at <= $1
+		ORDER BY next_attempt_at, id
+		LIMIT $3
+		FOR UPDATE SKIP LOCKED
+	), claimed AS (
+		UPDATE webhook_delivery AS d
+		SET next_attempt_at = $2
+		FROM due
+		WHERE d.id = due.id
+		RETURNING d.id, d.webhook_id, d.event_id, d.event_type, d.payload, d.attempts
+	)
+	SELECT claimed.id, claimed.webhook_id, webhook.url, webhook.secret,
+		claimed.event_id, claimed.event_type, claimed.payload, claimed.attempts
+	FROM claimed
+	JOIN webhook ON webhook.id = claimed.webhook_id
+	ORDER BY claimed.id
+	`, now, now.Add(lease), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var payload string
+		err := rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.URL, &delivery.Secret, &delivery.EventID, &delivery.EventType, &payload, &delivery.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		delivery.Payload = []byte(payload)
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+func (store *PGStore) RetryWebhookDelivery(ctx context.Context, id int64, next time.Time, lastError string) error {
+	_, err := store.db.ExecContext(ctx, `
+	UPDATE webhook_delivery
+	SET attempts = attempts + 1, next_attempt_at = $2, last_error = $3
+	WHERE id = $1
+	`, id, next, lastError)
+	return err
+}
+
+func (store *PGStore) DeleteWebhookDelivery(ctx context.Context, id int64) error {
+	_, err := store.db.ExecContext(ctx, `
+	DELETE FROM webhook_delivery
+	WHERE id = $1
+	`, id)
+	return err
+}
+
+
+func (store *PGStore) SaveAPIKey(ctx context.Context, key shared.APIKey) error {
+	scopes := make([]string, len(key.Scopes))
+	for i, scope := range key.Scopes {
+		scopes[i] = string(scope)
+	}
+
+	_, err := store.db.ExecContext(ctx, `
+	INSERT INTO api_key (id, name, owner, hash, scopes, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	`, key.ID, key.Name, key.Owner, key.Hash, pq.Array(scopes), key.CreatedAt)
+
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return ErrDuplicateID
+	}
+	return err
+}
+
+// apiKeyColumns is the column list every API key query selects, in the order scanAPIKey expects
+const apiKeyColumns = `id, name, owner, hash, scopes, created_at, last_used_at, revoked_at`
+
+func scanAPIKey(row rowScanner) (shared.APIKey, error) {
+	var key shared.APIKey
+	var scopes []string
+	var lastUsedAt, revokedAt sql.NullTime
+
+	err := row.Scan(&key.ID, &key.Name, &key.Owner, &key.Hash, pq.Array(&scopes), &key.CreatedAt, &lastUsedAt, &revokedAt)
+	if err != nil {
+		return shared.APIKey{}, err
+	}
+
+	for _, scope := range scopes {
+		key.Scopes = append(key.Scopes, shared.Scope(scope))
+	}
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, nil
+}
+
+func (store *PGStore) FindAPIKey(ctx context.Context, hash string) (shared.APIKey, error) {
+	row := store.db.QueryRowContext(ctx, `
+	SELECT `+apiKeyColumns+`
+	FROM api_key
+	WHERE hash = $1
+	`, hash)
+
+	key, err := scanAPIKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return shared.APIKey{}, shared.ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (store *PGStore) ListAPIKeys(ctx context.Context) ([]shared.APIKey, error) {
+	rows, err := store.db.QueryContext(ctx, `
+	SELECT `+apiKeyColumns+`
+	FROM api_key
+	ORDER BY created_at, id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []shared.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (store *PGStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	// revoking twice keeps the first time
+	result, err := store.db.ExecContext(ctx, `
+	UPDATE api_key
+	SET revoked_at = COALESCE(revoked_at, $2)
+	WHERE id = $1
+	`, id, at)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return shared.ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (store *PGStore) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	_, err := store.db.ExecContext(ctx, `
+	UPDATE api_key
+	SET last_used_at = GREATEST(last_used_at, $2)
+	WHERE id = $1
+	`, id, at)
+	return err
+}
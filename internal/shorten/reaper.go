@@ -0,0 +1,107 @@
+package shorten
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Reaper periodically purges expired links from the store.
+//
+// Links aren't removed the moment they expire: they're kept for a retention period first,
+// so during that window a redirect still says "expired" (410) rather than "not found" (404),
+// and the short ID can't be handed out again straight away.
+type Reaper struct {
+	store     Store
+	interval  time.Duration
+	retention time.Duration
+
+	idempotency IdempotencyStore // optional, see PurgeIdempotencyKeys
+
+	webhooks *WebhookDispatcher // optional, see NotifyExpired
+}
+
+func NewReaper(store Store, interval time.Duration, retention time.Duration) *Reaper {
+	return &Reaper{
+		store:     store,
+		interval:  interval,
+		retention: retention,
+	}
+}
+
+// PurgeIdempotencyKeys makes the reaper also remove expired Idempotency-Key records from keys.
+// Call it before Run
+func (r *Reaper) PurgeIdempotencyKeys(keys IdempotencyStore) {
+	r.idempotency = keys
+}
+
+// NotifyExpired makes the reaper queue a link.expired event for each link that expires, within an
+// interval of it expiring. Without it, expiries are still claimed (see Store.ClaimExpired), just not
+// reported, so turning webhooks on later doesn't announce every link that expired meanwhile.
+// Call it before Run
+func (r *Reaper) NotifyExpired(webhooks *WebhookDispatcher) {
+	r.webhooks = webhooks
+}
+
+// Run reaps once every interval until ctx is cancelled. It's meant to be run in its own goroutine.
+func (r *Reaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// reported first, so a link that's been expired longer than the retention
+			// (say no reaper ran for a while) still gets its event before it's purged
+			if err := r.ReportExpired(ctx, now); err != nil {
+				log.Printf("reaper: report expired links: %v", err)
+			}
+
+			n, err := r.Reap(ctx, now)
+			if err != nil {
+				log.Printf("reaper: purge expired links: %v", err)
+			} else if n > 0 {
+				log.Printf("reaper: purged %d expired links", n)
+			}
+
+			if r.idempotency != nil {
+				if _, err := r.idempotency.DeleteExpiredIdempotencyKeys(ctx, now); err != nil {
+					log.Printf("reaper: purge expired idempotency keys: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// Reap purges every link that expired more than the retention period before now
+func (r *Reaper) Reap(ctx context.Context, now time.Time) (int64, error) {
+	return r.store.DeleteExpired(ctx, now.Add(-r.retention))
+}
+
+// how many expired links ReportExpired claims per transaction
+const expiredReportBatch = 1000
+
+// ReportExpired claims every link that has expired by now and hasn't been reported, queueing a
+// link.expired event for each if NotifyExpired was called
+func (r *Reaper) ReportExpired(ctx context.Context, now time.Time) error {
+	var events []EventType
+	if r.webhooks != nil {
+		events = []EventType{EventLinkExpired}
+	}
+
+	for {
+		links, err := r.store.ClaimExpired(ctx, now, expiredReportBatch, events...)
+		if err != nil {
+			return err
+		}
+
+		if len(links) > 0 && r.webhooks != nil {
+			r.webhooks.nudge()
+		}
+		if len(links) < expiredReportBatch {
+			return nil
+		}
+	}
+}
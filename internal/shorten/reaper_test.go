@@ -0,0 +1,56 @@
+package shorten
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReaper_Reap(t *testing.T) {
+	store := NewMemStore()
+	now := time.Now()
+
+	longExpired := newTestData("old", "https://example.com/old")
+	longExpired.ExpiresAt = timePtr(now.Add(-2 * time.Hour))
+
+	justExpired := newTestData("recent", "https://example.com/recent")
+	justExpired.ExpiresAt = timePtr(now.Add(-time.Minute))
+
+	live := newTestData("live", "https://example.com/live")
+	live.ExpiresAt = timePtr(now.Add(time.Hour))
+
+	forever := newTestData("forever", "https://example.com/forever")
+
+	for _, link := range []ShortLink{longExpired, justExpired, live, forever} {
+		if err := store.Save(context.Background(), link); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+	}
+
+	reaper := NewReaper(store, time.Minute, time.Hour)
+
+	n, err := reaper.Reap(context.Background(), now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n != 1 {
+		t.Fatalf("expected 1 link purged, got %d", n)
+	}
+
+	if _, err := store.Get(context.Background(), "old"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected link past retention to be purged, got %v", err)
+	}
+
+	// still inside the retention window, and never-expiring links are left alone
+	for _, id := range []string{"recent", "live", "forever"} {
+		if _, err := store.Get(context.Background(), id); err != nil {
+			t.Fatalf("expected %q to be kept, got %v", id, err)
+		}
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
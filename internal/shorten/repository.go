@@ -1,15 +1,64 @@
 package shorten
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 var (
 	ErrDuplicateID = errors.New("duplicate short id")
+	ErrDuplicateURL = errors.New("owner already has a canonical link for this url")
 	ErrNotFound = errors.New("link not found")
+	ErrDeleted = errors.New("link has been deleted")
+	ErrExpired = errors.New("link has expired")
+	ErrHitLimitReached = errors.New("link has reached its maximum number of hits")
 )
 
+// HitCount is a number of redirects to count against a link, split into people and bots
+type HitCount struct {
+	Hits    int64
+	BotHits int64
+}
+
+// Every Store method takes a context so a query can be abandoned when the client goes away,
+// the server shuts down, or the caller's deadline passes.
+//
+// The methods that change a link take the webhook events it should raise. The store queues them
+// in the outbox (see WebhookStore) in the same transaction as the change: both happen or neither does.
 type Store interface {
-	Save(link ShortLink) error
-	Get(id string) (ShortLink, error)
-	// List() []ShortLink
-	IncrementHits(id string) error
+	// Save adds a new link: ErrDuplicateID if its ID is taken, and ErrDuplicateURL if it's
+	// Canonical and its owner already has a reusable canonical link for the same URL
+	Save(ctx context.Context, link ShortLink, events ...EventType) error
+	// SaveMany saves several links in one go. The returned slice has an error (or nil) for
+	// each link, in order: ErrDuplicateID or ErrDuplicateURL, like Save.
+	// The second return value is for failures that affect the whole call.
+	// Events are only queued for the links that were saved
+	SaveMany(ctx context.Context, links []ShortLink, events ...EventType) ([]error, error)
+	Get(ctx context.Context, id string) (ShortLink, error)
+	// FindByURL returns the reusable link (see ShortLink.reusable) of the given owner whose URL
+	// normalizes to the same thing as url: the canonical one if there is one, else the oldest.
+	// ErrNotFound if there's none
+	FindByURL(ctx context.Context, url string, owner string) (ShortLink, error)
+	// List returns up to opts.Limit links in opts.Sort order, starting after opts.After
+	List(ctx context.Context, opts ListOptions) ([]ShortLink, error)
+	// ClaimExpired marks up to limit links, other than deleted ones, that expired by now and haven't
+	// been claimed before, and returns them. Each expiry is only ever claimed once, by one caller
+	ClaimExpired(ctx context.Context, now time.Time, limit int, events ...EventType) ([]ShortLink, error)
+	IncrementHits(ctx context.Context, id string) error
+	// AddHits adds counts[id] to the hits and bot hits of each link in one go.
+	// IDs that no longer exist are skipped
+	AddHits(ctx context.Context, counts map[string]HitCount) error
+	// Hit atomically checks that the link can be followed at the given time (not deleted,
+	// not expired, under its MaxHits) and, if so, increments its hits and returns the updated link.
+	// The check and the increment must not be separable, or concurrent clicks could overshoot MaxHits
+	Hit(ctx context.Context, id string, now time.Time) (ShortLink, error)
+	// Update changes the target URL of a link that hasn't been deleted
+	Update(ctx context.Context, id string, url string, events ...EventType) (ShortLink, error)
+	// Delete soft-deletes a link: it stays in the store (so its ID is never reused)
+	// but Get reports it with DeletedAt set. The events carry the link as it was deleted
+	Delete(ctx context.Context, id string, events ...EventType) error
+	// DeleteExpired permanently removes links that expired before the given time
+	// and returns how many were removed
+	DeleteExpired(ctx context.Context, before time.Time) (int64, error)
 }
@@ -1,8 +1,10 @@
 package shorten
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -24,11 +26,11 @@ func TestMemStore_SaveGetList(t *testing.T) {
 	link := newTestData("abc123", "https://example.com")
 
 	t.Run("save and get", func(t *testing.T) {
-		if err := store.Save(link); err != nil {
+		if err := store.Save(context.Background(), link); err != nil {
 			t.Fatalf("unexpected error on save: %v", err)
 		}
 
-		gotLink, err := store.Get(link.ID)
+		gotLink, err := store.Get(context.Background(), link.ID)
 		if err != nil {
 			if errors.Is(err, ErrNotFound) {
 				t.Fatal("expected id to exist")
@@ -54,24 +56,168 @@ func TestMemStore_SaveGetList(t *testing.T) {
 		}
 	})
 
-	// t.Run("list", func(t *testing.T) {
-	// 	store := NewMemStore()
-	// 	link1 := newTestData("a", "url1")
-	// 	link2 := newTestData("b", "url2")
+	t.Run("list", func(t *testing.T) {
+		store := NewMemStore()
+		now := time.Now()
 
-	// 	if err := store.Save(link1); err != nil {
-	// 		t.Fatalf("unexpected error on save: %v", err)
-	// 	}
+		link1 := newTestData("a", "url1")
+		link1.CreatedAt = now.Add(-2 * time.Minute)
+		link1.Hits = 5
 
-	// 	if err := store.Save(link2); err != nil {
-	// 		t.Fatalf("unexpected error on save: %v", err)
-	// 	}
+		link2 := newTestData("b", "url2")
+		link2.CreatedAt = now.Add(-1 * time.Minute)
+		link2.Hits = 1
 
-	// 	links := store.List()
-	// 	if len(links) != 2 {
-	// 		t.Fatalf("expected 2 items, got %d", len(links))
-	// 	}
-	// })
+		link3 := newTestData("c", "url3")
+		link3.CreatedAt = now
+		link3.Hits = 3
+
+		for _, link := range []ShortLink{link1, link2, link3} {
+			if err := store.Save(context.Background(), link); err != nil {
+				t.Fatalf("unexpected error on save: %v", err)
+			}
+		}
+
+		links, err := store.List(context.Background(), ListOptions{Sort: SortCreatedAt, Limit: 10})
+		if err != nil {
+			t.Fatalf("unexpected error on list: %v", err)
+		}
+		if got := linkIDs(links); got != "c,b,a" {
+			t.Fatalf("expected newest first [c,b,a], got [%s]", got)
+		}
+
+		links, err = store.List(context.Background(), ListOptions{Sort: SortHits, Limit: 2})
+		if err != nil {
+			t.Fatalf("unexpected error on list: %v", err)
+		}
+		if got := linkIDs(links); got != "a,c" {
+			t.Fatalf("expected most hits first [a,c], got [%s]", got)
+		}
+
+		after := cursorFor(SortCreatedAt, link2)
+		links, err = store.List(context.Background(), ListOptions{Sort: SortCreatedAt, After: &after, Limit: 10})
+		if err != nil {
+			t.Fatalf("unexpected error on list: %v", err)
+		}
+		if got := linkIDs(links); got != "a" {
+			t.Fatalf("expected [a] after cursor, got [%s]", got)
+		}
+	})
+}
+
+func TestMemStore_Owners(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+
+	for i, owner := range []string{"marketing", "sales", "marketing"} {
+		link := newTestData(fmt.Sprintf("link%d", i), "https://example.com")
+		link.Owner = owner
+		if err := store.Save(ctx, link); err != nil {
+			t.Fatalf("unexpected error on save: %v", err)
+		}
+	}
+
+	t.Run("List by owner", func(t *testing.T) {
+		owner := "marketing"
+		links, err := store.List(ctx, ListOptions{Sort: SortCreatedAt, Limit: 10, Owner: &owner})
+		if err != nil {
+			t.Fatalf("unexpected error on list: %v", err)
+		}
+		if len(links) != 2 {
+			t.Fatalf("expected marketing's 2 links, got [%s]", linkIDs(links))
+		}
+		for _, link := range links {
+			if link.Owner != owner {
+				t.Fatalf("expected only %s's links, got %+v", owner, link)
+			}
+		}
+
+		links, err = store.List(ctx, ListOptions{Sort: SortCreatedAt, Limit: 10})
+		if err != nil {
+			t.Fatalf("unexpected error on list: %v", err)
+		}
+		if len(links) != 3 {
+			t.Fatalf("expected every link without an owner, got [%s]", linkIDs(links))
+		}
+	})
+
+	t.Run("FindByURL by owner", func(t *testing.T) {
+		link, err := store.FindByURL(ctx, "https://example.com", "sales")
+		if err != nil || link.ID != "link1" {
+			t.Fatalf("expected sales' link1, got %q (%v)", link.ID, err)
+		}
+		if _, err := store.FindByURL(ctx, "https://example.com", "support"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound for an owner without links, got %v", err)
+		}
+	})
+}
+
+func TestMemStore_CanonicalURLs(t *testing.T) {
+	ctx := context.Background()
+
+	canonical := func(id, url, owner string) ShortLink {
+		link := newTestData(id, url)
+		link.Owner = owner
+		link.Canonical = true
+		return link
+	}
+
+	store := NewMemStore()
+	if err := store.Save(ctx, canonical("first", "https://example.com", "marketing")); err != nil {
+		t.Fatalf("unexpected error on save: %v", err)
+	}
+
+	t.Run("One per owner and URL", func(t *testing.T) {
+		if err := store.Save(ctx, canonical("second", "https://EXAMPLE.com", "marketing")); !errors.Is(err, ErrDuplicateURL) {
+			t.Fatalf("expected ErrDuplicateURL, got %v", err)
+		}
+		if err := store.Save(ctx, canonical("sales", "https://example.com", "sales")); err != nil {
+			t.Fatalf("expected another owner to have their own, got %v", err)
+		}
+		if err := store.Save(ctx, newTestData("plain", "https://example.com")); err != nil {
+			t.Fatalf("expected links that aren't canonical to repeat URLs, got %v", err)
+		}
+
+		errs, err := store.SaveMany(ctx, []ShortLink{canonical("third", "https://example.com", "marketing")})
+		if err != nil || !errors.Is(errs[0], ErrDuplicateURL) {
+			t.Fatalf("expected ErrDuplicateURL from SaveMany, got %v (%v)", errs, err)
+		}
+	})
+
+	t.Run("Deleting frees the URL", func(t *testing.T) {
+		if err := store.Delete(ctx, "first"); err != nil {
+			t.Fatalf("unexpected error on delete: %v", err)
+		}
+		if err := store.Save(ctx, canonical("second", "https://example.com", "marketing")); err != nil {
+			t.Fatalf("expected a new canonical link, got %v", err)
+		}
+	})
+
+	t.Run("Updating stops a link being canonical", func(t *testing.T) {
+		link, err := store.Update(ctx, "second", "https://example.org")
+		if err != nil || link.Canonical {
+			t.Fatalf("expected a link that isn't canonical, got %+v (%v)", link, err)
+		}
+		if err := store.Save(ctx, canonical("third", "https://example.com", "marketing")); err != nil {
+			t.Fatalf("expected a new canonical link, got %v", err)
+		}
+	})
+
+	t.Run("FindByURL prefers the canonical link", func(t *testing.T) {
+		older := newTestData("older", "https://example.net")
+		older.Owner = "ops"
+		if err := store.Save(ctx, older); err != nil {
+			t.Fatalf("unexpected error on save: %v", err)
+		}
+		if err := store.Save(ctx, canonical("newer", "https://example.net", "ops")); err != nil {
+			t.Fatalf("unexpected error on save: %v", err)
+		}
+
+		link, err := store.FindByURL(ctx, "https://example.net", "ops")
+		if err != nil || link.ID != "newer" {
+			t.Fatalf("expected the canonical link newer, got %q (%v)", link.ID, err)
+		}
+	})
 }
 
 func TestMemStore_ConcurrentSaveGet(t *testing.T) {
@@ -86,15 +232,132 @@ func TestMemStore_ConcurrentSaveGet(t *testing.T) {
 		go func(i int) {
 			defer wg.Done()
 			id := fmt.Sprintf("id%d", i)
-			store.Save(newTestData(id, "url"))
+			store.Save(context.Background(), newTestData(id, "url"))
 		}(i)
 
 		go func(i int) {
 			defer wg.Done()
 			id := fmt.Sprintf("id%d", i)
-			store.Get(id)
+			store.Get(context.Background(), id)
 		}(i)
 	}
 
 	wg.Wait()
 }
+
+func linkIDs(links []ShortLink) string {
+	ids := make([]string, 0, len(links))
+	for _, link := range links {
+		ids = append(ids, link.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestMemStore_UpdateDelete(t *testing.T) {
+	store := NewMemStore()
+	link := newTestData("abc123", "https://example.com")
+
+	if err := store.Save(context.Background(), link); err != nil {
+		t.Fatalf("unexpected error on save: %v", err)
+	}
+
+	t.Run("update", func(t *testing.T) {
+		updated, err := store.Update(context.Background(), link.ID, "https://example.org")
+		if err != nil {
+			t.Fatalf("unexpected error on update: %v", err)
+		}
+
+		if updated.URL != "https://example.org" {
+			t.Fatalf("expected url %q, got %q", "https://example.org", updated.URL)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := store.Delete(context.Background(), link.ID); err != nil {
+			t.Fatalf("unexpected error on delete: %v", err)
+		}
+
+		got, err := store.Get(context.Background(), link.ID)
+		if err != nil {
+			t.Fatalf("expected soft-deleted link to still be readable, got %v", err)
+		}
+		if got.DeletedAt == nil {
+			t.Fatal("expected DeletedAt to be set")
+		}
+
+		if err := store.Delete(context.Background(), link.ID); !errors.Is(err, ErrDeleted) {
+			t.Fatalf("expected ErrDeleted on second delete, got %v", err)
+		}
+		if _, err := store.Update(context.Background(), link.ID, "https://example.net"); !errors.Is(err, ErrDeleted) {
+			t.Fatalf("expected ErrDeleted on update after delete, got %v", err)
+		}
+		if err := store.Save(context.Background(), link); !errors.Is(err, ErrDuplicateID) {
+			t.Fatalf("expected deleted id not to be reusable, got %v", err)
+		}
+
+		links, err := store.List(context.Background(), ListOptions{Sort: SortCreatedAt, Limit: 10})
+		if err != nil {
+			t.Fatalf("unexpected error on list: %v", err)
+		}
+		if len(links) != 0 {
+			t.Fatalf("expected deleted link to be excluded from list, got %d links", len(links))
+		}
+	})
+
+	t.Run("missing id", func(t *testing.T) {
+		if _, err := store.Update(context.Background(), "nope", "https://example.com"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+		if err := store.Delete(context.Background(), "nope"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestMemStore_HitRespectsMaxHits(t *testing.T) {
+	store := NewMemStore()
+
+	link := newTestData("once", "https://example.com")
+	link.MaxHits = 5
+	if err := store.Save(context.Background(), link); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	// far more clicks than allowed, all at once; exactly MaxHits of them may succeed
+	const clicks = 100
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		ok int
+	)
+
+	for i := 0; i < clicks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.Hit(context.Background(), link.ID, time.Now())
+			if err == nil {
+				mu.Lock()
+				ok++
+				mu.Unlock()
+				return
+			}
+			if !errors.Is(err, ErrHitLimitReached) {
+				t.Errorf("expected ErrHitLimitReached, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ok != 5 {
+		t.Fatalf("expected exactly 5 successful hits, got %d", ok)
+	}
+
+	got, err := store.Get(context.Background(), link.ID)
+	if err != nil {
+		t.Fatalf("unexpected error on get: %v", err)
+	}
+	if got.Hits != 5 {
+		t.Fatalf("expected hits to stop at 5, got %d", got.Hits)
+	}
+}
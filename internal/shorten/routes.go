@@ -1,11 +1,54 @@
 package shorten
 
-import "net/http"
+import (
+	"net/http"
 
-func RegisterRoutes(mux *http.ServeMux, shortener *Shortener) {
-	handler := NewHandler(shortener)
+	"shortener/internal/shared"
+)
 
-	mux.HandleFunc("POST /shorten", handler.HandleShorten)
-	mux.HandleFunc("GET /stats/", handler.HandleStats)
-	mux.HandleFunc("GET /", handler.HandleRedirect)
-}
\ No newline at end of file
+func RegisterRoutes(mux *http.ServeMux, shortener *Shortener, opts ...HandlerOption) {
+	handler := NewHandler(shortener, opts...)
+
+	limit := func(policy shared.RatePolicy, h http.Handler) http.Handler {
+		if handler.limiter == nil {
+			return h
+		}
+		return shared.RateLimit(handler.limiter, policy)(h)
+	}
+
+	// without API keys every endpoint is open, as in tests and local development.
+	// Keys are checked before the rate limit, so each key gets its own allowance; requests
+	// that fail the check are limited per IP by the KeyAuth itself (see LimitFailures)
+	guard := func(scope shared.Scope, policy shared.RatePolicy, h http.HandlerFunc) http.Handler {
+		limited := limit(policy, h)
+		if handler.keys == nil {
+			return limited
+		}
+		return handler.keys.Require(scope)(limited)
+	}
+
+	create, read, admin := handler.limits.Create, handler.limits.Read, handler.limits.Admin
+	redirect := limit(handler.limits.Redirect, http.HandlerFunc(handler.HandleRedirect))
+
+	mux.Handle("POST /shorten", guard(shared.ScopeCreate, create, handler.idempotent(handler.HandleShorten)))
+	mux.Handle("POST /shorten/batch", guard(shared.ScopeCreate, create, handler.idempotent(handler.HandleShortenBatch)))
+	mux.Handle("GET /stats/", guard(shared.ScopeReadStats, read, handler.HandleStats))
+	mux.Handle("GET /stats/{id}/timeseries", guard(shared.ScopeReadStats, read, handler.HandleTimeseries))
+	mux.Handle("GET /stats/{id}/breakdown", guard(shared.ScopeReadStats, read, handler.HandleBreakdown))
+	mux.Handle("GET /stats/{id}/live", guard(shared.ScopeReadStats, read, handler.HandleLive))
+	mux.Handle("GET /links", guard(shared.ScopeReadStats, read, handler.HandleList))
+	mux.Handle("PATCH /links/{id}", guard(shared.ScopeCreate, create, handler.HandleUpdate))
+	mux.Handle("DELETE /links/{id}", guard(shared.ScopeCreate, create, handler.HandleDelete))
+	mux.Handle("GET /", redirect) // HEAD too
+	mux.Handle("OPTIONS /", redirect)
+
+	if handler.keys != nil {
+		mux.Handle("GET /admin/live", guard(shared.ScopeAdmin, admin, handler.HandleLiveAll))
+		mux.Handle("POST /admin/webhooks", guard(shared.ScopeAdmin, admin, handler.HandleCreateWebhook))
+		mux.Handle("GET /admin/webhooks", guard(shared.ScopeAdmin, admin, handler.HandleListWebhooks))
+		mux.Handle("DELETE /admin/webhooks/{id}", guard(shared.ScopeAdmin, admin, handler.HandleDeleteWebhook))
+		mux.Handle("POST /admin/keys", guard(shared.ScopeAdmin, admin, handler.HandleCreateAPIKey))
+		mux.Handle("GET /admin/keys", guard(shared.ScopeAdmin, admin, handler.HandleListAPIKeys))
+		mux.Handle("DELETE /admin/keys/{id}", guard(shared.ScopeAdmin, admin, handler.HandleRevokeAPIKey))
+	}
+}
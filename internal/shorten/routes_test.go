@@ -0,0 +1,314 @@
+package shorten
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"shortener/internal/shared"
+)
+
+func TestRegisterRoutes_APIKeys(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewMemStore()
+	shortener := NewShortener(store, NewBase62Generator())
+	keys := shared.NewKeyAuth(store)
+	adminKey, _, _ := keys.Mint(ctx, "admin", "", []shared.Scope{shared.ScopeAdmin})
+
+	mux := http.NewServeMux()
+	RegisterRoutes(mux, shortener, WithAPIKeys(keys))
+
+	serve := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// admins mint the other keys
+	mint := func(body string) apiKeyResponse {
+		t.Helper()
+
+		w := serve(http.MethodPost, "/admin/keys", adminKey, body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+		}
+		var resp apiKeyResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return resp
+	}
+	creator := mint(`{"name":"ci","scopes":["create"]}`)
+	reader := mint(`{"name":"dashboard","owner":"ci","scopes":["read-stats"]}`)
+	if creator.Key == "" || !strings.HasPrefix(creator.Key, "sk_") {
+		t.Fatalf("expected the secret in the response, got %+v", creator)
+	}
+
+	w := serve(http.MethodPost, "/shorten", creator.Key, `{"url":"https://example.com"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var created shortenResponse
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		method, path string
+		key          string
+		want         int
+	}{
+		{"No key", http.MethodPost, "/shorten", "", http.StatusUnauthorized},
+		{"Reader can't create", http.MethodPost, "/shorten", reader.Key, http.StatusForbidden},
+		{"Creator can't read stats", http.MethodGet, "/stats/" + created.Short, creator.Key, http.StatusForbidden},
+		{"Reader reads stats", http.MethodGet, "/stats/" + created.Short, reader.Key, http.StatusOK},
+		{"Admin reads stats", http.MethodGet, "/stats/" + created.Short, adminKey, http.StatusOK},
+		{"Redirects are public", http.MethodGet, "/" + created.Short, "", http.StatusFound},
+		{"Admin endpoints need admin", http.MethodGet, "/admin/keys", reader.Key, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := ""
+			if tt.method == http.MethodPost {
+				body = `{"url":"https://example.org"}`
+			}
+			if w := serve(tt.method, tt.path, tt.key, body); w.Code != tt.want {
+				t.Fatalf("expected %d, got %d: %s", tt.want, w.Code, w.Body)
+			}
+		})
+	}
+
+	t.Run("Listing and revoking keys", func(t *testing.T) {
+		if w := serve(http.MethodDelete, "/admin/keys/"+reader.ID, adminKey, ""); w.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d", w.Code)
+		}
+		if w := serve(http.MethodGet, "/stats/"+created.Short, reader.Key, ""); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected a revoked key to get 401, got %d", w.Code)
+		}
+		if w := serve(http.MethodDelete, "/admin/keys/missing", adminKey, ""); w.Code != http.StatusNotFound {
+			t.Fatalf("expected 404, got %d", w.Code)
+		}
+
+		w := serve(http.MethodGet, "/admin/keys", adminKey, "")
+		var list apiKeyListResponse
+		if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if len(list.Keys) != 3 {
+			t.Fatalf("expected 3 keys, got %d", len(list.Keys))
+		}
+		for _, key := range list.Keys {
+			if key.Key != "" {
+				t.Fatalf("expected no secrets in the list, got %+v", key)
+			}
+			if key.ID == reader.ID && key.RevokedAt == "" {
+				t.Fatalf("expected %s to be revoked, got %+v", reader.Name, key)
+			}
+			if key.ID == creator.ID && key.LastUsedAt == "" {
+				t.Fatalf("expected %s to have been used, got %+v", creator.Name, key)
+			}
+		}
+	})
+
+	t.Run("Bad key requests", func(t *testing.T) {
+		for _, body := range []string{`{"name":"x","scopes":["root"]}`, `{"name":"","scopes":["create"]}`, `{"name":"x"}`} {
+			if w := serve(http.MethodPost, "/admin/keys", adminKey, body); w.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400 for %s, got %d", body, w.Code)
+			}
+		}
+	})
+}
+
+func TestRegisterRoutes_Owners(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewMemStore()
+	shortener := NewShortener(store, NewBase62Generator(), WithLiveBroker(NewLiveBroker(10)))
+	keys := shared.NewKeyAuth(store)
+	marketing, _, _ := keys.Mint(ctx, "marketing-ci", "marketing", []shared.Scope{shared.ScopeCreate, shared.ScopeReadStats})
+	sales, _, _ := keys.Mint(ctx, "sales-ci", "sales", []shared.Scope{shared.ScopeCreate, shared.ScopeReadStats})
+	admin, _, _ := keys.Mint(ctx, "ops", "", []shared.Scope{shared.ScopeAdmin})
+
+	mux := http.NewServeMux()
+	RegisterRoutes(mux, shortener, WithAPIKeys(keys), WithIdempotency(store, time.Hour))
+
+	serve := func(method, path, key, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", key)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	create := func(key, idempotencyKey string) shortenResponse {
+		t.Helper()
+
+		w := serve(http.MethodPost, "/shorten", key, `{"url":"https://example.com/campaign"}`, "Idempotency-Key", idempotencyKey)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+		}
+		var resp shortenResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return resp
+	}
+
+	campaign := create(marketing, "req-1")
+
+	t.Run("Idempotency keys are per API key", func(t *testing.T) {
+		// the same Idempotency-Key from another team is a different request, not a replay
+		if theirs := create(sales, "req-1"); theirs.Short == campaign.Short {
+			t.Fatalf("expected sales to get their own link, got marketing's %s", campaign.Short)
+		}
+	})
+
+	t.Run("Links are stamped with their owner", func(t *testing.T) {
+		link, err := shortener.Stats(ctx, campaign.Short)
+		if err != nil || link.Owner != "marketing" {
+			t.Fatalf("expected marketing to own %s, got %q (%v)", campaign.Short, link.Owner, err)
+		}
+	})
+
+	t.Run("Other owners' links look missing", func(t *testing.T) {
+		for _, req := range []struct{ method, path, body string }{
+			{http.MethodGet, "/stats/" + campaign.Short, ""},
+			{http.MethodGet, "/stats/" + campaign.Short + "/timeseries", ""},
+			{http.MethodGet, "/stats/" + campaign.Short + "/breakdown", ""},
+			{http.MethodGet, "/stats/" + campaign.Short + "/live", ""},
+			{http.MethodPatch, "/links/" + campaign.Short, `{"url":"https://evil.example"}`},
+			{http.MethodDelete, "/links/" + campaign.Short, ""},
+		} {
+			if w := serve(req.method, req.path, sales, req.body); w.Code != http.StatusNotFound {
+				t.Fatalf("%s %s: expected 404, got %d: %s", req.method, req.path, w.Code, w.Body)
+			}
+		}
+
+		if w := serve(http.MethodGet, "/stats/"+campaign.Short, marketing, ""); w.Code != http.StatusOK {
+			t.Fatalf("expected the owner to see their link, got %d", w.Code)
+		}
+		if url, _ := shortener.Resolve(ctx, campaign.Short); url != "https://example.com/campaign" {
+			t.Fatalf("expected the link to be untouched, got %q", url)
+		}
+	})
+
+	t.Run("Listing only shows the owner's links, except to admins", func(t *testing.T) {
+		list := func(key string) listResponse {
+			t.Helper()
+
+			w := serve(http.MethodGet, "/links", key, "")
+			var resp listResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			return resp
+		}
+
+		if got := list(marketing).Links; len(got) != 1 || got[0].Short != campaign.Short {
+			t.Fatalf("expected only marketing's link, got %+v", got)
+		}
+		if got := list(sales).Links; len(got) != 1 || got[0].Short == campaign.Short {
+			t.Fatalf("expected only sales' link, got %+v", got)
+		}
+		if got := list(admin).Links; len(got) != 2 {
+			t.Fatalf("expected admins to see both links, got %+v", got)
+		}
+	})
+
+	t.Run("Admins manage every link", func(t *testing.T) {
+		if w := serve(http.MethodGet, "/stats/"+campaign.Short, admin, ""); w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		if w := serve(http.MethodDelete, "/links/"+campaign.Short, admin, ""); w.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d", w.Code)
+		}
+		// the owner learns it was deleted; everyone else still just sees nothing
+		if w := serve(http.MethodGet, "/stats/"+campaign.Short, marketing, ""); w.Code != http.StatusGone {
+			t.Fatalf("expected 410 for the owner, got %d", w.Code)
+		}
+		if w := serve(http.MethodGet, "/stats/"+campaign.Short, sales, ""); w.Code != http.StatusNotFound {
+			t.Fatalf("expected 404 for another owner, got %d", w.Code)
+		}
+	})
+}
+
+func TestRegisterRoutes_RateLimits(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewMemStore()
+	shortener := NewShortener(store, NewBase62Generator())
+	link, err := shortener.CreateWithOptions(ctx, "https://example.com", CreateOptions{Owner: "ci"})
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+	keys := shared.NewKeyAuth(store)
+	key, _, _ := keys.Mint(ctx, "ci", "", []shared.Scope{shared.ScopeCreate, shared.ScopeReadStats})
+	limiter := shared.NewRateLimiter(nil)
+	keys.LimitFailures(limiter, shared.RatePolicy{Rate: 1, Burst: 1})
+
+	mux := http.NewServeMux()
+	RegisterRoutes(mux, shortener, WithAPIKeys(keys), WithRateLimits(limiter, RateLimits{
+		Create:   shared.RatePolicy{Rate: 1, Burst: 1},
+		Redirect: shared.RatePolicy{Rate: 1, Burst: 2},
+	}))
+
+	serve := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = "203.0.113.1:1234"
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Redirects are limited per IP", func(t *testing.T) {
+		for range 2 {
+			if w := serve(http.MethodGet, "/"+link.ID, "", ""); w.Code != http.StatusFound {
+				t.Fatalf("expected 302, got %d", w.Code)
+			}
+		}
+		w := serve(http.MethodGet, "/"+link.ID, "", "")
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Fatalf("expected 429 with Retry-After, got %d %v", w.Code, w.Header())
+		}
+	})
+
+	t.Run("Groups are limited separately", func(t *testing.T) {
+		if w := serve(http.MethodPost, "/shorten", key, `{"url":"https://example.org"}`); w.Code != http.StatusCreated {
+			t.Fatalf("expected creating not to be held up by redirects, got %d", w.Code)
+		}
+		if w := serve(http.MethodPost, "/shorten", key, `{"url":"https://example.org"}`); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected 429, got %d", w.Code)
+		}
+		// reading has no policy here
+		for range 3 {
+			if w := serve(http.MethodGet, "/stats/"+link.ID, key, ""); w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", w.Code)
+			}
+		}
+	})
+
+	t.Run("Bad keys are limited per IP", func(t *testing.T) {
+		if w := serve(http.MethodGet, "/links", "sk_wrong", ""); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401, got %d", w.Code)
+		}
+		if w := serve(http.MethodGet, "/links", "sk_wrong", ""); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected 429, got %d", w.Code)
+		}
+	})
+}
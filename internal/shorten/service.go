@@ -1,9 +1,12 @@
 package shorten
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
+	"strings"
 	"time"
 )
 
@@ -11,19 +14,142 @@ import (
 // var ErrNotFound = errors.New("not found")
 var ErrInvalidURL = errors.New("invalid url")
 var ErrTooManyCollisions = errors.New("could not generate unique id, too many collisions")
+var ErrInvalidExpiry = errors.New("invalid expiry")
+var ErrInvalidMaxHits = errors.New("maxHits must be positive")
 
 type Shortener struct {
 	store Store
 	ids   IDGenerator
+
+	maxBatchSize int
+	dedupe       bool
+
+	// per-operation deadlines for store calls; 0 means the caller's context is the only limit
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	hits *HitAggregator // nil counts every redirect in the store straight away
+	bots *BotClassifier
+	live *LiveBroker // nil disables live click streams
+
+	webhooks *WebhookDispatcher // nil disables webhooks
+
+	counts shortenerCounts // for metrics
+
+	clicks *ClickRecorder // nil means redirects aren't recorded as clicks
+}
+
+// Option configures optional Shortener behaviour in NewShortener
+type Option func(*Shortener)
+
+// WithMaxBatchSize caps how many links one CreateBatch call may create
+func WithMaxBatchSize(n int) Option {
+	return func(s *Shortener) {
+		if n > 0 {
+			s.maxBatchSize = n
+		}
+	}
+}
+
+// WithDedupe makes Create hand back the existing link when the same URL (after normalization)
+// has been shortened before, instead of making a new one. Only plain requests are deduplicated:
+// ones with an alias, expiry or hit cap always get a link of their own. Links made this way are
+// Canonical, which the store keeps to one per owner and URL, so concurrent creates share one too.
+func WithDedupe() Option {
+	return func(s *Shortener) {
+		s.dedupe = true
+	}
+}
+
+// WithTimeouts puts a deadline on every store call, so a slow database fails the request quickly
+// instead of holding it (and a connection) open. read covers lookups and redirects, write covers
+// creates, updates and deletes. A zero duration leaves that kind of call without a deadline.
+func WithTimeouts(read, write time.Duration) Option {
+	return func(s *Shortener) {
+		s.readTimeout = read
+		s.writeTimeout = write
+	}
+}
+
+// WithHitAggregator makes Resolve count redirects through hits instead of one store update per click.
+// Links with a MaxHits cap are still counted synchronously, since the cap has to be exact
+func WithHitAggregator(hits *HitAggregator) Option {
+	return func(s *Shortener) {
+		s.hits = hits
+	}
+}
+
+// WithClickRecorder records every successful redirect made through ResolveVisit as a Click,
+// which Timeseries then reports on
+func WithClickRecorder(clicks *ClickRecorder) Option {
+	return func(s *Shortener) {
+		s.clicks = clicks
+	}
+}
+
+// WithLiveBroker publishes every successful redirect made through ResolveVisit to live,
+// for Subscribe and SubscribeAll
+func WithLiveBroker(live *LiveBroker) Option {
+	return func(s *Shortener) {
+		s.live = live
+	}
 }
 
-func NewShortener(store Store, ids IDGenerator) *Shortener {
-	return &Shortener{
-		store: store,
-		ids:   ids,
+// WithWebhooks sends link events (created, updated, deleted, clicked) to webhooks through d
+func WithWebhooks(d *WebhookDispatcher) Option {
+	return func(s *Shortener) {
+		s.webhooks = d
 	}
 }
 
+// WithBotClassifier replaces the default rules for which redirects are bots (see BotClassifier)
+func WithBotClassifier(bots *BotClassifier) Option {
+	return func(s *Shortener) {
+		s.bots = bots
+	}
+}
+
+func NewShortener(store Store, ids IDGenerator, opts ...Option) *Shortener {
+	s := &Shortener{
+		store:        store,
+		ids:          ids,
+		maxBatchSize: defaultMaxBatchSize,
+		bots:         NewBotClassifier(DefaultBotPatterns(), DefaultBotMethods),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// readContext and writeContext derive the context for one store operation (see WithTimeouts)
+func (s *Shortener) readContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withOptionalTimeout(ctx, s.readTimeout)
+}
+
+func (s *Shortener) writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withOptionalTimeout(ctx, s.writeTimeout)
+}
+
+func withOptionalTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// contextError makes sure an error caused by ctx ending matches context.DeadlineExceeded or
+// context.Canceled. Drivers don't always say so: lib/pq reports a cancelled query as
+// "canceling statement due to user request"
+func contextError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ctx.Err(), err)
+}
+
 func validateURL(raw string) error {
 	// make sure URL is not empty
 	if raw == "" {
@@ -46,23 +172,114 @@ func validateURL(raw string) error {
 	return nil
 }
 
+// normalizeURL gives equivalent URLs the same form, so they can be matched for dedupe:
+// lowercase scheme and host, no default port, and "/" for an empty path.
+// The path, query and fragment are case-sensitive and are left alone.
+func normalizeURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]" // IPv6 literal
+	} else {
+		u.Host = host
+	}
+
+	if u.Path == "" && u.Host != "" {
+		u.Path = "/"
+	}
+
+	return u.String()
+}
+
+// CreateOptions are the optional settings for a new link. The zero value gives a plain link
+type CreateOptions struct {
+	ExpiresAt *time.Time // the link stops resolving at this time; nil means never
+	MaxHits   int64      // the link stops resolving after this many redirects; 0 means unlimited
+	Alias     string     // use this as the short ID instead of generating one
+	Owner     string     // who the link belongs to; dedupe mode only reuses the same owner's links
+}
+
 // Create generates a Short ID and saves it along with the associated URL
 // It also initialises a hit counter and saves the time of creation (CreatedAt)
-func (s *Shortener) Create(url string) (ShortLink, error) {
-	// Validate the URL
-	if err := validateURL(url); err != nil {
-		return ShortLink{}, fmt.Errorf("%w: %s", ErrInvalidURL, err)
+func (s *Shortener) Create(ctx context.Context, url string) (ShortLink, error) {
+	return s.CreateWithOptions(ctx, url, CreateOptions{})
+}
+
+// CreateWithOptions is Create for links with extra settings, like an expiry time
+func (s *Shortener) CreateWithOptions(ctx context.Context, url string, opts CreateOptions) (ShortLink, error) {
+	link, _, err := s.CreateOrGet(ctx, url, opts)
+	return link, err
+}
+
+// CreateOrGet is CreateWithOptions that also reports whether the link is new.
+// created is only ever false in dedupe mode (see WithDedupe), when an existing link was returned
+func (s *Shortener) CreateOrGet(ctx context.Context, url string, opts CreateOptions) (link ShortLink, created bool, err error) {
+	link, err = newLink(url, opts, time.Now())
+	if err != nil {
+		return ShortLink{}, false, err
 	}
 
-	const maxAttempts = 10
+	ctx, cancel := s.writeContext(ctx)
+	defer cancel()
 
-	for attempt := 0; attempt < maxAttempts; attempt++ {
-		input := url
-		if attempt > 0 {
-			input = fmt.Sprintf("%s#%d", url, attempt)
+	link.Canonical = s.dedupe && opts.dedupable()
+
+	for attempt := 0; ; attempt++ {
+		if link.Canonical {
+			existing, err := s.store.FindByURL(ctx, url, opts.Owner)
+			if err == nil {
+				return existing, false, nil
+			}
+			if !errors.Is(err, ErrNotFound) {
+				return ShortLink{}, false, contextError(ctx, err)
+			}
+		}
+
+		saved, err := s.create(ctx, link, url, opts)
+		// another create of the same URL got in between FindByURL and here, so look again
+		if errors.Is(err, ErrDuplicateURL) && attempt < maxAttempts {
+			continue
+		}
+		if err != nil {
+			return ShortLink{}, false, contextError(ctx, err)
+		}
+		link = saved
+		break
+	}
+
+	s.counts.created.Add(1)
+	s.notify()
+	return link, true, nil
+}
+
+// create saves a validated link, using opts.Alias as its ID or generating one
+func (s *Shortener) create(ctx context.Context, link ShortLink, url string, opts CreateOptions) (ShortLink, error) {
+
+	// a vanity alias skips the generator: it either gets saved as-is or it's taken
+	if opts.Alias != "" {
+		link.ID = opts.Alias
+		if err := s.store.Save(ctx, link, s.events(EventLinkCreated)...); err != nil {
+			if errors.Is(err, ErrDuplicateID) {
+				return ShortLink{}, fmt.Errorf("%w: %q", ErrAliasTaken, opts.Alias)
+			}
+			return ShortLink{}, err
 		}
+		return link, nil
+	}
 
-		id, err := s.ids.Next(input)
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		id, err := s.nextID(ctx, url, attempt)
 		if err != nil {
 			return ShortLink{}, err
 		}
@@ -73,15 +290,16 @@ func (s *Shortener) Create(url string) (ShortLink, error) {
 		// 	continue
 		// }
 
-		link := ShortLink{
-			ID:        id,
-			URL:       url,
-			Hits:      0,
-			CreatedAt: time.Now(),
+		// a generated ID that happens to spell a route would never be reachable
+		if isReservedAlias(id) {
+			continue
 		}
 
-		if err := s.store.Save(link); err != nil {
+		link.ID = id
+
+		if err := s.store.Save(ctx, link, s.events(EventLinkCreated)...); err != nil {
 			if errors.Is(err, ErrDuplicateID) {
+				s.counts.collisions.Add(1)
 				continue // collision -> retry
 			}
 			return ShortLink{}, err
@@ -93,31 +311,282 @@ func (s *Shortener) Create(url string) (ShortLink, error) {
 	return ShortLink{}, ErrTooManyCollisions
 }
 
+// dedupable reports whether a request may be answered with an existing link (see WithDedupe)
+func (opts CreateOptions) dedupable() bool {
+	return opts.Alias == "" && opts.ExpiresAt == nil && opts.MaxHits == 0
+}
+
+// how many IDs Create tries before giving up with ErrTooManyCollisions
+const maxAttempts = 10
+
+// nextID asks the generator for an ID. Retries feed it a different input, so deterministic
+// generators (like HashGenerator) don't hand back the same colliding ID every time
+func (s *Shortener) nextID(ctx context.Context, url string, attempt int) (string, error) {
+	input := url
+	if attempt > 0 {
+		input = fmt.Sprintf("%s#%d", url, attempt)
+	}
+
+	return s.ids.Next(ctx, input)
+}
+
+// newLink validates a create request and builds the link for it, minus the ID
+// (which is opts.Alias if set, otherwise still to be generated)
+func newLink(url string, opts CreateOptions, now time.Time) (ShortLink, error) {
+	// Validate the URL
+	if err := validateURL(url); err != nil {
+		return ShortLink{}, fmt.Errorf("%w: %s", ErrInvalidURL, err)
+	}
+
+	// an expiry in the past would create a link that's dead on arrival
+	if opts.ExpiresAt != nil && !opts.ExpiresAt.After(now) {
+		return ShortLink{}, fmt.Errorf("%w: expiry must be in the future", ErrInvalidExpiry)
+	}
+
+	if opts.MaxHits < 0 {
+		return ShortLink{}, ErrInvalidMaxHits
+	}
+
+	if opts.Alias != "" {
+		if err := validateAlias(opts.Alias); err != nil {
+			return ShortLink{}, err
+		}
+	}
+
+	return ShortLink{
+		URL:       url,
+		Hits:      0,
+		CreatedAt: now,
+		ExpiresAt: opts.ExpiresAt,
+		MaxHits:   opts.MaxHits,
+		Owner:     opts.Owner,
+	}, nil
+}
+
 // Resolve returns the URL associated with the given id. It also increments hits
-func (s *Shortener) Resolve(id string) (string, error) {
-	link, err := s.store.Get(id)
+// Deleted, expired and used-up links return ErrDeleted, ErrExpired and ErrHitLimitReached respectively
+func (s *Shortener) Resolve(ctx context.Context, id string) (string, error) {
+	return s.ResolveVisit(ctx, id, Visit{At: time.Now()})
+}
+
+// ResolveVisit is Resolve for a redirect we know more about, which is recorded as a click
+// (see WithClickRecorder) and published to live subscribers (see WithLiveBroker) if the link resolves. Visits from bots are redirected too, but
+// count as BotHits rather than Hits and never use up a MaxHits cap
+func (s *Shortener) ResolveVisit(ctx context.Context, id string, visit Visit) (string, error) {
+	bot := s.bots.IsBot(visit.Method, visit.UserAgent)
+
+	var url string
+	var err error
+	if bot {
+		url, err = s.resolveBot(ctx, id)
+	} else {
+		url, err = s.resolve(ctx, id)
+	}
+	s.counts.resolved(err, bot)
 	if err != nil {
-		if errors.Is(err, ErrNotFound) {
-			return "", ErrNotFound
-		}
-		// TODO: Note how I almost forgot this return statement
 		return "", err
 	}
 
-	s.store.IncrementHits(id)
+	if s.clicks != nil {
+		s.clicks.Record(id, visit, bot)
+	}
+	if s.live != nil && s.live.watching(id) {
+		s.live.Publish(newClickEvent(id, visit, bot))
+	}
+	if s.webhooks != nil && s.webhooks.wantsClicks() {
+		s.notifyClick(newClickEvent(id, visit, bot))
+	}
+
+	return url, nil
+}
+
+// resolveBot resolves id without touching its hits, only its bot hits
+func (s *Shortener) resolveBot(ctx context.Context, id string) (string, error) {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
+	link, err := s.store.Get(ctx, id)
+	if err != nil {
+		return "", contextError(ctx, err)
+	}
+
+	if err := link.checkActive(time.Now()); err != nil {
+		return "", err
+	}
+
+	if s.hits != nil {
+		s.hits.AddBot(id)
+	} else if err := s.store.AddHits(ctx, map[string]HitCount{id: {BotHits: 1}}); err != nil {
+		return "", contextError(ctx, err)
+	}
+
+	return link.URL, nil
+}
+
+func (s *Shortener) resolve(ctx context.Context, id string) (string, error) {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
+	if s.hits == nil {
+		return s.resolveAndCount(ctx, id)
+	}
+
+	link, err := s.store.Get(ctx, id)
+	if err != nil {
+		return "", contextError(ctx, err)
+	}
+
+	if link.MaxHits > 0 {
+		return s.resolveAndCount(ctx, id)
+	}
+
+	if err := link.checkActive(time.Now()); err != nil {
+		return "", err
+	}
+
+	s.hits.Add(id)
+
+	return link.URL, nil
+}
+
+// resolveAndCount resolves id and counts the hit in the store in one step,
+// so a MaxHits cap holds under concurrent clicks
+func (s *Shortener) resolveAndCount(ctx context.Context, id string) (string, error) {
+	link, err := s.store.Hit(ctx, id, time.Now())
+	if err != nil {
+		return "", contextError(ctx, err)
+	}
 
 	return link.URL, nil
 }
 
 // Stats returns metadata for an ID, including the Short ID itself, the associated URL, hit count, and time of creation of the ID
-func (s *Shortener) Stats(id string) (ShortLink, error) {
-	link, err := s.store.Get(id)
+func (s *Shortener) Stats(ctx context.Context, id string) (ShortLink, error) {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
+	link, err := s.store.Get(ctx, id)
 	if err != nil {
 		if errors.Is(err, ErrNotFound) {
 			return ShortLink{}, ErrNotFound
 		}
-		return ShortLink{}, err
+		return ShortLink{}, contextError(ctx, err)
+	}
+
+	if link.DeletedAt != nil {
+		return ShortLink{}, ErrDeleted
+	}
+
+	// include clicks that are still waiting to be flushed
+	if s.hits != nil {
+		pending := s.hits.Pending(id)
+		link.Hits += pending.Hits
+		link.BotHits += pending.BotHits
 	}
 
 	return link, nil
 }
+
+// Owner returns who a link belongs to. Unlike Stats it works for deleted links too
+func (s *Shortener) Owner(ctx context.Context, id string) (string, error) {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
+	link, err := s.store.Get(ctx, id)
+	if err != nil {
+		return "", contextError(ctx, err)
+	}
+	return link.Owner, nil
+}
+
+// Update points an existing link at a new URL. The new URL goes through the same validation as Create
+func (s *Shortener) Update(ctx context.Context, id string, url string) (ShortLink, error) {
+	if err := validateURL(url); err != nil {
+		return ShortLink{}, fmt.Errorf("%w: %s", ErrInvalidURL, err)
+	}
+
+	ctx, cancel := s.writeContext(ctx)
+	defer cancel()
+
+	link, err := s.store.Update(ctx, id, url, s.events(EventLinkUpdated)...)
+	if err != nil {
+		return ShortLink{}, contextError(ctx, err)
+	}
+
+	s.notify()
+	return link, nil
+}
+
+// Delete soft-deletes a link. Afterwards Resolve and Stats return ErrDeleted for it,
+// so callers can tell a removed link apart from one that never existed
+func (s *Shortener) Delete(ctx context.Context, id string) error {
+	ctx, cancel := s.writeContext(ctx)
+	defer cancel()
+
+	if err := s.store.Delete(ctx, id, s.events(EventLinkDeleted)...); err != nil {
+		return contextError(ctx, err)
+	}
+
+	s.notify()
+	return nil
+}
+
+// List returns one page of links. An empty cursor starts from the beginning, and limit is
+// clamped to (0, maxListLimit], with 0 meaning the default page size.
+// The returned page's NextCursor is empty once there are no more links.
+// Sorting by hits can skip links that get busy while the pages are read, see ListSort
+func (s *Shortener) List(ctx context.Context, cursor string, limit int, sort string) (LinkPage, error) {
+	return s.list(ctx, nil, cursor, limit, sort)
+}
+
+// ListByOwner is List for one owner's links
+func (s *Shortener) ListByOwner(ctx context.Context, owner string, cursor string, limit int, sort string) (LinkPage, error) {
+	return s.list(ctx, &owner, cursor, limit, sort)
+}
+
+func (s *Shortener) list(ctx context.Context, owner *string, cursor string, limit int, sort string) (LinkPage, error) {
+	order, err := parseListSort(sort)
+	if err != nil {
+		return LinkPage{}, err
+	}
+
+	opts := ListOptions{Sort: order, Limit: limit, Owner: owner}
+	if opts.Limit <= 0 {
+		opts.Limit = defaultListLimit
+	}
+	if opts.Limit > maxListLimit {
+		opts.Limit = maxListLimit
+	}
+
+	if cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			return LinkPage{}, err
+		}
+		// a cursor only makes sense for the sort order it was issued for
+		if after.Sort != order {
+			return LinkPage{}, ErrInvalidCursor
+		}
+		opts.After = &after
+	}
+
+	// ask for one extra row so we know whether there's a next page without a COUNT query
+	pageSize := opts.Limit
+	opts.Limit++
+
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
+	links, err := s.store.List(ctx, opts)
+	if err != nil {
+		return LinkPage{}, contextError(ctx, err)
+	}
+
+	page := LinkPage{Links: links}
+	if len(links) > pageSize {
+		page.Links = links[:pageSize]
+		page.NextCursor = cursorFor(order, page.Links[pageSize-1]).encode()
+	}
+
+	return page, nil
+}
@@ -1,8 +1,13 @@
 package shorten
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // Sequence Generator is preloaded with IDs.
@@ -17,7 +22,7 @@ func NewSequenceGenerator(ids ...string) *SequenceGenerator {
 	return &SequenceGenerator{ids: ids}
 }
 
-func (g *SequenceGenerator) Next(_ string) (string, error) {
+func (g *SequenceGenerator) Next(_ context.Context, _ string) (string, error) {
 	if g.i >= len(g.ids) {
 		return "", errors.New("no more ids")
 	}
@@ -32,7 +37,7 @@ type MockGenerator struct {
 	id string
 }
 
-func (mg *MockGenerator) Next(_ string) (string, error) {
+func (mg *MockGenerator) Next(_ context.Context, _ string) (string, error) {
 	return "fake-id", nil
 }
 
@@ -56,7 +61,7 @@ func TestCreate(t *testing.T) {
 		shortener := newTestShortener(t, NewBase62Generator())
 		url := "https://example.com"
 
-		link, err := shortener.Create(url)
+		link, err := shortener.Create(context.Background(), url)
 		if err != nil {
 			t.Fatalf("expected nil err, got %v", err)
 		}
@@ -98,7 +103,7 @@ func TestCreate(t *testing.T) {
 
 		for _, tt := range tests {
 			t.Run(tt.name, func(t *testing.T) {
-				_, err := shortener.Create(tt.url)
+				_, err := shortener.Create(context.Background(), tt.url)
 
 				if err == nil {
 					t.Fatalf("expected error for url %q, got nil", tt.url)
@@ -121,12 +126,12 @@ func TestCreate(t *testing.T) {
 		url := "https://example.com"
 
 		// Call Create() twice to generate a collision
-		link, err := shortener.Create(url)
+		link, err := shortener.Create(context.Background(), url)
 		if err != nil {
 			t.Fatalf("setup failed: %v", err)
 		}
 
-		link, err = shortener.Create(url)	
+		link, err = shortener.Create(context.Background(), url)	
 		if err != nil {
 			t.Fatalf("expected nil error, got %v", err)
 		}
@@ -142,7 +147,7 @@ func TestCreate(t *testing.T) {
 		url := "https://example.com"
 
 		// Create ID
-		_, err := shortener.Create(url)
+		_, err := shortener.Create(context.Background(), url)
 		if err != nil {
 			t.Fatalf("setup failed: %v", err)
 		}
@@ -150,7 +155,7 @@ func TestCreate(t *testing.T) {
 		// Create the ID again
 		// Mock generator returns the same id every time, so it will generate collisions infinitely - The expected behaviour is that you run
 		// out of retry attempts
-		_, err = shortener.Create(url)
+		_, err = shortener.Create(context.Background(), url)
 		if err == nil {
 			t.Fatal("expected error, got nil")
 		}
@@ -169,13 +174,13 @@ func TestResolve(t *testing.T) {
 		url := "https://example.com"
 
 		// 1) Create ID
-		link, err := shortener.Create(url)
+		link, err := shortener.Create(context.Background(), url)
 		if err != nil {
 			t.Fatalf("setup failed: %v", err)
 		}
 
 		// 2) Resolve
-		gotURL, err := shortener.Resolve(link.ID)
+		gotURL, err := shortener.Resolve(context.Background(), link.ID)
 		if err != nil {
 			t.Fatalf("expected nil error, got %v", err)
 		}
@@ -186,7 +191,7 @@ func TestResolve(t *testing.T) {
 		}
 
 		// Check whether hit count was incremented
-		link, err = shortener.Stats(link.ID)
+		link, err = shortener.Stats(context.Background(), link.ID)
 		if err != nil {
 			t.Fatalf("stats failed: %v", err)
 		}
@@ -199,7 +204,7 @@ func TestResolve(t *testing.T) {
 	// Test: ID not found
 	t.Run("Short ID not found", func(t *testing.T) {
 		shortener := newTestShortener(t, NewHashGenerator(8))
-		_, err := shortener.Resolve("fake-id")
+		_, err := shortener.Resolve(context.Background(), "fake-id")
 		if !errors.Is(err, ErrNotFound) {
 			t.Fatalf("expected error: %v; got %v", ErrNotFound, err)
 		}
@@ -212,19 +217,19 @@ func TestStats(t *testing.T) {
 		url := "https://example.com"
 
 		// 1) Create ID
-		link, err := shortener.Create(url)
+		link, err := shortener.Create(context.Background(), url)
 		if err != nil {
 			t.Fatalf("setup failed: %v", err)
 		}
 
 		// 2) Resolve thrice, so expected hits == 3
 		for i := 0; i < 3; i++ {
-			if _, err := shortener.Resolve(link.ID); err != nil {
+			if _, err := shortener.Resolve(context.Background(), link.ID); err != nil {
 				t.Fatalf("setup resolve failed: %v", err)
 			}
 		}
 		
-		link, err = shortener.Stats(link.ID)
+		link, err = shortener.Stats(context.Background(), link.ID)
 		if err != nil {
 			t.Fatalf("expected nil error, got %v", err)
 		}
@@ -241,9 +246,532 @@ func TestStats(t *testing.T) {
 	t.Run("Short ID not found", func(t *testing.T) {
 		shortener := newTestShortener(t, NewHashGenerator(8))
 
-		_, err := shortener.Stats("fake-id")
+		_, err := shortener.Stats(context.Background(), "fake-id")
 		if !errors.Is(err, ErrNotFound) {
 			t.Fatalf("expected error: %v; got %v", ErrNotFound, err)
 		}
 	})
 }
+
+func TestList(t *testing.T) {
+	t.Run("Pages through every link", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		const n = 7
+		for i := 0; i < n; i++ {
+			if _, err := shortener.Create(context.Background(), fmt.Sprintf("https://example.com/%d", i)); err != nil {
+				t.Fatalf("setup failed: %v", err)
+			}
+		}
+
+		seen := make(map[string]bool)
+		cursor := ""
+		pages := 0
+
+		for {
+			page, err := shortener.List(context.Background(), cursor, 3, "")
+			if err != nil {
+				t.Fatalf("expected nil error, got %v", err)
+			}
+			pages++
+
+			for _, link := range page.Links {
+				if seen[link.ID] {
+					t.Fatalf("link %q returned twice", link.ID)
+				}
+				seen[link.ID] = true
+			}
+
+			if page.NextCursor == "" {
+				break
+			}
+			cursor = page.NextCursor
+		}
+
+		if len(seen) != n {
+			t.Fatalf("expected %d links, got %d", n, len(seen))
+		}
+		if pages != 3 {
+			t.Fatalf("expected 3 pages, got %d", pages)
+		}
+	})
+
+	t.Run("Invalid sort", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		_, err := shortener.List(context.Background(), "", 10, "url")
+		if !errors.Is(err, ErrInvalidSort) {
+			t.Fatalf("expected ErrInvalidSort, got %v", err)
+		}
+	})
+
+	t.Run("Invalid cursor", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		_, err := shortener.List(context.Background(), "not-a-cursor", 10, "")
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Fatalf("expected ErrInvalidCursor, got %v", err)
+		}
+	})
+
+	t.Run("Cursor from a different sort", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+		for i := 0; i < 2; i++ {
+			if _, err := shortener.Create(context.Background(), fmt.Sprintf("https://example.com/%d", i)); err != nil {
+				t.Fatalf("setup failed: %v", err)
+			}
+		}
+
+		page, err := shortener.List(context.Background(), "", 1, "hits")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		_, err = shortener.List(context.Background(), page.NextCursor, 1, "created_at")
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Fatalf("expected ErrInvalidCursor, got %v", err)
+		}
+	})
+
+	// sort=hits is approximate across pages; this pins down how
+	t.Run("Links that pass the hits cursor are skipped", func(t *testing.T) {
+		ctx := context.Background()
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		busy, err := shortener.Create(ctx, "https://example.com/busy")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		quiet, err := shortener.Create(ctx, "https://example.com/quiet")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		resolve := func(id string, n int) {
+			for range n {
+				if _, err := shortener.Resolve(ctx, id); err != nil {
+					t.Fatalf("setup failed: %v", err)
+				}
+			}
+		}
+		resolve(busy.ID, 2)
+		resolve(quiet.ID, 1)
+
+		page, err := shortener.List(ctx, "", 1, "hits")
+		if err != nil || len(page.Links) != 1 || page.Links[0].ID != busy.ID {
+			t.Fatalf("expected the busy link first, got %+v (%v)", page.Links, err)
+		}
+
+		// the quiet link overtakes the cursor before the next page is read
+		resolve(quiet.ID, 2)
+
+		page, err = shortener.List(ctx, page.NextCursor, 1, "hits")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(page.Links) != 0 {
+			t.Fatalf("expected the quiet link to be skipped, got %+v", page.Links)
+		}
+	})
+}
+
+func TestUpdateDelete(t *testing.T) {
+	t.Run("Update changes the redirect target", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		link, err := shortener.Create(context.Background(), "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		if _, err := shortener.Update(context.Background(), link.ID, "https://example.org"); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+
+		gotURL, err := shortener.Resolve(context.Background(), link.ID)
+		if err != nil {
+			t.Fatalf("resolve failed: %v", err)
+		}
+		if gotURL != "https://example.org" {
+			t.Fatalf("expected url %q, got %q", "https://example.org", gotURL)
+		}
+	})
+
+	t.Run("Update rejects invalid URLs", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		link, err := shortener.Create(context.Background(), "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		if _, err := shortener.Update(context.Background(), link.ID, "ftp://example.com"); !errors.Is(err, ErrInvalidURL) {
+			t.Fatalf("expected ErrInvalidURL, got %v", err)
+		}
+	})
+
+	t.Run("Deleted links are gone, not missing", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		link, err := shortener.Create(context.Background(), "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		if err := shortener.Delete(context.Background(), link.ID); err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+
+		if _, err := shortener.Resolve(context.Background(), link.ID); !errors.Is(err, ErrDeleted) {
+			t.Fatalf("expected ErrDeleted from Resolve, got %v", err)
+		}
+		if _, err := shortener.Stats(context.Background(), link.ID); !errors.Is(err, ErrDeleted) {
+			t.Fatalf("expected ErrDeleted from Stats, got %v", err)
+		}
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	t.Run("Expired links stop resolving", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		link, err := shortener.CreateWithOptions(context.Background(), "https://example.com", CreateOptions{
+			ExpiresAt: timePtr(time.Now().Add(50 * time.Millisecond)),
+		})
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		if _, err := shortener.Resolve(context.Background(), link.ID); err != nil {
+			t.Fatalf("expected link to resolve before expiry, got %v", err)
+		}
+
+		time.Sleep(60 * time.Millisecond)
+
+		if _, err := shortener.Resolve(context.Background(), link.ID); !errors.Is(err, ErrExpired) {
+			t.Fatalf("expected ErrExpired, got %v", err)
+		}
+
+		// stats are still available for an expired link
+		if _, err := shortener.Stats(context.Background(), link.ID); err != nil {
+			t.Fatalf("expected stats for expired link, got %v", err)
+		}
+	})
+
+	t.Run("Expiry in the past", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		_, err := shortener.CreateWithOptions(context.Background(), "https://example.com", CreateOptions{
+			ExpiresAt: timePtr(time.Now().Add(-time.Minute)),
+		})
+		if !errors.Is(err, ErrInvalidExpiry) {
+			t.Fatalf("expected ErrInvalidExpiry, got %v", err)
+		}
+	})
+}
+
+func TestMaxHits(t *testing.T) {
+	t.Run("Link stops resolving after MaxHits", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		link, err := shortener.CreateWithOptions(context.Background(), "https://example.com", CreateOptions{MaxHits: 2})
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if _, err := shortener.Resolve(context.Background(), link.ID); err != nil {
+				t.Fatalf("resolve %d: expected nil error, got %v", i+1, err)
+			}
+		}
+
+		if _, err := shortener.Resolve(context.Background(), link.ID); !errors.Is(err, ErrHitLimitReached) {
+			t.Fatalf("expected ErrHitLimitReached, got %v", err)
+		}
+
+		link, err = shortener.Stats(context.Background(), link.ID)
+		if err != nil {
+			t.Fatalf("stats failed: %v", err)
+		}
+		if link.Hits != 2 {
+			t.Fatalf("expected refused redirects not to count, got hits=%d", link.Hits)
+		}
+	})
+
+	t.Run("Negative MaxHits", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		_, err := shortener.CreateWithOptions(context.Background(), "https://example.com", CreateOptions{MaxHits: -1})
+		if !errors.Is(err, ErrInvalidMaxHits) {
+			t.Fatalf("expected ErrInvalidMaxHits, got %v", err)
+		}
+	})
+}
+
+func TestCreateAlias(t *testing.T) {
+	t.Run("Alias is used as the short ID", func(t *testing.T) {
+		// the sequence generator has no IDs left, so this fails if Create touches it
+		shortener := newTestShortener(t, NewSequenceGenerator())
+
+		link, err := shortener.CreateWithOptions(context.Background(), "https://example.com", CreateOptions{Alias: "spring-sale"})
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+
+		if link.ID != "spring-sale" {
+			t.Fatalf("expected id %q, got %q", "spring-sale", link.ID)
+		}
+	})
+
+	t.Run("Taken alias", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		if _, err := shortener.CreateWithOptions(context.Background(), "https://example.com", CreateOptions{Alias: "spring-sale"}); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		_, err := shortener.CreateWithOptions(context.Background(), "https://example.org", CreateOptions{Alias: "spring-sale"})
+		if !errors.Is(err, ErrAliasTaken) {
+			t.Fatalf("expected ErrAliasTaken, got %v", err)
+		}
+	})
+
+	t.Run("Invalid alias", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		tests := []struct {
+			name  string
+			alias string
+		}{
+			{"too short", "ab"},
+			{"too long", strings.Repeat("a", 65)},
+			{"bad characters", "spring sale!"},
+			{"path separator", "a/b/c"},
+			{"reserved", "stats"},
+			{"reserved, different case", "Links"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := shortener.CreateWithOptions(context.Background(), "https://example.com", CreateOptions{Alias: tt.alias})
+				if !errors.Is(err, ErrInvalidAlias) {
+					t.Fatalf("expected ErrInvalidAlias for %q, got %v", tt.alias, err)
+				}
+			})
+		}
+	})
+
+	t.Run("Generated IDs skip reserved words", func(t *testing.T) {
+		shortener := newTestShortener(t, NewSequenceGenerator("shorten", "abc123"))
+
+		link, err := shortener.Create(context.Background(), "https://example.com")
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+
+		if link.ID != "abc123" {
+			t.Fatalf("expected reserved id to be skipped, got %q", link.ID)
+		}
+	})
+}
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"https://example.com", "https://example.com/"},
+		{"HTTPS://EXAMPLE.com/Path", "https://example.com/Path"},
+		{"http://example.com:80/a", "http://example.com/a"},
+		{"https://example.com:443/a?q=1", "https://example.com/a?q=1"},
+		{"https://example.com:8443/a", "https://example.com:8443/a"},
+		{"http://[::1]:80/", "http://[::1]/"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeURL(tt.in); got != tt.want {
+			t.Errorf("normalizeURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	t.Run("Same URL reuses the link", func(t *testing.T) {
+		shortener := NewShortener(NewMemStore(), NewBase62Generator(), WithDedupe())
+
+		first, created, err := shortener.CreateOrGet(context.Background(), "https://example.com/page", CreateOptions{})
+		if err != nil || !created {
+			t.Fatalf("setup failed: created=%v err=%v", created, err)
+		}
+
+		again, created, err := shortener.CreateOrGet(context.Background(), "https://EXAMPLE.com/page", CreateOptions{})
+		if err != nil {
+			t.Fatalf("expected nil error, got %v", err)
+		}
+		if created {
+			t.Fatal("expected existing link to be reused")
+		}
+		if again.ID != first.ID {
+			t.Fatalf("expected id %q, got %q", first.ID, again.ID)
+		}
+	})
+
+	t.Run("Special links are never reused", func(t *testing.T) {
+		shortener := NewShortener(NewMemStore(), NewBase62Generator(), WithDedupe())
+
+		// a capped link shouldn't be handed to someone asking for a plain one...
+		capped, err := shortener.CreateWithOptions(context.Background(), "https://example.com", CreateOptions{MaxHits: 1})
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		plain, created, err := shortener.CreateOrGet(context.Background(), "https://example.com", CreateOptions{})
+		if err != nil || !created || plain.ID == capped.ID {
+			t.Fatalf("expected a new plain link, got id=%q created=%v err=%v", plain.ID, created, err)
+		}
+
+		// ...and asking for a capped link always makes a new one
+		_, created, err = shortener.CreateOrGet(context.Background(), "https://example.com", CreateOptions{MaxHits: 1})
+		if err != nil || !created {
+			t.Fatalf("expected a new capped link, got created=%v err=%v", created, err)
+		}
+	})
+
+	t.Run("Only the same owner's links are reused", func(t *testing.T) {
+		shortener := NewShortener(NewMemStore(), NewBase62Generator(), WithDedupe())
+
+		mine, _, err := shortener.CreateOrGet(context.Background(), "https://example.com", CreateOptions{Owner: "marketing"})
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		theirs, created, err := shortener.CreateOrGet(context.Background(), "https://example.com", CreateOptions{Owner: "sales"})
+		if err != nil || !created || theirs.ID == mine.ID {
+			t.Fatalf("expected a new link for another owner, got id=%q created=%v err=%v", theirs.ID, created, err)
+		}
+
+		again, created, err := shortener.CreateOrGet(context.Background(), "https://example.com", CreateOptions{Owner: "marketing"})
+		if err != nil || created || again.ID != mine.ID {
+			t.Fatalf("expected %q to be reused, got id=%q created=%v err=%v", mine.ID, again.ID, created, err)
+		}
+	})
+
+	t.Run("Deleted links are not reused", func(t *testing.T) {
+		shortener := NewShortener(NewMemStore(), NewBase62Generator(), WithDedupe())
+
+		first, err := shortener.Create(context.Background(), "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		if err := shortener.Delete(context.Background(), first.ID); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		_, created, err := shortener.CreateOrGet(context.Background(), "https://example.com", CreateOptions{})
+		if err != nil || !created {
+			t.Fatalf("expected a new link, got created=%v err=%v", created, err)
+		}
+	})
+
+	t.Run("Losing a race for the URL reuses the winner's link", func(t *testing.T) {
+		store := &racingStore{MemStore: NewMemStore()}
+		shortener := NewShortener(store, NewBase62Generator(), WithDedupe())
+
+		winner := ShortLink{ID: "winner", URL: "https://example.com", CreatedAt: time.Now(), Canonical: true}
+		if err := store.Save(context.Background(), winner); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		link, created, err := shortener.CreateOrGet(context.Background(), "https://example.com", CreateOptions{})
+		if err != nil || created || link.ID != winner.ID {
+			t.Fatalf("expected %q to be reused, got id=%q created=%v err=%v", winner.ID, link.ID, created, err)
+		}
+	})
+
+	t.Run("Off by default", func(t *testing.T) {
+		shortener := newTestShortener(t, NewBase62Generator())
+
+		if _, err := shortener.Create(context.Background(), "https://example.com"); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		_, created, err := shortener.CreateOrGet(context.Background(), "https://example.com", CreateOptions{})
+		if err != nil || !created {
+			t.Fatalf("expected a new link, got created=%v err=%v", created, err)
+		}
+	})
+}
+
+// racingStore is a MemStore whose first FindByURL misses, as if another create of the same URL
+// saved its link right after the lookup
+type racingStore struct {
+	*MemStore
+	missed atomic.Bool
+}
+
+func (store *racingStore) FindByURL(ctx context.Context, url string, owner string) (ShortLink, error) {
+	if store.missed.CompareAndSwap(false, true) {
+		return ShortLink{}, ErrNotFound
+	}
+	return store.MemStore.FindByURL(ctx, url, owner)
+}
+
+// slowStore is a MemStore whose lookups only return once their context ends, like a database that has stopped answering
+type slowStore struct {
+	*MemStore
+}
+
+func (store slowStore) Get(ctx context.Context, _ string) (ShortLink, error) {
+	<-ctx.Done()
+	return ShortLink{}, errors.New("canceling statement due to user request")
+}
+
+func (store slowStore) Hit(ctx context.Context, id string, _ time.Time) (ShortLink, error) {
+	return store.Get(ctx, id)
+}
+
+func (store slowStore) List(ctx context.Context, _ ListOptions) ([]ShortLink, error) {
+	_, err := store.Get(ctx, "")
+	return nil, err
+}
+
+func TestTimeouts(t *testing.T) {
+	t.Run("Slow store times out", func(t *testing.T) {
+		shortener := NewShortener(slowStore{NewMemStore()}, NewBase62Generator(), WithTimeouts(10*time.Millisecond, time.Second))
+
+		start := time.Now()
+		_, err := shortener.Resolve(context.Background(), "abc")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected DeadlineExceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("expected Resolve to give up after the read timeout, took %s", elapsed)
+		}
+
+		if _, err := shortener.Stats(context.Background(), "abc"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected DeadlineExceeded, got %v", err)
+		}
+	})
+
+	t.Run("Cancelled caller", func(t *testing.T) {
+		shortener := NewShortener(slowStore{NewMemStore()}, NewBase62Generator())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, err := shortener.Resolve(ctx, "abc"); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected Canceled, got %v", err)
+		}
+	})
+
+	t.Run("Fast store is unaffected", func(t *testing.T) {
+		shortener := NewShortener(NewMemStore(), NewBase62Generator(), WithTimeouts(time.Second, time.Second))
+
+		link, err := shortener.Create(context.Background(), "https://example.com")
+		if err != nil {
+			t.Fatalf("expected nil err, got %v", err)
+		}
+		if _, err := shortener.Resolve(context.Background(), link.ID); err != nil {
+			t.Fatalf("expected nil err, got %v", err)
+		}
+	})
+}
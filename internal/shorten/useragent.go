@@ -0,0 +1,106 @@
+package shorten
+
+import "strings"
+
+// UserAgent is what the stats use from a User-Agent header
+type UserAgent struct {
+	Class   string // one of the Agent* classes
+	Browser string // browser family, e.g. "Chrome"; "" if not recognised
+	OS      string // operating system family, e.g. "Android"; "" if not recognised
+}
+
+// parseUserAgent classifies a User-Agent header and picks out its browser and OS families
+func parseUserAgent(ua string) UserAgent {
+	lower := strings.ToLower(ua)
+
+	return UserAgent{
+		Class:   classifyUserAgent(ua),
+		Browser: firstMatch(lower, browserFamilies),
+		OS:      firstMatch(lower, osFamilies),
+	}
+}
+
+// uaFamily is a family name and the (lowercase) substrings that identify it
+type uaFamily struct {
+	name    string
+	markers []string
+}
+
+// Order matters: most browsers claim to be Safari and Chrome-based ones also say Chrome,
+// Android says Linux, and iOS says "like Mac OS X", so the more specific families come first
+var browserFamilies = []uaFamily{
+	{"Edge", []string{"edg/", "edge/", "edga/", "edgios/"}},
+	{"Opera", []string{"opr/", "opera"}},
+	{"Samsung Internet", []string{"samsungbrowser/"}},
+	{"Firefox", []string{"firefox/", "fxios/"}},
+	{"Chrome", []string{"chrome/", "crios/", "chromium/"}},
+	{"Safari", []string{"safari/"}},
+	{"Internet Explorer", []string{"msie ", "trident/"}},
+}
+
+var osFamilies = []uaFamily{
+	{"iOS", []string{"iphone", "ipad", "ipod"}},
+	{"Android", []string{"android"}},
+	{"Windows", []string{"windows"}},
+	{"ChromeOS", []string{"cros "}}, // with the space, since "microsoft" contains "cros"
+	{"macOS", []string{"macintosh", "mac os x"}},
+	{"Linux", []string{"linux", "x11"}},
+}
+
+func firstMatch(lower string, families []uaFamily) string {
+	for _, family := range families {
+		for _, marker := range family.markers {
+			if strings.Contains(lower, marker) {
+				return family.name
+			}
+		}
+	}
+	return ""
+}
+
+// User-agent classes recorded with each click
+const (
+	AgentDesktop = "desktop"
+	AgentMobile  = "mobile"
+	AgentTablet  = "tablet"
+	AgentBot     = "bot"
+	AgentUnknown = "unknown"
+)
+
+// botMarkers are substrings (lowercase) that only show up in crawler and preview-fetcher user agents.
+// Most chat apps' fetchers say "bot" (Slackbot, Twitterbot, Discordbot, TelegramBot, LinkedInBot);
+// the rest are listed by name. "twitter" and "discord" alone would also match their in-app browsers
+var botMarkers = []string{
+	"bot", "crawler", "spider", "slurp", "facebookexternalhit", "embedly", "preview",
+	"slack-imgproxy", "whatsapp", "iframely", "vkshare", "mastodon",
+	"curl/", "wget/", "python-requests", "go-http-client", "headless",
+}
+
+// classifyUserAgent sorts a User-Agent header into one of the Agent* classes.
+// It only looks for well-known markers, which is plenty for stats; it's not meant to be exact
+func classifyUserAgent(ua string) string {
+	if ua == "" {
+		return AgentUnknown
+	}
+
+	lower := strings.ToLower(ua)
+
+	for _, marker := range botMarkers {
+		if strings.Contains(lower, marker) {
+			return AgentBot
+		}
+	}
+
+	switch {
+	case strings.Contains(lower, "ipad"), strings.Contains(lower, "tablet"),
+		strings.Contains(lower, "android") && !strings.Contains(lower, "mobile"):
+		return AgentTablet
+	case strings.Contains(lower, "mobi"), strings.Contains(lower, "iphone"), strings.Contains(lower, "ipod"):
+		return AgentMobile
+	case strings.Contains(lower, "windows"), strings.Contains(lower, "macintosh"), strings.Contains(lower, "x11"),
+		strings.Contains(lower, "cros "):
+		return AgentDesktop
+	default:
+		return AgentUnknown
+	}
+}
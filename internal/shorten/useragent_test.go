@@ -0,0 +1,85 @@
+package shorten
+
+import "testing"
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		name string
+		ua   string
+		want UserAgent
+	}{
+		{
+			"Chrome on Windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+			UserAgent{Class: AgentDesktop, Browser: "Chrome", OS: "Windows"},
+		},
+		{
+			"Edge on Windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36 Edg/126.0.0.0",
+			UserAgent{Class: AgentDesktop, Browser: "Edge", OS: "Windows"},
+		},
+		{
+			"Safari on macOS",
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_5) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Safari/605.1.15",
+			UserAgent{Class: AgentDesktop, Browser: "Safari", OS: "macOS"},
+		},
+		{
+			"Chrome on ChromeOS",
+			"Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+			UserAgent{Class: AgentDesktop, Browser: "Chrome", OS: "ChromeOS"},
+		},
+		{
+			"Microsoft Office on macOS",
+			"Microsoft Office/16.0 (Macintosh; Mac OS X 10.15.7; Microsoft Outlook 16.86.0; Pro)",
+			UserAgent{Class: AgentDesktop, OS: "macOS"},
+		},
+		{
+			"Firefox on Linux",
+			"Mozilla/5.0 (X11; Linux x86_64; rv:127.0) Gecko/20100101 Firefox/127.0",
+			UserAgent{Class: AgentDesktop, Browser: "Firefox", OS: "Linux"},
+		},
+		{
+			"Safari on iPhone",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1",
+			UserAgent{Class: AgentMobile, Browser: "Safari", OS: "iOS"},
+		},
+		{
+			"Chrome on iPad",
+			"Mozilla/5.0 (iPad; CPU OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/126.0.6478.54 Mobile/15E148 Safari/604.1",
+			UserAgent{Class: AgentTablet, Browser: "Chrome", OS: "iOS"},
+		},
+		{
+			"Samsung Internet on Android",
+			"Mozilla/5.0 (Linux; Android 14; SM-S918B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/25.0 Chrome/121.0.0.0 Mobile Safari/537.36",
+			UserAgent{Class: AgentMobile, Browser: "Samsung Internet", OS: "Android"},
+		},
+		{
+			"Googlebot",
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			UserAgent{Class: AgentBot},
+		},
+		{
+			"Slack preview",
+			"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)",
+			UserAgent{Class: AgentBot},
+		},
+		{
+			"curl",
+			"curl/8.6.0",
+			UserAgent{Class: AgentBot},
+		},
+		{
+			"empty",
+			"",
+			UserAgent{Class: AgentUnknown},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseUserAgent(tt.ua); got != tt.want {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
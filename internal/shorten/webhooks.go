@@ -0,0 +1,541 @@
+package shorten
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrWebhooksDisabled = errors.New("webhooks are not enabled")
+	ErrInvalidWebhook   = errors.New("invalid webhook")
+)
+
+// EventType is what happened to a link. Webhooks subscribe to some or all of them
+type EventType string
+
+const (
+	EventLinkCreated EventType = "link.created"
+	EventLinkUpdated EventType = "link.updated"
+	EventLinkDeleted EventType = "link.deleted"
+	EventLinkExpired EventType = "link.expired"
+	EventLinkClicked EventType = "link.clicked"
+)
+
+var eventTypes = []EventType{EventLinkCreated, EventLinkUpdated, EventLinkDeleted, EventLinkExpired, EventLinkClicked}
+
+// Webhook is a subscription: events of the given types are POSTed to URL, signed with Secret
+type Webhook struct {
+	ID        string
+	URL       string
+	Secret    string
+	Events    []EventType // empty means every event
+	CreatedAt time.Time
+}
+
+func (hook Webhook) wants(event EventType) bool {
+	return len(hook.Events) == 0 || slices.Contains(hook.Events, event)
+}
+
+// WebhookEvent is one event, with the exact JSON body its deliveries send
+type WebhookEvent struct {
+	ID      string
+	Type    EventType
+	Payload []byte
+}
+
+// WebhookDelivery is one event on its way to one webhook
+type WebhookDelivery struct {
+	ID        int64
+	WebhookID string
+	URL       string
+	Secret    string
+	EventID   string
+	EventType EventType
+	Payload   []byte
+	Attempts  int // failed attempts so far
+}
+
+// WebhookStore keeps webhook subscriptions and the outbox of deliveries still to be made
+type WebhookStore interface {
+	SaveWebhook(ctx context.Context, hook Webhook) error
+	ListWebhooks(ctx context.Context) ([]Webhook, error)
+	// DeleteWebhook removes a subscription along with its pending deliveries. ErrNotFound if there's no such webhook
+	DeleteWebhook(ctx context.Context, id string) error
+
+	// EnqueueWebhookEvents adds a delivery of each event to every webhook that wants it, due straight away
+	EnqueueWebhookEvents(ctx context.Context, events []WebhookEvent) error
+	// ClaimWebhookDeliveries returns up to limit deliveries that are due at now, oldest first, and pushes
+	// them back by lease so no one else sends them meanwhile. A delivery that's neither retried nor
+	// deleted before the lease is up (say the server died mid-send) becomes due again
+	ClaimWebhookDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error)
+	// RetryWebhookDelivery counts a failed attempt and makes the delivery due again at next
+	RetryWebhookDelivery(ctx context.Context, id int64, next time.Time, lastError string) error
+	// DeleteWebhookDelivery removes a delivery that's been made or given up on
+	DeleteWebhookDelivery(ctx context.Context, id int64) error
+}
+
+// webhookPayload is the JSON body of every delivery
+type webhookPayload struct {
+	ID         string        `json:"id"` // the same for every delivery (and retry) of an event, for deduplication
+	Type       EventType     `json:"type"`
+	OccurredAt time.Time     `json:"occurredAt"`
+	Link       *ShortLink    `json:"link,omitempty"`
+	Click      *webhookClick `json:"click,omitempty"`
+}
+
+type webhookClick struct {
+	Short    string    `json:"short"`
+	At       time.Time `json:"at"`
+	Bot      bool      `json:"bot"`
+	Referrer string    `json:"referrer,omitempty"`
+	Device   string    `json:"device"`
+	Browser  string    `json:"browser,omitempty"`
+	OS       string    `json:"os,omitempty"`
+}
+
+func newWebhookEvent(id string, event EventType, at time.Time, link *ShortLink, click *webhookClick) (WebhookEvent, error) {
+	payload := webhookPayload{
+		ID:         id,
+		Type:       event,
+		OccurredAt: at.UTC(),
+		Link:       link,
+		Click:      click,
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return WebhookEvent{ID: payload.ID, Type: event, Payload: body}, nil
+}
+
+// linkEvent is an event about link that happened at the given time. A link only expires once, so
+// a link.expired event has an ID made from the link and its expiry, and is dated when it expired
+func linkEvent(event EventType, link ShortLink, at time.Time) (WebhookEvent, error) {
+	id := uuid.NewString()
+	if event == EventLinkExpired && link.ExpiresAt != nil {
+		at = *link.ExpiresAt
+		id = uuid.NewSHA1(uuid.NameSpaceURL, []byte(link.ID+":"+string(event)+":"+at.UTC().Format(time.RFC3339Nano))).String()
+	}
+	return newWebhookEvent(id, event, at, &link, nil)
+}
+
+// linkEvents is an event of each type for each of links, for a store to queue along with the change
+func linkEvents(types []EventType, links ...ShortLink) ([]WebhookEvent, error) {
+	now := time.Now()
+	events := make([]WebhookEvent, 0, len(types)*len(links))
+	for _, link := range links {
+		for _, event := range types {
+			ev, err := linkEvent(event, link, now)
+			if err != nil {
+				return nil, fmt.Errorf("%s event for %s: %w", event, link.ID, err)
+			}
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+func clickEvent(ev ClickEvent) (WebhookEvent, error) {
+	return newWebhookEvent(uuid.NewString(), EventLinkClicked, ev.At, nil, &webhookClick{
+		Short:    ev.LinkID,
+		At:       ev.At.UTC(),
+		Bot:      ev.Bot,
+		Referrer: ev.ReferrerHost,
+		Device:   ev.AgentClass,
+		Browser:  ev.Browser,
+		OS:       ev.OS,
+	})
+}
+
+// Headers sent with every delivery. The signature header is "t=<unix time>,v1=<hex HMAC>", see SignWebhook
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookIDHeader        = "X-Webhook-Id"
+)
+
+// SignWebhook is the v1 signature of a delivery: HMAC-SHA256, keyed with the webhook's secret, of the
+// Unix timestamp, a dot and the body. Receivers should recompute it, compare in constant time, and
+// reject old timestamps so a captured delivery can't be replayed
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+const (
+	webhookBatchSize   = 100
+	webhookConcurrency = 8                // deliveries sent at once
+	webhookLease       = 2 * time.Minute  // longer than a delivery can take, see defaultWebhookClient
+	webhookClickBuffer = 10000            // click events held in memory between runs
+	webhookRetryBase   = 10 * time.Second // the first retry's delay, doubling after that
+	webhookRetryMax    = time.Hour
+)
+
+var defaultWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// WebhookDispatcher delivers the events in the outbox. Deliveries that fail are retried with
+// exponential backoff until maxAttempts, then dropped.
+//
+// Link events are written to the outbox by the store, in the same transaction as the change they
+// describe (see Store), so none is lost to a crash and none is sent for a change that didn't happen.
+//
+// Click events are best effort: one outbox write per redirect would cost more than the redirect, so
+// they're held in memory and written every interval, like ClickRecorder's clicks. The ones not yet
+// written are lost if the server dies, and dropped once webhookClickBuffer of them are waiting
+type WebhookDispatcher struct {
+	store       WebhookStore
+	client      *http.Client
+	interval    time.Duration
+	maxAttempts int
+
+	retryBase time.Duration
+	retryMax  time.Duration
+	now       func() time.Time
+
+	mu     sync.Mutex
+	clicks []WebhookEvent // click events waiting to be written to the outbox
+
+	clicksWanted atomic.Bool // whether any webhook wants link.clicked, as of the last refresh
+
+	wake chan struct{} // nudges Run to dispatch early
+}
+
+// NewWebhookDispatcher returns a dispatcher over store. A nil client uses one with a 10 second timeout
+func NewWebhookDispatcher(store WebhookStore, client *http.Client, interval time.Duration, maxAttempts int) *WebhookDispatcher {
+	if client == nil {
+		client = defaultWebhookClient
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+
+	return &WebhookDispatcher{
+		store:       store,
+		client:      client,
+		interval:    interval,
+		maxAttempts: maxAttempts,
+		retryBase:   webhookRetryBase,
+		retryMax:    webhookRetryMax,
+		now:         time.Now,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// CreateWebhook subscribes url to events (all of them if there are none). The secret
+// is generated unless one is given, and is only ever returned here
+func (d *WebhookDispatcher) CreateWebhook(ctx context.Context, url, secret string, events []EventType) (Webhook, error) {
+	if err := validateURL(url); err != nil {
+		return Webhook{}, fmt.Errorf("%w: %s", ErrInvalidWebhook, err)
+	}
+	for _, event := range events {
+		if !slices.Contains(eventTypes, event) {
+			return Webhook{}, fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, event)
+		}
+	}
+	if secret == "" {
+		secret = rand.Text()
+	}
+
+	hook := Webhook{
+		ID:        uuid.NewString(),
+		URL:       url,
+		Secret:    secret,
+		Events:    slices.Compact(slices.Sorted(slices.Values(events))),
+		CreatedAt: d.now(),
+	}
+	if err := d.store.SaveWebhook(ctx, hook); err != nil {
+		return Webhook{}, err
+	}
+
+	if hook.wants(EventLinkClicked) {
+		d.clicksWanted.Store(true)
+	}
+	return hook, nil
+}
+
+// ListWebhooks returns every subscription, without secrets
+func (d *WebhookDispatcher) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	hooks, err := d.store.ListWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	return hooks, nil
+}
+
+func (d *WebhookDispatcher) DeleteWebhook(ctx context.Context, id string) error {
+	return d.store.DeleteWebhook(ctx, id)
+}
+
+// nudge asks Run to dispatch now, for events that were just written to the outbox
+func (d *WebhookDispatcher) nudge() {
+	select {
+	case d.wake <- struct{}{}:
+	default: // a run has already been asked for
+	}
+}
+
+// queueClick holds a click event in memory until the next run writes it to the outbox
+func (d *WebhookDispatcher) queueClick(ev WebhookEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.clicks) >= webhookClickBuffer {
+		log.Printf("webhooks: dropped a %s event because the outbox is falling behind", ev.Type)
+		return
+	}
+	d.clicks = append(d.clicks, ev)
+}
+
+// wantsClicks reports whether click events are worth building
+func (d *WebhookDispatcher) wantsClicks() bool {
+	return d.clicksWanted.Load()
+}
+
+// Run dispatches every interval (or as soon as link events are written) until ctx is cancelled.
+// It's meant to be run in its own goroutine
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	runFlusher(ctx, "webhooks", d.interval, d.wake, d.Dispatch)
+}
+
+// Dispatch writes queued click events to the outbox, then sends every delivery that's due
+func (d *WebhookDispatcher) Dispatch(ctx context.Context) error {
+	if err := d.flushClicks(ctx); err != nil {
+		return err
+	}
+
+	if err := d.refresh(ctx); err != nil {
+		return err
+	}
+
+	for {
+		deliveries, err := d.store.ClaimWebhookDeliveries(ctx, d.now(), webhookLease, webhookBatchSize)
+		if err != nil {
+			return err
+		}
+
+		if err := d.deliverAll(ctx, deliveries); err != nil {
+			return err
+		}
+
+		if len(deliveries) < webhookBatchSize {
+			return nil
+		}
+	}
+}
+
+// Drain writes queued click events to the outbox, where they'll be delivered after a restart.
+// It's meant for shutdown, after Run has returned
+func (d *WebhookDispatcher) Drain(ctx context.Context) error {
+	return drainFlusher(ctx, "webhooks", d.flushClicks)
+}
+
+func (d *WebhookDispatcher) flushClicks(ctx context.Context) error {
+	d.mu.Lock()
+	batch := d.clicks
+	d.clicks = nil
+	d.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if err := d.store.EnqueueWebhookEvents(ctx, batch); err != nil {
+		d.mu.Lock()
+		// what's queued meanwhile is newer, so the failed batch goes first
+		d.clicks = append(batch, d.clicks...)
+		if over := len(d.clicks) - webhookClickBuffer; over > 0 {
+			log.Printf("webhooks: dropped %d %s events because the outbox is falling behind", over, EventLinkClicked)
+			d.clicks = d.clicks[:webhookClickBuffer]
+		}
+		d.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// refresh notes whether anyone wants clicks, including webhooks created by other servers
+func (d *WebhookDispatcher) refresh(ctx context.Context) error {
+	hooks, err := d.store.ListWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+
+	d.clicksWanted.Store(slices.ContainsFunc(hooks, func(hook Webhook) bool {
+		return hook.wants(EventLinkClicked)
+	}))
+	return nil
+}
+
+func (d *WebhookDispatcher) deliverAll(ctx context.Context, deliveries []WebhookDelivery) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	slots := make(chan struct{}, webhookConcurrency)
+
+	for _, delivery := range deliveries {
+		slots <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-slots }()
+
+			if err := d.deliver(ctx, delivery); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// deliver makes one attempt at a delivery and records the outcome in the outbox.
+// Only failing to record it is an error: a receiver that's down is what the retries are for
+func (d *WebhookDispatcher) deliver(ctx context.Context, delivery WebhookDelivery) error {
+	sendErr := d.send(ctx, delivery)
+	if sendErr == nil {
+		return d.store.DeleteWebhookDelivery(ctx, delivery.ID)
+	}
+
+	attempts := delivery.Attempts + 1
+	if attempts >= d.maxAttempts {
+		log.Printf("webhooks: giving up on %s event %s for webhook %s after %d attempts: %v",
+			delivery.EventType, delivery.EventID, delivery.WebhookID, attempts, sendErr)
+		return d.store.DeleteWebhookDelivery(ctx, delivery.ID)
+	}
+
+	next := d.now().Add(d.retryDelay(attempts))
+	return d.store.RetryWebhookDelivery(ctx, delivery.ID, next, sendErr.Error())
+}
+
+// retryDelay is how long to wait after the given number of failed attempts: retryBase doubling
+// each time up to retryMax, give or take a little so failed deliveries don't all come back at once
+func (d *WebhookDispatcher) retryDelay(attempts int) time.Duration {
+	delay := d.retryMax
+	if shift := attempts - 1; shift < 32 && d.retryBase<<shift < d.retryMax {
+		delay = d.retryBase << shift
+	}
+
+	jitter := delay / 5
+	if jitter <= 0 {
+		return delay
+	}
+	return delay - jitter/2 + mathrand.N(jitter)
+}
+
+func (d *WebhookDispatcher) send(ctx context.Context, delivery WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+
+	timestamp := d.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, string(delivery.EventType))
+	req.Header.Set(webhookIDHeader, delivery.EventID)
+	req.Header.Set(webhookSignatureHeader,
+		fmt.Sprintf("t=%d,v1=%s", timestamp, SignWebhook(delivery.Secret, timestamp, delivery.Payload)))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // so the connection can be reused
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// events is what a link change should queue in the outbox along with itself: nothing unless
+// webhooks are enabled
+func (s *Shortener) events(event EventType) []EventType {
+	if s.webhooks == nil {
+		return nil
+	}
+	return []EventType{event}
+}
+
+// notify wakes the dispatcher once a link change has queued its events
+func (s *Shortener) notify() {
+	if s.webhooks != nil {
+		s.webhooks.nudge()
+	}
+}
+
+// notifyClick queues a click event; see WebhookDispatcher for why clicks aren't written straight away
+func (s *Shortener) notifyClick(click ClickEvent) {
+	ev, err := clickEvent(click)
+	if err != nil {
+		log.Printf("webhooks: no %s event for %s: %v", EventLinkClicked, click.LinkID, err)
+		return
+	}
+
+	s.webhooks.queueClick(ev)
+}
+
+func (s *Shortener) CreateWebhook(ctx context.Context, url, secret string, events []EventType) (Webhook, error) {
+	if s.webhooks == nil {
+		return Webhook{}, ErrWebhooksDisabled
+	}
+
+	ctx, cancel := s.writeContext(ctx)
+	defer cancel()
+
+	hook, err := s.webhooks.CreateWebhook(ctx, url, secret, events)
+	return hook, contextError(ctx, err)
+}
+
+func (s *Shortener) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	if s.webhooks == nil {
+		return nil, ErrWebhooksDisabled
+	}
+
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+
+	hooks, err := s.webhooks.ListWebhooks(ctx)
+	return hooks, contextError(ctx, err)
+}
+
+func (s *Shortener) DeleteWebhook(ctx context.Context, id string) error {
+	if s.webhooks == nil {
+		return ErrWebhooksDisabled
+	}
+
+	ctx, cancel := s.writeContext(ctx)
+	defer cancel()
+
+	return contextError(ctx, s.webhooks.DeleteWebhook(ctx, id))
+}
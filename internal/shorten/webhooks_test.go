@@ -0,0 +1,521 @@
+package shorten
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"shortener/internal/shared"
+)
+
+// delivered is one request a webhookReceiver got
+type delivered struct {
+	header  http.Header
+	body    []byte
+	payload webhookPayload
+}
+
+// webhookReceiver is an httptest server that records deliveries and answers with status()
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	delivered []delivered
+	status    func(n int) int // n counts requests from 1
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	t.Helper()
+
+	rec := &webhookReceiver{status: func(int) int { return http.StatusNoContent }}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload webhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("delivery is not JSON: %v", err)
+		}
+
+		rec.mu.Lock()
+		rec.delivered = append(rec.delivered, delivered{header: r.Header.Clone(), body: body, payload: payload})
+		n := len(rec.delivered)
+		rec.mu.Unlock()
+
+		w.WriteHeader(rec.status(n))
+	}))
+	t.Cleanup(rec.Close)
+
+	return rec
+}
+
+func (rec *webhookReceiver) received() []delivered {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	return append([]delivered(nil), rec.delivered...)
+}
+
+// testClock is a settable now() for the dispatcher
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// flakyWebhookStore is a MemStore whose outbox can't be written while failing is set
+type flakyWebhookStore struct {
+	*MemStore
+	failing atomic.Bool
+}
+
+func (store *flakyWebhookStore) EnqueueWebhookEvents(ctx context.Context, events []WebhookEvent) error {
+	if store.failing.Load() {
+		return errors.New("database unavailable")
+	}
+	return store.MemStore.EnqueueWebhookEvents(ctx, events)
+}
+
+func newTestWebhooks(t *testing.T, store WebhookStore, rec *webhookReceiver) (*WebhookDispatcher, *testClock) {
+	t.Helper()
+
+	clock := &testClock{now: time.Now()}
+	d := NewWebhookDispatcher(store, rec.Client(), time.Hour, 3)
+	d.now = clock.Now
+	return d, clock
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Link events are signed and delivered to matching webhooks", func(t *testing.T) {
+		rec := newWebhookReceiver(t)
+		others := newWebhookReceiver(t)
+		store := NewMemStore()
+		d, _ := newTestWebhooks(t, store, rec)
+		shortener := NewShortener(store, NewBase62Generator(), WithWebhooks(d))
+
+		hook, err := shortener.CreateWebhook(ctx, rec.URL, "s3cret", []EventType{EventLinkCreated, EventLinkUpdated, EventLinkDeleted})
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		if _, err := shortener.CreateWebhook(ctx, others.URL, "", []EventType{EventLinkDeleted}); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		link, err := shortener.Create(ctx, "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		if _, err := shortener.Update(ctx, link.ID, "https://example.org"); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		if err := shortener.Delete(ctx, link.ID); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		if err := d.Dispatch(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// deliveries go out concurrently, so they can arrive in any order
+		got := make(map[EventType]delivered)
+		for _, delivery := range rec.received() {
+			got[delivery.payload.Type] = delivery
+		}
+		if len(got) != 3 {
+			t.Fatalf("expected created, updated and deleted deliveries, got %d", len(got))
+		}
+		for event, delivery := range got {
+			if delivery.header.Get(webhookEventHeader) != string(event) {
+				t.Fatalf("%s: expected the event header to match the payload", event)
+			}
+			if delivery.payload.Link == nil || delivery.payload.Link.ID != link.ID {
+				t.Fatalf("%s: expected link %s, got %+v", event, link.ID, delivery.payload.Link)
+			}
+			if delivery.header.Get(webhookIDHeader) != delivery.payload.ID {
+				t.Fatalf("%s: expected the event ID header to match the payload", event)
+			}
+
+			var timestamp int64
+			var signature string
+			if _, err := fmt.Sscanf(delivery.header.Get(webhookSignatureHeader), "t=%d,v1=%s", &timestamp, &signature); err != nil {
+				t.Fatalf("%s: malformed signature header: %v", event, err)
+			}
+			if signature != SignWebhook(hook.Secret, timestamp, delivery.body) {
+				t.Fatalf("%s: signature doesn't verify", event)
+			}
+		}
+		updated, deleted := got[EventLinkUpdated].payload.Link, got[EventLinkDeleted].payload.Link
+		if updated.URL != "https://example.org" || deleted.DeletedAt == nil {
+			t.Fatalf("expected the events to carry the link as it was then, got %+v and %+v", updated, deleted)
+		}
+
+		if got := others.received(); len(got) != 1 || got[0].payload.Type != EventLinkDeleted {
+			t.Fatalf("expected only the delete event for the filtered webhook, got %d deliveries", len(got))
+		}
+	})
+
+	t.Run("Failed deliveries are retried with backoff", func(t *testing.T) {
+		rec := newWebhookReceiver(t)
+		rec.status = func(n int) int {
+			if n <= 2 {
+				return http.StatusInternalServerError
+			}
+			return http.StatusOK
+		}
+		store := NewMemStore()
+		d, clock := newTestWebhooks(t, store, rec)
+		d.retryBase = time.Minute
+		shortener := NewShortener(store, NewBase62Generator(), WithWebhooks(d))
+
+		if _, err := shortener.CreateWebhook(ctx, rec.URL, "", nil); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		if _, err := shortener.Create(ctx, "https://example.com"); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		dispatch := func(wantReceived int) {
+			t.Helper()
+			if err := d.Dispatch(ctx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := len(rec.received()); got != wantReceived {
+				t.Fatalf("expected %d deliveries so far, got %d", wantReceived, got)
+			}
+		}
+
+		dispatch(1) // fails
+		dispatch(1) // not due yet
+		clock.Add(2 * time.Minute)
+		dispatch(2) // fails again, next retry waits about twice as long
+		clock.Add(time.Minute + 30*time.Second)
+		dispatch(2)
+		clock.Add(time.Minute)
+		dispatch(3) // succeeds
+		clock.Add(time.Hour)
+		dispatch(3) // and isn't sent again
+
+		got := rec.received()
+		if got[0].payload.ID != got[2].payload.ID {
+			t.Fatal("expected retries to carry the same event ID")
+		}
+	})
+
+	t.Run("Deliveries are given up after maxAttempts", func(t *testing.T) {
+		rec := newWebhookReceiver(t)
+		rec.status = func(int) int { return http.StatusBadGateway }
+		store := NewMemStore()
+		d, clock := newTestWebhooks(t, store, rec)
+		shortener := NewShortener(store, NewBase62Generator(), WithWebhooks(d))
+
+		if _, err := shortener.CreateWebhook(ctx, rec.URL, "", nil); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		if _, err := shortener.Create(ctx, "https://example.com"); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		for range 5 {
+			if err := d.Dispatch(ctx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			clock.Add(2 * time.Hour)
+		}
+
+		if got := len(rec.received()); got != 3 {
+			t.Fatalf("expected 3 attempts, got %d", got)
+		}
+		if got := len(store.deliveries); got != 0 {
+			t.Fatalf("expected the delivery to be dropped, got %d left", got)
+		}
+	})
+
+	t.Run("Clicks are batched", func(t *testing.T) {
+		rec := newWebhookReceiver(t)
+		store := NewMemStore()
+		d, _ := newTestWebhooks(t, store, rec)
+		shortener := NewShortener(store, NewBase62Generator(), WithWebhooks(d))
+
+		link, err := shortener.Create(ctx, "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		if _, err := shortener.Resolve(ctx, link.ID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(d.clicks) != 0 {
+			t.Fatal("expected no click events while no webhook wants them")
+		}
+
+		if _, err := shortener.CreateWebhook(ctx, rec.URL, "", []EventType{EventLinkClicked}); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		_, err = shortener.ResolveVisit(ctx, link.ID, Visit{At: time.Now(), UserAgent: firefoxUA, Referrer: "https://news.example.org/"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(store.deliveries) != 0 {
+			t.Fatal("expected the click to wait in memory, not go to the outbox straight away")
+		}
+
+		if err := d.Dispatch(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got := rec.received()
+		if len(got) != 1 || got[0].payload.Click == nil {
+			t.Fatalf("expected one click delivery, got %d", len(got))
+		}
+		if click := got[0].payload.Click; click.Short != link.ID || click.Browser != "Firefox" || click.Referrer != "news.example.org" {
+			t.Fatalf("unexpected click %+v", click)
+		}
+	})
+
+	t.Run("Link events are written with the change", func(t *testing.T) {
+		rec := newWebhookReceiver(t)
+		store := NewMemStore()
+		d, _ := newTestWebhooks(t, store, rec)
+		shortener := NewShortener(store, NewBase62Generator(), WithWebhooks(d))
+
+		if _, err := shortener.CreateWebhook(ctx, rec.URL, "", nil); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		link, err := shortener.Create(ctx, "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		if err := shortener.Delete(ctx, link.ID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := len(store.deliveries); got != 2 {
+			t.Fatalf("expected the create and the delete in the outbox straight away, got %d deliveries", got)
+		}
+
+		// a change that didn't happen has nothing to tell
+		if err := shortener.Delete(ctx, link.ID); !errors.Is(err, ErrDeleted) {
+			t.Fatalf("expected ErrDeleted, got %v", err)
+		}
+		if _, err := shortener.Update(ctx, link.ID, "https://example.org"); !errors.Is(err, ErrDeleted) {
+			t.Fatalf("expected ErrDeleted, got %v", err)
+		}
+		if got := len(store.deliveries); got != 2 {
+			t.Fatalf("expected no events for failed changes, got %d deliveries", got)
+		}
+
+		if err := d.Dispatch(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		types := map[EventType]*ShortLink{}
+		for _, got := range rec.received() {
+			types[got.payload.Type] = got.payload.Link
+		}
+		if len(types) != 2 || types[EventLinkCreated] == nil || types[EventLinkDeleted] == nil || types[EventLinkDeleted].DeletedAt == nil {
+			t.Fatalf("expected a created and a deleted event, got %v", types)
+		}
+	})
+
+	t.Run("Clicks wait in memory while the outbox is down", func(t *testing.T) {
+		rec := newWebhookReceiver(t)
+		store := &flakyWebhookStore{MemStore: NewMemStore()}
+		d, _ := newTestWebhooks(t, store, rec)
+		shortener := NewShortener(store, NewBase62Generator(), WithWebhooks(d))
+
+		if _, err := shortener.CreateWebhook(ctx, rec.URL, "", []EventType{EventLinkClicked}); err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+		link, err := shortener.Create(ctx, "https://example.com")
+		if err != nil {
+			t.Fatalf("setup failed: %v", err)
+		}
+
+		store.failing.Store(true)
+		if _, err := shortener.Resolve(ctx, link.ID); err != nil {
+			t.Fatalf("a broken outbox must not fail the redirect, got %v", err)
+		}
+		if err := d.Dispatch(ctx); err == nil {
+			t.Fatal("expected an error while the outbox is down")
+		}
+
+		store.failing.Store(false)
+		if err := d.Drain(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := d.Dispatch(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := len(rec.received()); got != 1 {
+			t.Fatalf("expected the click to be delivered after all, got %d deliveries", got)
+		}
+	})
+
+	t.Run("Invalid webhooks are rejected", func(t *testing.T) {
+		d := NewWebhookDispatcher(NewMemStore(), nil, time.Hour, 3)
+
+		for _, tt := range []struct {
+			url    string
+			events []EventType
+		}{
+			{"ftp://example.com/hook", nil},
+			{"https://example.com/hook", []EventType{"link.exploded"}},
+		} {
+			if _, err := d.CreateWebhook(ctx, tt.url, "", tt.events); !errors.Is(err, ErrInvalidWebhook) {
+				t.Fatalf("%s %v: expected ErrInvalidWebhook, got %v", tt.url, tt.events, err)
+			}
+		}
+	})
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	d := NewWebhookDispatcher(NewMemStore(), nil, time.Hour, 10)
+	d.retryBase = 10 * time.Second
+	d.retryMax = time.Minute
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, time.Minute},
+		{100, time.Minute},
+	}
+
+	for _, tt := range tests {
+		got := d.retryDelay(tt.attempts)
+		if got < tt.want*9/10 || got > tt.want*11/10 {
+			t.Fatalf("retryDelay(%d) = %s, want about %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestReaper_ReportExpired(t *testing.T) {
+	ctx := context.Background()
+	rec := newWebhookReceiver(t)
+	store := NewMemStore()
+	d, _ := newTestWebhooks(t, store, rec)
+	shortener := NewShortener(store, NewBase62Generator(), WithWebhooks(d))
+
+	if _, err := shortener.CreateWebhook(ctx, rec.URL, "", []EventType{EventLinkExpired}); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	// two replicas' reapers
+	reaper := NewReaper(store, time.Minute, time.Hour)
+	reaper.NotifyExpired(d)
+	other := NewReaper(store, time.Minute, time.Hour)
+	other.NotifyExpired(d)
+
+	expiresAt := time.Now().Add(time.Minute)
+	link, err := shortener.CreateWithOptions(ctx, "https://example.com", CreateOptions{ExpiresAt: &expiresAt})
+	if err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+	if _, err := shortener.Create(ctx, "https://example.org"); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+
+	// nothing has expired yet
+	if err := reaper.ReportExpired(ctx, time.Now()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// every report covers the expiry, but the link is only reported once
+	for _, r := range []*Reaper{reaper, other, reaper} {
+		if err := r.ReportExpired(ctx, expiresAt.Add(time.Second)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if err := d.Dispatch(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := rec.received()
+	if len(got) != 1 || got[0].payload.Type != EventLinkExpired || got[0].payload.Link.ID != link.ID {
+		t.Fatalf("expected one link.expired event for %s, got %d deliveries", link.ID, len(got))
+	}
+
+	// should the event be queued again anyway, receivers can tell it's the same one
+	stored, err := store.Get(ctx, link.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	again, err := linkEvent(EventLinkExpired, stored, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if again.ID != got[0].payload.ID {
+		t.Fatalf("expected the event ID to stay %s, got %s", got[0].payload.ID, again.ID)
+	}
+}
+
+func TestHandleWebhooks(t *testing.T) {
+	rec := newWebhookReceiver(t)
+	store := NewMemStore()
+	d, _ := newTestWebhooks(t, store, rec)
+	shortener := NewShortener(store, NewBase62Generator(), WithWebhooks(d))
+
+	keys := shared.NewKeyAuth(store)
+	adminKey, _, _ := keys.Mint(context.Background(), "admin", "", []shared.Scope{shared.ScopeAdmin})
+	mux := http.NewServeMux()
+	RegisterRoutes(mux, shortener, WithAPIKeys(keys))
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", adminKey)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(http.MethodPost, "/admin/webhooks", `{"url":"`+rec.URL+`","events":["link.created"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var created webhookResponse
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if created.ID == "" || created.Secret == "" {
+		t.Fatalf("expected an ID and a generated secret, got %+v", created)
+	}
+
+	if w := serve(http.MethodPost, "/admin/webhooks", `{"url":"not a url"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+
+	w = serve(http.MethodGet, "/admin/webhooks", "")
+	var list webhookListResponse
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(list.Webhooks) != 1 || list.Webhooks[0].ID != created.ID || list.Webhooks[0].Secret != "" {
+		t.Fatalf("expected the webhook without its secret, got %+v", list.Webhooks)
+	}
+
+	if w := serve(http.MethodDelete, "/admin/webhooks/"+created.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if w := serve(http.MethodDelete, "/admin/webhooks/"+created.ID, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+}